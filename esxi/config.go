@@ -1,8 +1,10 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 )
 
 // Config struct contains configuration data for the ESXi host
@@ -11,18 +13,88 @@ type Config struct {
 	esxiHostPort string
 	esxiUserName string
 	esxiPassword string
+
+	esxiPrivateKey           string
+	esxiPrivateKeyPassphrase string
+	esxiUseAgent             bool
+
+	esxiKnownHostsFile        string
+	esxiHostKeyFingerprint    string
+	esxiInsecureIgnoreHostKey bool
+
+	esxiBastion *SSHConnectionSettings
+
+	retryPolicy retryPolicy
+	maxSessions int
+
+	sshPool  *sshClientPool
+	executor hostExecutor
+
+	guestLocks        keyedMutex
+	resourcePoolLocks keyedMutex
+
+	inventory hostInventory
+}
+
+// sshConnectionSettings returns the SSH connection settings for the ESXi host,
+// including the pooled connection shared by every resource.
+func (c *Config) sshConnectionSettings() SSHConnectionSettings {
+	return SSHConnectionSettings{
+		host: c.esxiHostName,
+		port: c.esxiHostPort,
+		user: c.esxiUserName,
+		pass: c.esxiPassword,
+
+		privateKey:           c.esxiPrivateKey,
+		privateKeyPassphrase: c.esxiPrivateKeyPassphrase,
+		useAgent:             c.esxiUseAgent,
+
+		knownHostsFile:        c.esxiKnownHostsFile,
+		hostKeyFingerprint:    c.esxiHostKeyFingerprint,
+		insecureIgnoreHostKey: c.esxiInsecureIgnoreHostKey,
+
+		retry:       c.retryPolicy,
+		maxSessions: c.maxSessions,
+		bastion:     c.esxiBastion,
+		pool:        c.sshPool,
+	}
+}
+
+// lockGuest serializes changes to the vmx file of guest vmid.  Call the
+// returned function to unlock.
+func (c *Config) lockGuest(ctx context.Context, vmid string) (func(), error) {
+	unlock, err := c.guestLocks.lock(ctx, vmid)
+	if err != nil {
+		return nil, newTimeoutError("lock guest "+vmid, err)
+	}
+	return unlock, nil
+}
+
+// lockResourcePools serializes lookups and changes of the named resource
+// pools.  Pools are keyed by the last element of their path, since that
+// is how getResourcePoolID finds them.  Call the returned function to unlock.
+func (c *Config) lockResourcePools(ctx context.Context, names ...string) (func(), error) {
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, name[strings.LastIndex(name, "/")+1:])
+	}
+
+	unlock, err := c.resourcePoolLocks.lock(ctx, keys...)
+	if err != nil {
+		return nil, newTimeoutError("lock resource pool "+strings.Join(names, ", "), err)
+	}
+	return unlock, nil
 }
 
 // validateEsxiCredentials tests the ESXi credentials by attempting to connect to ESXi host
-func (c *Config) validateEsxiCredentials() error {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func (c *Config) validateEsxiCredentials(ctx context.Context) error {
 	log.Printf("[validateEsxiCreds]\n")
 
 	var remoteCmd string
 	var err error
 
 	remoteCmd = fmt.Sprintf("vmware --version")
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Connectivity test, get vmware version")
+	_, err = c.executor.runReadOnly(ctx, remoteCmd, "Connectivity test, get vmware version")
 	if err != nil {
 		return fmt.Errorf("Failed to connect to esxi host: %s", err)
 	}
@@ -0,0 +1,56 @@
+package esxi
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// parseEsxcliCSV parses the output of esxcli --formatter=csv into one map
+// per row, keyed by the column names of the header.  esxcli ends every
+// line with a comma, so the empty last column is dropped.
+func parseEsxcliCSV(output string) ([]map[string]string, error) {
+	r := csv.NewReader(strings.NewReader(output))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse esxcli output: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Failed to parse esxcli output: no header in %q", output)
+	}
+
+	header := records[0]
+	var rows []map[string]string
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, value := range record {
+			if i < len(header) && header[i] != "" {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseDatastores returns the names of the datastores in the output of
+// esxcli --formatter=csv storage filesystem list.  Boot bank and OSDATA
+// volumes are not datastores.
+func parseDatastores(output string) ([]string, error) {
+	rows, err := parseEsxcliCSV(output)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, row := range rows {
+		fsType := row["Type"]
+		if row["Volume Name"] == "" || !(strings.HasPrefix(fsType, "VMFS-") || strings.HasPrefix(fsType, "NFS") ||
+			strings.EqualFold(fsType, "vsan") || strings.EqualFold(fsType, "vvol")) {
+			continue
+		}
+		names = append(names, row["Volume Name"])
+	}
+	return names, nil
+}
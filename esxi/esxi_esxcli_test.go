@@ -0,0 +1,52 @@
+package esxi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseEsxcliCSV(t *testing.T) {
+	rows, err := parseEsxcliCSV("Name,Value,\n\"a, b\",\"say \"\"hi\"\"\",\nshort,\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]string{
+		{"Name": "a, b", "Value": `say "hi"`},
+		{"Name": "short", "Value": ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("rows: %v", rows)
+	}
+
+	for _, output := range []string{"", "Name,Value,\n\"unterminated,\n"} {
+		if rows, err := parseEsxcliCSV(output); err == nil {
+			t.Errorf("%q parsed: %v", output, rows)
+		}
+	}
+}
+
+func TestParseDatastoresVersions(t *testing.T) {
+	// Boot banks are vfat, and from 7.0 on OSDATA is VMFSOS.  Neither holds
+	// guests.
+	expected := map[string][]string{
+		"esxi65": {"datastore1", "nfs-iso"},
+		"esxi67": {"ssd 1", "hdd2", "nfs41-backup"},
+		"esxi70": {"datastore1", "vsanDatastore"},
+		"esxi80": {"nvme-ds", "Lab, Shared", "vvol-ds"},
+	}
+
+	for version, want := range expected {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "esxcli", "storage-filesystem-list", version+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := parseDatastores(string(data))
+		if err != nil {
+			t.Errorf("%s: %s", version, err)
+		} else if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: datastores %q, want %q", version, names, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package esxi
+
+import (
+	"context"
+)
+
+// hostExecutor runs commands and writes files on the ESXi host.  Config holds
+// one so host functions can be exercised without a real host.
+type hostExecutor interface {
+	// run runs a command that may change the host
+	run(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error)
+
+	// runReadOnly runs a command that does not change the host and may be retried
+	runReadOnly(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error)
+
+	// writeFile replaces path on the host with content, keeping path.bak if backup is set
+	writeFile(ctx context.Context, path string, content string, backup bool) error
+}
+
+// sshExecutor runs commands on the ESXi host over the pooled SSH connection
+type sshExecutor struct {
+	esxiSSHinfo SSHConnectionSettings
+}
+
+// newSSHExecutor returns an executor for the host described by esxiSSHinfo
+func newSSHExecutor(esxiSSHinfo SSHConnectionSettings) *sshExecutor {
+	return &sshExecutor{esxiSSHinfo: esxiSSHinfo}
+}
+
+func (e *sshExecutor) run(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error) {
+	return runCommandOnHost(ctx, e.esxiSSHinfo, remoteCmd, shortCmdDesc)
+}
+
+func (e *sshExecutor) runReadOnly(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error) {
+	return runReadOnlyCommandOnHost(ctx, e.esxiSSHinfo, remoteCmd, shortCmdDesc)
+}
+
+func (e *sshExecutor) writeFile(ctx context.Context, path string, content string, backup bool) error {
+	return writeFileOnHost(ctx, e.esxiSSHinfo, path, content, backup)
+}
@@ -0,0 +1,137 @@
+package esxi
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// fakeExecutor is a scriptable hostExecutor.  Each command is answered by the
+// first scripted response whose pattern matches it; files are kept in memory.
+type fakeExecutor struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	responses []*fakeResponse
+	commands  []string
+	files     map[string]string
+}
+
+// fakeResponse is a canned answer to the commands matching pattern
+type fakeResponse struct {
+	pattern *regexp.Regexp
+	result  remoteCmdResult
+	once    bool
+	used    bool
+}
+
+// newFakeExecutor returns a fake host that fails the test on unscripted commands
+func newFakeExecutor(t *testing.T) *fakeExecutor {
+	return &fakeExecutor{
+		t:     t,
+		files: make(map[string]string),
+	}
+}
+
+// testConfig returns a provider config that talks to executor
+func testConfig(executor hostExecutor) *Config {
+	return &Config{
+		esxiHostName: "esxi.test",
+		esxiHostPort: "22",
+		esxiUserName: "root",
+		retryPolicy:  defaultRetryPolicy(),
+		executor:     executor,
+	}
+}
+
+// on answers commands matching pattern with stdout and exit status 0
+func (f *fakeExecutor) on(pattern string, stdout string) *fakeExecutor {
+	return f.add(pattern, remoteCmdResult{stdout: stdout}, false)
+}
+
+// onNext is like on, but answers only the next matching command
+func (f *fakeExecutor) onNext(pattern string, stdout string) *fakeExecutor {
+	return f.add(pattern, remoteCmdResult{stdout: stdout}, true)
+}
+
+// onFailure answers commands matching pattern with stderr and a non-zero exit status
+func (f *fakeExecutor) onFailure(pattern string, stderr string, exitCode int) *fakeExecutor {
+	return f.add(pattern, remoteCmdResult{stderr: stderr, exitCode: exitCode}, false)
+}
+
+// onNextFailure is like onFailure, but answers only the next matching command
+func (f *fakeExecutor) onNextFailure(pattern string, stderr string, exitCode int) *fakeExecutor {
+	return f.add(pattern, remoteCmdResult{stderr: stderr, exitCode: exitCode}, true)
+}
+
+func (f *fakeExecutor) add(pattern string, result remoteCmdResult, once bool) *fakeExecutor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.responses = append(f.responses, &fakeResponse{
+		pattern: regexp.MustCompile(pattern),
+		result:  result,
+		once:    once,
+	})
+	return f
+}
+
+// ran reports whether a command matching pattern was run
+func (f *fakeExecutor) ran(pattern string) bool {
+	return f.count(pattern) > 0
+}
+
+// count returns how many commands matching pattern were run
+func (f *fakeExecutor) count(pattern string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	re := regexp.MustCompile(pattern)
+	n := 0
+	for _, cmd := range f.commands {
+		if re.MatchString(cmd) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeExecutor) run(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commands = append(f.commands, remoteCmd)
+
+	for _, r := range f.responses {
+		if (r.once && r.used) || !r.pattern.MatchString(remoteCmd) {
+			continue
+		}
+		r.used = true
+
+		if r.result.exitCode != 0 {
+			return r.result, newRemoteCmdError(shortCmdDesc, r.result, errors.New("Process exited with non-zero status"))
+		}
+		return r.result, nil
+	}
+
+	f.t.Errorf("fake host: unscripted command %q (%s)", remoteCmd, shortCmdDesc)
+	result := remoteCmdResult{stderr: "sh: unscripted command", exitCode: 127}
+	return result, newRemoteCmdError(shortCmdDesc, result, errors.New("Process exited with status 127"))
+}
+
+func (f *fakeExecutor) runReadOnly(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error) {
+	return f.run(ctx, remoteCmd, shortCmdDesc)
+}
+
+func (f *fakeExecutor) writeFile(ctx context.Context, path string, content string, backup bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if old, ok := f.files[path]; ok && backup {
+		f.files[path+".bak"] = old
+	}
+	f.files[path] = content
+	return nil
+}
@@ -0,0 +1,55 @@
+package esxi
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// testFakeHost starts a fake ESXi host with datastore ds1 and returns it
+// with a provider config that talks to it over SSH
+func testFakeHost(t *testing.T) (*fakeESXiHost, *fakeSSHServer, *Config) {
+	host := newFakeESXiHost("ds1")
+	server := startFakeSSHServer(t, host)
+	return host, server, server.providerConfig(t)
+}
+
+// testResourceData returns resource data for r built from raw, with id set
+func testResourceData(t *testing.T, r *schema.Resource, id string, raw map[string]interface{}) *schema.ResourceData {
+	d := schema.TestResourceDataRaw(t, r.Schema, raw)
+	d.SetId(id)
+	return d
+}
+
+// testResourceUpdate returns resource data for updating state to raw, so
+// the old values are seen by d.GetChange
+func testResourceUpdate(t *testing.T, r *schema.Resource, state *terraform.InstanceState, raw map[string]interface{}) *schema.ResourceData {
+	cfg, err := config.NewRawConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := schema.InternalMap(r.Schema)
+	diff, err := sm.Diff(state, terraform.NewResourceConfig(cfg), nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := sm.Data(state, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testImport imports id and refreshes it, as terraform import does
+func testImport(t *testing.T, r *schema.Resource, id string, c *Config) (*schema.ResourceData, error) {
+	imported, err := r.Importer.State(testResourceData(t, r, id, nil), c)
+	if err != nil {
+		return nil, err
+	}
+	if len(imported) != 1 {
+		t.Fatalf("import returned %d resources", len(imported))
+	}
+	return imported[0], r.Read(imported[0], c)
+}
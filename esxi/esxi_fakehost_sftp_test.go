@@ -0,0 +1,263 @@
+package esxi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+//
+//  The sftp subsystem of the fake host.  Only what writeFileOnHost uses is
+//  served: reading, writing and stat of files, remove, and both renames.
+//
+
+const (
+	sftpPacketExtended = 200
+	sftpPacketStatus   = 101
+
+	sftpStatusOK         = 0
+	sftpStatusNoSuchFile = 2
+	sftpStatusFailure    = 4
+)
+
+// serveSFTP serves the sftp subsystem on channel until the client closes it
+func (h *fakeESXiHost) serveSFTP(channel io.ReadWriteCloser) {
+	handler := fakeSFTPHandler{h}
+	server := sftp.NewRequestServer(&fakeSFTPConn{host: h, channel: channel}, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	})
+	server.Serve()
+}
+
+// rename moves the file from to to.  Like OpenSSH's sftp-server, a plain
+// rename refuses to replace an existing file and a posix rename does not.
+func (h *fakeESXiHost) rename(from string, to string, replace bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	from, to = path.Clean(from), path.Clean(to)
+	f, ok := h.files[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if f.dir {
+		return errors.New("Is a directory")
+	}
+	if _, ok := h.files[to]; ok && !replace {
+		return errors.New("File exists")
+	}
+	if parent, ok := h.files[path.Dir(to)]; !ok || !parent.dir {
+		return os.ErrNotExist
+	}
+
+	h.files[to] = f
+	delete(h.files, from)
+	return nil
+}
+
+// fakeSFTPConn passes sftp packets from the client to a RequestServer.  The
+// RequestServer in this version of pkg/sftp cannot parse the
+// posix-rename@openssh.com extension, so those packets are answered here.
+type fakeSFTPConn struct {
+	host    *fakeESXiHost
+	channel io.ReadWriteCloser
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (c *fakeSFTPConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(c.channel, length); err != nil {
+			return 0, err
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err := io.ReadFull(c.channel, packet); err != nil {
+			return 0, err
+		}
+		if !c.posixRename(packet) {
+			c.pending = append(length, packet...)
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *fakeSFTPConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.channel.Write(p)
+}
+
+func (c *fakeSFTPConn) Close() error {
+	return c.channel.Close()
+}
+
+// posixRename carries out packet and replies to it if it is a
+// posix-rename@openssh.com request
+func (c *fakeSFTPConn) posixRename(packet []byte) bool {
+	if len(packet) == 0 || packet[0] != sftpPacketExtended {
+		return false
+	}
+	var request struct {
+		ID        uint32
+		Extension string
+		From      string
+		To        string
+	}
+	if err := ssh.Unmarshal(packet[1:], &request); err != nil || request.Extension != "posix-rename@openssh.com" {
+		return false
+	}
+
+	reply := struct {
+		ID       uint32
+		Code     uint32
+		Message  string
+		Language string
+	}{ID: request.ID, Code: sftpStatusOK}
+	if err := c.host.rename(request.From, request.To, true); err != nil {
+		reply.Code = sftpStatusFailure
+		if os.IsNotExist(err) {
+			reply.Code = sftpStatusNoSuchFile
+		}
+		reply.Message = err.Error()
+	}
+
+	body := append([]byte{sftpPacketStatus}, ssh.Marshal(reply)...)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)))
+	c.Write(append(length, body...))
+	return true
+}
+
+// fakeSFTPHandler serves sftp requests from the fake host's files
+type fakeSFTPHandler struct {
+	host *fakeESXiHost
+}
+
+func (s fakeSFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	s.host.mu.Lock()
+	defer s.host.mu.Unlock()
+
+	data, err := s.host.readFile(r.Filepath)
+	if err == errFakeNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (s fakeSFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	s.host.mu.Lock()
+	defer s.host.mu.Unlock()
+
+	if _, ok := s.host.stat(r.Filepath); !ok || r.Pflags().Trunc {
+		if err := s.host.writeFile(r.Filepath, nil); err != nil {
+			return nil, err
+		}
+	}
+	return fakeSFTPFile{s.host, r.Filepath}, nil
+}
+
+func (s fakeSFTPHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Rename":
+		return s.host.rename(r.Filepath, r.Target, false)
+	case "Remove":
+		s.host.mu.Lock()
+		defer s.host.mu.Unlock()
+
+		f, ok := s.host.stat(r.Filepath)
+		if !ok {
+			return os.ErrNotExist
+		}
+		if f.dir {
+			return errors.New("Is a directory")
+		}
+		delete(s.host.files, path.Clean(r.Filepath))
+		return nil
+	}
+	return errors.New("Operation unsupported")
+}
+
+func (s fakeSFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method != "Stat" {
+		return nil, errors.New("Operation unsupported")
+	}
+
+	s.host.mu.Lock()
+	defer s.host.mu.Unlock()
+
+	f, ok := s.host.stat(r.Filepath)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return fakeSFTPStat{fakeFileInfo{name: path.Base(r.Filepath), size: int64(len(f.data)), dir: f.dir}}, nil
+}
+
+// fakeSFTPStat lists the one file a Stat request asked for
+type fakeSFTPStat []os.FileInfo
+
+func (l fakeSFTPStat) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(infos, l[offset:]), nil
+}
+
+// fakeFileInfo describes a file on the fake host
+type fakeFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fakeFileInfo) Name() string       { return i.name }
+func (i fakeFileInfo) Size() int64        { return i.size }
+func (i fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeFileInfo) IsDir() bool        { return i.dir }
+func (i fakeFileInfo) Sys() interface{}   { return nil }
+
+func (i fakeFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// fakeSFTPFile writes to a file on the fake host
+type fakeSFTPFile struct {
+	host *fakeESXiHost
+	name string
+}
+
+func (f fakeSFTPFile) WriteAt(p []byte, off int64) (int, error) {
+	f.host.mu.Lock()
+	defer f.host.mu.Unlock()
+
+	file, ok := f.host.files[path.Clean(f.name)]
+	if !ok || file.dir {
+		return 0, os.ErrNotExist
+	}
+	if end := off + int64(len(p)); end > int64(len(file.data)) {
+		file.data = append(file.data, make([]byte, end-int64(len(file.data)))...)
+	}
+	return copy(file.data[off:], p), nil
+}
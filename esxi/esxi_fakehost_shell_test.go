@@ -0,0 +1,913 @@
+package esxi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+//  fakeShell interprets the subset of busybox sh the provider sends to the
+//  host: pipelines, && || ; lists, { } groups, > and 2> redirections,
+//  variables and $( ) substitutions, and the text utilities used to pick
+//  apart vim-cmd output.  Expansions are never split into fields, as if
+//  they were always quoted.
+//
+
+// shellToken is a word, or an operator when op is set
+type shellToken struct {
+	op     string
+	word   string
+	quoted bool
+}
+
+// fakeShellList is a sequence of pipelines joined by && || or ;
+type fakeShellList struct {
+	pipelines []*fakeShellPipeline
+	ops       []string
+}
+
+// fakeShellPipeline is a sequence of commands joined by |
+type fakeShellPipeline struct {
+	commands []*fakeShellCommand
+}
+
+// fakeShellCommand is either a { } group or a simple command with redirections
+type fakeShellCommand struct {
+	group          *fakeShellList
+	args           []string
+	stdoutFile     string
+	stderrNull     bool
+	stderrToStdout bool
+}
+
+// fakeCommand is a command the fake host can run
+type fakeCommand func(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int
+
+// fakeShellEnv is the state of one shell: its variables and the exit
+// status of the last pipeline
+type fakeShellEnv struct {
+	vars   map[string]string
+	status int
+}
+
+// shellAssignmentRe matches a variable assignment
+var shellAssignmentRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=`)
+
+// errShellExit unwinds a list when the exit builtin runs
+type errShellExit struct {
+	status int
+}
+
+func (e *errShellExit) Error() string {
+	return fmt.Sprintf("exit %d", e.status)
+}
+
+// tokenizeShell splits a command line into words and operators
+func tokenizeShell(cmd string) ([]shellToken, error) {
+	var tokens []shellToken
+	var word bytes.Buffer
+	inWord, quoted := false, false
+
+	endWord := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{word: word.String(), quoted: quoted})
+		}
+		word.Reset()
+		inWord, quoted = false, false
+	}
+
+	for i := 0; i < len(cmd); i++ {
+		ch := cmd[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			endWord()
+
+		case ch == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+			inWord, quoted = true, true
+
+		case ch == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				if cmd[i] == '$' {
+					expansion, end, err := scanShellExpansion(cmd, i)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(expansion)
+					i = end
+					continue
+				}
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("\"\\$`", cmd[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(cmd[i])
+			}
+			if i >= len(cmd) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			inWord, quoted = true, true
+
+		case ch == '\\':
+			if i+1 < len(cmd) {
+				i++
+				word.WriteByte(cmd[i])
+			}
+			inWord, quoted = true, true
+
+		case ch == '$':
+			expansion, end, err := scanShellExpansion(cmd, i)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(expansion)
+			i = end
+			inWord = true
+
+		case ch == '|' || ch == '&' || ch == ';':
+			endWord()
+			op := string(ch)
+			if ch != ';' && i+1 < len(cmd) && cmd[i+1] == ch {
+				op += string(ch)
+				i++
+			}
+			if op == "&" {
+				return nil, fmt.Errorf("background jobs are not supported")
+			}
+			tokens = append(tokens, shellToken{op: op})
+
+		case ch == '>':
+			op := ">"
+			if inWord && !quoted && word.String() == "2" {
+				word.Reset()
+				inWord = false
+				op = "2>"
+				if strings.HasPrefix(cmd[i+1:], "&1") {
+					op = "2>&1"
+					i += 2
+				}
+			}
+			endWord()
+			tokens = append(tokens, shellToken{op: op})
+
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	endWord()
+
+	return tokens, nil
+}
+
+var shellNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// scanShellExpansion reads the expansion starting at the '$' at cmd[i].  It
+// returns the expansion encoded between NUL bytes for expandShellWord, and
+// the index of its last byte.  A '$' that starts no expansion is itself.
+func scanShellExpansion(cmd string, i int) (string, int, error) {
+	rest := cmd[i+1:]
+	switch {
+	case strings.HasPrefix(rest, "("):
+		depth := 0
+		for j := i + 1; j < len(cmd); j++ {
+			switch cmd[j] {
+			case '\\':
+				j++
+			case '\'':
+				end := strings.IndexByte(cmd[j+1:], '\'')
+				if end < 0 {
+					return "", 0, fmt.Errorf("unterminated quoted string")
+				}
+				j += end + 1
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					return "\x00(" + cmd[i+2:j] + "\x00", j, nil
+				}
+			}
+		}
+		return "", 0, fmt.Errorf("missing )")
+
+	case strings.HasPrefix(rest, "{"):
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing }")
+		}
+		return "\x00$" + rest[1:end] + "\x00", i + 1 + end, nil
+
+	case strings.HasPrefix(rest, "?"):
+		return "\x00$?\x00", i + 1, nil
+
+	default:
+		name := shellNameRe.FindString(rest)
+		if name == "" {
+			return "$", i, nil
+		}
+		return "\x00$" + name + "\x00", i + len(name), nil
+	}
+}
+
+// expandShellWord replaces the expansions in word with their values.  The
+// status is that of the last command substitution, or 0.
+func (h *fakeESXiHost) expandShellWord(word string, env *fakeShellEnv, stderr io.Writer) (string, int, error) {
+	if !strings.Contains(word, "\x00") {
+		return word, 0, nil
+	}
+
+	var buf bytes.Buffer
+	status := 0
+	parts := strings.Split(word, "\x00")
+	for i, part := range parts {
+		switch {
+		case i%2 == 0:
+			buf.WriteString(part)
+		case part == "$?":
+			buf.WriteString(strconv.Itoa(env.status))
+		case strings.HasPrefix(part, "$"):
+			buf.WriteString(env.vars[part[1:]])
+		default:
+			list, err := parseShell(part[1:])
+			if err != nil {
+				fmt.Fprintf(stderr, "sh: %s\n", err)
+				status = 2
+				continue
+			}
+			var out bytes.Buffer
+			subshell := &fakeShellEnv{vars: make(map[string]string), status: env.status}
+			for k, v := range env.vars {
+				subshell.vars[k] = v
+			}
+			status, err = h.runShellList(list, subshell, strings.NewReader(""), &out, stderr)
+			if e, ok := err.(*errShellExit); ok {
+				status = e.status
+			} else if err != nil {
+				return "", status, err
+			}
+			buf.WriteString(strings.TrimRight(out.String(), "\n"))
+		}
+	}
+	return buf.String(), status, nil
+}
+
+// parseShell parses a command line into a list
+func parseShell(cmd string) (*fakeShellList, error) {
+	tokens, err := tokenizeShell(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	list, rest, err := parseShellList(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("syntax error near %q", rest[0].word+rest[0].op)
+	}
+	return list, nil
+}
+
+func isShellWord(t shellToken, word string) bool {
+	return t.op == "" && !t.quoted && t.word == word
+}
+
+func parseShellList(tokens []shellToken) (*fakeShellList, []shellToken, error) {
+	list := &fakeShellList{}
+
+	for {
+		pipeline, rest, err := parseShellPipeline(tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		list.pipelines = append(list.pipelines, pipeline)
+		tokens = rest
+
+		if len(tokens) == 0 || (tokens[0].op != "&&" && tokens[0].op != "||" && tokens[0].op != ";") {
+			return list, tokens, nil
+		}
+		op := tokens[0].op
+		tokens = tokens[1:]
+
+		// A trailing ; before } or the end of the line ends the list
+		if op == ";" && (len(tokens) == 0 || isShellWord(tokens[0], "}")) {
+			return list, tokens, nil
+		}
+		list.ops = append(list.ops, op)
+	}
+}
+
+func parseShellPipeline(tokens []shellToken) (*fakeShellPipeline, []shellToken, error) {
+	pipeline := &fakeShellPipeline{}
+
+	for {
+		command, rest, err := parseShellCommand(tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		pipeline.commands = append(pipeline.commands, command)
+		tokens = rest
+
+		if len(tokens) == 0 || tokens[0].op != "|" {
+			return pipeline, tokens, nil
+		}
+		tokens = tokens[1:]
+	}
+}
+
+func parseShellCommand(tokens []shellToken) (*fakeShellCommand, []shellToken, error) {
+	command := &fakeShellCommand{}
+
+	if len(tokens) > 0 && isShellWord(tokens[0], "{") {
+		group, rest, err := parseShellList(tokens[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 || !isShellWord(rest[0], "}") {
+			return nil, nil, fmt.Errorf("missing }")
+		}
+		command.group = group
+		tokens = rest[1:]
+	}
+
+	for len(tokens) > 0 {
+		t := tokens[0]
+		switch t.op {
+		case "":
+			if command.group != nil || isShellWord(t, "}") {
+				return command, tokens, nil
+			}
+			command.args = append(command.args, t.word)
+			tokens = tokens[1:]
+
+		case ">", "2>":
+			if len(tokens) < 2 || tokens[1].op != "" {
+				return nil, nil, fmt.Errorf("missing redirection target")
+			}
+			if t.op == ">" {
+				command.stdoutFile = tokens[1].word
+			} else if tokens[1].word == "/dev/null" {
+				command.stderrNull = true
+			} else {
+				return nil, nil, fmt.Errorf("unsupported redirection 2>%s", tokens[1].word)
+			}
+			tokens = tokens[2:]
+
+		case "2>&1":
+			command.stderrToStdout = true
+			tokens = tokens[1:]
+
+		default:
+			if command.group == nil && len(command.args) == 0 {
+				return nil, nil, fmt.Errorf("syntax error near %q", t.op)
+			}
+			return command, tokens, nil
+		}
+	}
+
+	if command.group == nil && len(command.args) == 0 {
+		return nil, nil, fmt.Errorf("syntax error: unexpected end of line")
+	}
+	return command, tokens, nil
+}
+
+// runShell runs a command line on the fake host and returns its exit status
+func (h *fakeESXiHost) runShell(cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	list, err := parseShell(cmd)
+	if err != nil {
+		fmt.Fprintf(stderr, "sh: %s\n", err)
+		return 2
+	}
+
+	env := &fakeShellEnv{vars: make(map[string]string)}
+	status, err := h.runShellList(list, env, stdin, stdout, stderr)
+	if e, ok := err.(*errShellExit); ok {
+		return e.status
+	}
+	return status
+}
+
+func (h *fakeESXiHost) runShellList(list *fakeShellList, env *fakeShellEnv, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	status, err := h.runShellPipeline(list.pipelines[0], env, stdin, stdout, stderr)
+	env.status = status
+	if err != nil {
+		return status, err
+	}
+
+	for i, op := range list.ops {
+		if (op == "&&" && status != 0) || (op == "||" && status == 0) {
+			continue
+		}
+		status, err = h.runShellPipeline(list.pipelines[i+1], env, stdin, stdout, stderr)
+		env.status = status
+		if err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+func (h *fakeESXiHost) runShellPipeline(pipeline *fakeShellPipeline, env *fakeShellEnv, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	in := stdin
+	status := 0
+
+	for i, command := range pipeline.commands {
+		var out bytes.Buffer
+		var err error
+
+		status, err = h.runShellCommand(command, env, in, &out, stderr)
+		if err != nil {
+			return status, err
+		}
+
+		if i == len(pipeline.commands)-1 {
+			stdout.Write(out.Bytes())
+		}
+		in = &out
+	}
+	return status, nil
+}
+
+func (h *fakeESXiHost) runShellCommand(command *fakeShellCommand, env *fakeShellEnv, in io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	var out bytes.Buffer
+	errOut := stderr
+	if command.stderrNull {
+		errOut = ioutil.Discard
+	}
+	if command.stderrToStdout {
+		errOut = &out
+	}
+
+	var status int
+	if command.group != nil {
+		var err error
+		status, err = h.runShellList(command.group, env, in, &out, errOut)
+		if err != nil {
+			stdout.Write(out.Bytes())
+			return status, err
+		}
+	} else {
+		args := make([]string, len(command.args))
+		for i, arg := range command.args {
+			var err error
+			args[i], status, err = h.expandShellWord(arg, env, errOut)
+			if err != nil {
+				return status, err
+			}
+		}
+
+		if m := shellAssignmentRe.FindStringSubmatch(command.args[0]); m != nil && len(args) == 1 {
+			env.vars[m[1]] = args[0][len(m[0]):]
+			return status, nil
+		}
+
+		name := args[0]
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+
+		if name == "exit" {
+			status := 0
+			if len(args) > 1 {
+				status, _ = strconv.Atoi(args[1])
+			}
+			return status, &errShellExit{status: status}
+		}
+
+		fn, ok := fakeCommands[name]
+		if !ok {
+			fmt.Fprintf(errOut, "sh: %s: not found\n", args[0])
+			return 127, nil
+		}
+		status = fn(h, args[1:], in, &out, errOut)
+	}
+
+	if command.stdoutFile != "" {
+		if err := h.writeFile(command.stdoutFile, out.Bytes()); err != nil {
+			fmt.Fprintf(errOut, "sh: can't create %s: %s\n", command.stdoutFile, err)
+			return 1, nil
+		}
+		return status, nil
+	}
+
+	stdout.Write(out.Bytes())
+	return status, nil
+}
+
+//
+//  Text utilities
+//
+
+// readLines reads all of r and splits it into lines
+func readLines(r io.Reader) []string {
+	data, _ := ioutil.ReadAll(r)
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// breToRE2 converts a POSIX basic regular expression to RE2 syntax
+func breToRE2(pattern string) string {
+	var buf bytes.Buffer
+	inBracket := false
+
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case inBracket:
+			if ch == ']' {
+				inBracket = false
+			}
+			if ch == '\\' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(ch)
+		case ch == '[':
+			inBracket = true
+			buf.WriteByte(ch)
+			if strings.HasPrefix(pattern[i+1:], "^]") {
+				buf.WriteString("^]")
+				i += 2
+			} else if strings.HasPrefix(pattern[i+1:], "]") {
+				buf.WriteString("]")
+				i++
+			}
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			if strings.IndexByte("(){}|+?", pattern[i]) >= 0 {
+				buf.WriteByte(pattern[i])
+			} else {
+				buf.WriteByte('\\')
+				buf.WriteByte(pattern[i])
+			}
+		case strings.IndexByte("(){}|+?", ch) >= 0:
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return buf.String()
+}
+
+func fakeGrep(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	var after, before, maxCount int
+	var onlyMatching, quiet, extended, fixed, wholeLine bool
+	var operands []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || len(arg) == 1 || len(operands) > 0 {
+			operands = append(operands, arg)
+			continue
+		}
+
+		for j := 1; j < len(arg); j++ {
+			switch arg[j] {
+			case 'o':
+				onlyMatching = true
+			case 'q':
+				quiet = true
+			case 'E':
+				extended = true
+			case 'F':
+				fixed = true
+			case 'x':
+				wholeLine = true
+			case 'A', 'B', 'm':
+				value := arg[j+1:]
+				if value == "" && i+1 < len(args) {
+					i++
+					value = args[i]
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					fmt.Fprintf(errOut, "grep: invalid number '%s'\n", value)
+					return 2
+				}
+				switch arg[j] {
+				case 'A':
+					after = n
+				case 'B':
+					before = n
+				case 'm':
+					maxCount = n
+				}
+				j = len(arg)
+			default:
+				fmt.Fprintf(errOut, "grep: unrecognized option '-%c'\n", arg[j])
+				return 2
+			}
+		}
+	}
+
+	if len(operands) == 0 {
+		fmt.Fprintf(errOut, "grep: no pattern\n")
+		return 2
+	}
+
+	pattern := operands[0]
+	if fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	} else if !extended {
+		pattern = breToRE2(pattern)
+	}
+	if wholeLine {
+		pattern = "^(?:" + pattern + ")$"
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(errOut, "grep: bad regex '%s': %s\n", operands[0], err)
+		return 2
+	}
+
+	var lines []string
+	if len(operands) == 1 {
+		lines = readLines(in)
+	} else {
+		for _, file := range operands[1:] {
+			data, err := h.readFile(file)
+			if err != nil {
+				fmt.Fprintf(errOut, "grep: %s: %s\n", file, err)
+				return 2
+			}
+			lines = append(lines, readLines(bytes.NewReader(data))...)
+		}
+	}
+
+	var matched []int
+	for i, line := range lines {
+		if re.MatchString(line) {
+			matched = append(matched, i)
+			if maxCount > 0 && len(matched) == maxCount {
+				break
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return 1
+	}
+	if quiet {
+		return 0
+	}
+
+	if onlyMatching {
+		for _, i := range matched {
+			for _, m := range re.FindAllString(lines[i], -1) {
+				fmt.Fprintln(out, m)
+			}
+		}
+		return 0
+	}
+
+	printed := make(map[int]bool)
+	for _, i := range matched {
+		for j := i - before; j <= i+after; j++ {
+			if j >= 0 && j < len(lines) {
+				printed[j] = true
+			}
+		}
+	}
+
+	last := -1
+	for i := range lines {
+		if !printed[i] {
+			continue
+		}
+		if last >= 0 && i > last+1 && (before > 0 || after > 0) {
+			fmt.Fprintln(out, "--")
+		}
+		fmt.Fprintln(out, lines[i])
+		last = i
+	}
+	return 0
+}
+
+var awkPrintRe = regexp.MustCompile(`^\{\s*print \$([0-9]+|NF)\s*\}$`)
+
+func fakeAwk(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(errOut, "awk: usage: awk '{print $N}'\n")
+		return 2
+	}
+	m := awkPrintRe.FindStringSubmatch(args[0])
+	if m == nil {
+		fmt.Fprintf(errOut, "awk: unsupported program %s\n", args[0])
+		return 2
+	}
+
+	for _, line := range readLines(in) {
+		fields := strings.Fields(line)
+		n := len(fields)
+		if m[1] != "NF" {
+			n, _ = strconv.Atoi(m[1])
+		}
+
+		switch {
+		case n == 0:
+			fmt.Fprintln(out, line)
+		case n <= len(fields):
+			fmt.Fprintln(out, fields[n-1])
+		default:
+			fmt.Fprintln(out)
+		}
+	}
+	return 0
+}
+
+func fakeSed(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) != 1 || len(args[0]) < 4 || args[0][0] != 's' {
+		fmt.Fprintf(errOut, "sed: unsupported script %q\n", strings.Join(args, " "))
+		return 2
+	}
+
+	script := args[0]
+	delim := script[1]
+	parts := strings.Split(script[2:], string(delim))
+	if len(parts) != 3 {
+		fmt.Fprintf(errOut, "sed: unterminated `s' command\n")
+		return 2
+	}
+
+	re, err := regexp.Compile(breToRE2(parts[0]))
+	if err != nil {
+		fmt.Fprintf(errOut, "sed: bad regex %s: %s\n", parts[0], err)
+		return 2
+	}
+
+	template := sedTemplate(parts[1])
+	for _, line := range readLines(in) {
+		if parts[2] == "g" {
+			line = re.ReplaceAllString(line, template)
+		} else if m := re.FindStringSubmatchIndex(line); m != nil {
+			line = line[:m[0]] + string(re.ExpandString(nil, template, line, m)) + line[m[1]:]
+		}
+		fmt.Fprintln(out, line)
+	}
+	return 0
+}
+
+// sedTemplate converts a sed replacement, with \1 to \9 and &, to a
+// regexp template
+func sedTemplate(replacement string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(replacement); i++ {
+		ch := replacement[i]
+		switch {
+		case ch == '\\' && i+1 < len(replacement):
+			i++
+			if replacement[i] >= '1' && replacement[i] <= '9' {
+				fmt.Fprintf(&buf, "${%c}", replacement[i])
+			} else if replacement[i] == '$' {
+				buf.WriteString("$$")
+			} else {
+				buf.WriteByte(replacement[i])
+			}
+		case ch == '&':
+			buf.WriteString("${0}")
+		case ch == '$':
+			buf.WriteString("$$")
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return buf.String()
+}
+
+var leadingNumberRe = regexp.MustCompile(`^\s*-?[0-9]+`)
+
+func fakeSort(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	lines := readLines(in)
+	numeric := len(args) > 0 && args[0] == "-n"
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		if !numeric {
+			return lines[i] < lines[j]
+		}
+		a, _ := strconv.Atoi(strings.TrimSpace(leadingNumberRe.FindString(lines[i])))
+		b, _ := strconv.Atoi(strings.TrimSpace(leadingNumberRe.FindString(lines[j])))
+		return a < b
+	})
+
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return 0
+}
+
+func fakeTail(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	n := 10
+	for i := 0; i < len(args); i++ {
+		value := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "n")
+		if value == "" && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		n, _ = strconv.Atoi(value)
+	}
+
+	lines := readLines(in)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return 0
+}
+
+func fakeWc(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	data, _ := ioutil.ReadAll(in)
+	fmt.Fprintln(out, bytes.Count(data, []byte("\n")))
+	return 0
+}
+
+func fakeEcho(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	fmt.Fprintln(out, strings.Join(args, " "))
+	return 0
+}
+
+func fakeTrue(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	return 0
+}
+
+// fakeSleep waits for the given seconds, or until the client closes the
+// session.  The host is not held meanwhile, as a command stuck on the real
+// host would not stop others.
+func fakeSleep(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	seconds := 0
+	if len(args) > 0 {
+		seconds, _ = strconv.Atoi(args[0])
+	}
+
+	var done <-chan struct{}
+	if session, ok := in.(fakeSessionInput); ok {
+		done = session.done
+	}
+
+	h.mu.Unlock()
+	defer h.mu.Lock()
+
+	select {
+	case <-done:
+		return 143
+	case <-time.After(time.Duration(seconds) * time.Second):
+		return 0
+	}
+}
+
+func fakeTest(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	negate := false
+	if len(args) > 0 && args[0] == "!" {
+		negate = true
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		fmt.Fprintf(errOut, "sh: test: unsupported expression\n")
+		return 2
+	}
+
+	file, exists := h.stat(args[1])
+	var result bool
+	switch args[0] {
+	case "-e":
+		result = exists
+	case "-f":
+		result = exists && !file.dir
+	case "-d":
+		result = exists && file.dir
+	case "-s":
+		result = exists && !file.dir && file.size() > 0
+	default:
+		fmt.Fprintf(errOut, "sh: test: unknown operator %s\n", args[0])
+		return 2
+	}
+
+	if result != negate {
+		return 0
+	}
+	return 1
+}
+
+func fakeBracket(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) == 0 || args[len(args)-1] != "]" {
+		fmt.Fprintf(errOut, "sh: [: missing ]\n")
+		return 2
+	}
+	return fakeTest(h, args[:len(args)-1], in, out, errOut)
+}
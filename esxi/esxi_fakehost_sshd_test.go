@@ -0,0 +1,348 @@
+package esxi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	fakeSSHUser     = "root"
+	fakeSSHPassword = "password"
+)
+
+// fakeSSHServer serves a fakeESXiHost over SSH on a loopback port.  Only
+// password authentication, "exec" and "sftp" session requests and
+// "direct-tcpip" forwarding are supported, so a server can also stand in
+// for a bastion.
+type fakeSSHServer struct {
+	host     *fakeESXiHost
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu           sync.Mutex
+	conns        []net.Conn
+	accepted     int
+	commands     []string
+	tunnels      []string
+	transfers    int
+	sessions     int
+	peakSessions int
+	wg           sync.WaitGroup
+}
+
+// fakeSessionInput is the stdin of a session.  done is closed once the
+// client closes the session, so a blocking command can stop.
+type fakeSessionInput struct {
+	io.Reader
+	done <-chan struct{}
+}
+
+// startFakeSSHServer starts serving host and stops the server when the test ends
+func startFakeSSHServer(t *testing.T, host *fakeESXiHost) *fakeSSHServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create host key signer: %s", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == fakeSSHUser && string(password) == fakeSSHPassword {
+				return nil, nil
+			}
+			return nil, &ssh.ServerAuthError{}
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	s := &fakeSSHServer{
+		host:     host,
+		listener: listener,
+		config:   config,
+		hostKey:  signer.PublicKey(),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// providerConfig returns a provider config that connects to the server
+func (s *fakeSSHServer) providerConfig(t *testing.T) *Config {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+
+	retry, err := newRetryPolicy(3, "10ms", "100ms", nil)
+	if err != nil {
+		t.Fatalf("Failed to create retry policy: %s", err)
+	}
+
+	c := &Config{
+		esxiHostName:           host,
+		esxiHostPort:           port,
+		esxiUserName:           fakeSSHUser,
+		esxiPassword:           fakeSSHPassword,
+		esxiHostKeyFingerprint: ssh.FingerprintSHA256(s.hostKey),
+		retryPolicy:            retry,
+	}
+
+	c.sshPool, err = newSSHClientPool(c.sshConnectionSettings())
+	if err != nil {
+		t.Fatalf("Failed to create SSH pool: %s", err)
+	}
+	c.executor = newSSHExecutor(c.sshConnectionSettings())
+	return c
+}
+
+// ran returns the command lines the server has executed
+func (s *fakeSSHServer) ran() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// sftpSessions returns how many sftp subsystem sessions the server has served
+func (s *fakeSSHServer) sftpSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transfers
+}
+
+// tunneled returns the addresses the server has forwarded connections to
+func (s *fakeSSHServer) tunneled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.tunnels...)
+}
+
+// connections returns how many connections the server has accepted
+func (s *fakeSSHServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.accepted
+}
+
+// openSessions returns how many sessions are open now
+func (s *fakeSSHServer) openSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions
+}
+
+// maxSessions returns the most sessions that were open at once
+func (s *fakeSSHServer) maxSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peakSessions
+}
+
+// trackSession counts a session as open or closed
+func (s *fakeSSHServer) trackSession(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions += delta
+	if s.sessions > s.peakSessions {
+		s.peakSessions = s.sessions
+	}
+}
+
+// dropConnections closes every open connection, as a host restart would
+func (s *fakeSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeSSHServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+	s.wg.Wait()
+}
+
+func (s *fakeSSHServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *fakeSSHServer) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			s.wg.Add(1)
+			go s.handleSession(channel, channelRequests)
+
+		case "direct-tcpip":
+			s.wg.Add(1)
+			go s.handleTunnel(newChannel)
+
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// handleTunnel forwards a direct-tcpip channel to the address it asks for
+func (s *fakeSSHServer) handleTunnel(newChannel ssh.NewChannel) {
+	defer s.wg.Done()
+
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+
+	address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.tunnels = append(s.tunnels, address)
+	s.mu.Unlock()
+
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	io.Copy(conn, channel)
+}
+
+func (s *fakeSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer s.wg.Done()
+	defer channel.Close()
+
+	// The session counts as closed once its command is done, before the
+	// client can see the exit status and open the next one.
+	s.trackSession(1)
+	open := true
+	defer func() {
+		if open {
+			s.trackSession(-1)
+		}
+	}()
+
+	for req := range requests {
+		if req.Type == "subsystem" {
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			s.mu.Lock()
+			s.transfers++
+			s.mu.Unlock()
+
+			s.host.serveSFTP(channel)
+			s.trackSession(-1)
+			open = false
+
+			channel.SendRequest("exit-status", false, make([]byte, 4))
+			return
+		}
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mu.Unlock()
+
+		// The requests channel is closed when the client closes the session
+		done := make(chan struct{})
+		go func() {
+			for req := range requests {
+				req.Reply(false, nil)
+			}
+			close(done)
+		}()
+
+		status := s.host.run(payload.Command, fakeSessionInput{channel, done}, channel, channel.Stderr())
+		s.trackSession(-1)
+		open = false
+
+		exitStatus := make([]byte, 4)
+		binary.BigEndian.PutUint32(exitStatus, uint32(status))
+		channel.SendRequest("exit-status", false, exitStatus)
+		return
+	}
+}
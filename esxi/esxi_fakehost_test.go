@@ -0,0 +1,955 @@
+package esxi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+//  fakeESXiHost is the in-memory state behind the fake SSH server: a virtual
+//  filesystem with the datastores under /vmfs/volumes, registered guests and
+//  resource pools.  /etc/vmware/hostd/pools.xml is rendered from the pools.
+//
+
+const fakePoolsXML = "/etc/vmware/hostd/pools.xml"
+
+// fakeHostMemSize is the memory of the fake host in MB.  Guests with more
+// do not power on.
+const fakeHostMemSize = 32768
+
+// fakeFile is a file or directory on the fake host.  Flat vmdk files only
+// record their size.
+type fakeFile struct {
+	dir      bool
+	data     []byte
+	flatSize int64
+	diskType string
+}
+
+func (f *fakeFile) size() int64 {
+	if f.flatSize > 0 {
+		return f.flatSize
+	}
+	return int64(len(f.data))
+}
+
+// fakeVM is a registered guest
+type fakeVM struct {
+	id      int
+	name    string
+	vmxPath string
+	poolID  string
+	power   string
+}
+
+// fakePool is a resource pool below ha-root-pool
+type fakePool struct {
+	id     string
+	name   string
+	parent string
+
+	cpuMin, cpuMax int
+	cpuExpandable  bool
+	cpuShares      string
+	memMin, memMax int
+	memExpandable  bool
+	memShares      string
+}
+
+// fakeESXiHost holds everything the fake host knows
+type fakeESXiHost struct {
+	mu sync.Mutex
+
+	files      map[string]*fakeFile
+	datastores []string
+	vms        map[int]*fakeVM
+	pools      map[string]*fakePool
+	nextVMID   int
+	nextPoolID int
+}
+
+var fakeCommands map[string]fakeCommand
+
+func init() {
+	fakeCommands = map[string]fakeCommand{
+		"[":          fakeBracket,
+		"awk":        fakeAwk,
+		"cat":        fakeCat,
+		"cp":         fakeCp,
+		"echo":       fakeEcho,
+		"esxcli":     fakeEsxcli,
+		"grep":       fakeGrep,
+		"ls":         fakeLs,
+		"mkdir":      fakeMkdir,
+		"mv":         fakeMv,
+		"rm":         fakeRm,
+		"rmdir":      fakeRmdir,
+		"sed":        fakeSed,
+		"sleep":      fakeSleep,
+		"sort":       fakeSort,
+		"tail":       fakeTail,
+		"test":       fakeTest,
+		"true":       fakeTrue,
+		"vim-cmd":    fakeVimCmd,
+		"vmkfstools": fakeVmkfstools,
+		"vmware":     fakeVmware,
+		"wc":         fakeWc,
+	}
+}
+
+// newFakeESXiHost returns a host with the given datastores and no guests
+func newFakeESXiHost(datastores ...string) *fakeESXiHost {
+	h := &fakeESXiHost{
+		files:      make(map[string]*fakeFile),
+		datastores: datastores,
+		vms:        make(map[int]*fakeVM),
+		pools:      make(map[string]*fakePool),
+		nextVMID:   1,
+		nextPoolID: 1,
+	}
+
+	for _, dir := range []string{"/", "/etc", "/etc/vmware", "/etc/vmware/hostd", "/vmfs", "/vmfs/volumes"} {
+		h.files[dir] = &fakeFile{dir: true}
+	}
+	for _, ds := range datastores {
+		h.files["/vmfs/volumes/"+ds] = &fakeFile{dir: true}
+	}
+	return h
+}
+
+// run runs a command line on the host, as the SSH server does for exec requests
+func (h *fakeESXiHost) run(cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.runShell(cmd, stdin, stdout, stderr)
+}
+
+// file returns the contents of a file, for tests to inspect
+func (h *fakeESXiHost) file(name string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, err := h.readFile(name)
+	return string(data), err == nil
+}
+
+//
+//  Filesystem
+//
+
+var errFakeNotFound = errors.New("No such file or directory")
+
+func (h *fakeESXiHost) stat(name string) (*fakeFile, bool) {
+	name = path.Clean(name)
+	if name == fakePoolsXML {
+		return &fakeFile{data: []byte(h.poolsXML())}, true
+	}
+	f, ok := h.files[name]
+	return f, ok
+}
+
+func (h *fakeESXiHost) readFile(name string) ([]byte, error) {
+	f, ok := h.stat(name)
+	if !ok {
+		return nil, errFakeNotFound
+	}
+	if f.dir {
+		return nil, errors.New("Is a directory")
+	}
+	return f.data, nil
+}
+
+func (h *fakeESXiHost) writeFile(name string, data []byte) error {
+	name = path.Clean(name)
+	if parent, ok := h.files[path.Dir(name)]; !ok || !parent.dir {
+		return errors.New("nonexistent directory")
+	}
+	if f, ok := h.files[name]; ok && f.dir {
+		return errors.New("Is a directory")
+	}
+	h.files[name] = &fakeFile{data: append([]byte(nil), data...)}
+	return nil
+}
+
+// children returns the sorted names of the entries in dir
+func (h *fakeESXiHost) children(dir string) []string {
+	var names []string
+	prefix := strings.TrimSuffix(path.Clean(dir), "/") + "/"
+	for name := range h.files {
+		if strings.HasPrefix(name, prefix) && name != prefix && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name[len(prefix):])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeAll removes name and everything below it
+func (h *fakeESXiHost) removeAll(name string) {
+	name = path.Clean(name)
+	for f := range h.files {
+		if f == name || strings.HasPrefix(f, name+"/") {
+			delete(h.files, f)
+		}
+	}
+}
+
+// datastorePath converts an absolute path to the "[ds] dir/file" form
+func datastorePath(name string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(name), "/vmfs/volumes/"), "/", 2)
+	if len(parts) < 2 {
+		return "[" + parts[0] + "]"
+	}
+	return fmt.Sprintf("[%s] %s", parts[0], parts[1])
+}
+
+func fakeCat(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) == 0 {
+		io.Copy(out, in)
+		return 0
+	}
+
+	status := 0
+	for _, name := range args {
+		data, err := h.readFile(name)
+		if err != nil {
+			fmt.Fprintf(errOut, "cat: can't open '%s': %s\n", name, err)
+			status = 1
+			continue
+		}
+		out.Write(data)
+	}
+	return status
+}
+
+// splitFlags separates single-letter flags from operands
+func splitFlags(args []string) (string, []string) {
+	var flags string
+	var operands []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 && len(operands) == 0 {
+			flags += arg[1:]
+		} else {
+			operands = append(operands, arg)
+		}
+	}
+	return flags, operands
+}
+
+func fakeLsLine(name string, f *fakeFile) string {
+	mode := "-rw-------"
+	if f.dir {
+		mode = "drwxr-xr-x"
+	}
+	return fmt.Sprintf("%s    1 root     root     %12d Jan  1 00:00 %s", mode, f.size(), name)
+}
+
+func fakeLs(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	flags, operands := splitFlags(args)
+	long := strings.Contains(flags, "l")
+	all := strings.Contains(flags, "a")
+	dirOnly := strings.Contains(flags, "d")
+
+	status := 0
+	for _, name := range operands {
+		f, ok := h.stat(name)
+		if !ok {
+			fmt.Fprintf(errOut, "ls: %s: No such file or directory\n", name)
+			status = 1
+			continue
+		}
+
+		if !f.dir || dirOnly {
+			if long {
+				fmt.Fprintln(out, fakeLsLine(name, f))
+			} else {
+				fmt.Fprintln(out, name)
+			}
+			continue
+		}
+
+		var lines []string
+		if all {
+			lines = append(lines, fakeLsLine(".", f), fakeLsLine("..", &fakeFile{dir: true}))
+		}
+		for _, child := range h.children(name) {
+			childFile, _ := h.stat(path.Join(name, child))
+			if long {
+				lines = append(lines, fakeLsLine(child, childFile))
+			} else {
+				lines = append(lines, child)
+			}
+		}
+		if long {
+			fmt.Fprintf(out, "total %d\n", len(lines))
+		}
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+	}
+	return status
+}
+
+func fakeMkdir(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	flags, operands := splitFlags(args)
+	parents := strings.Contains(flags, "p")
+
+	for _, name := range operands {
+		name = path.Clean(name)
+		if f, ok := h.files[name]; ok {
+			if parents && f.dir {
+				continue
+			}
+			fmt.Fprintf(errOut, "mkdir: can't create directory '%s': File exists\n", name)
+			return 1
+		}
+
+		if _, ok := h.files[path.Dir(name)]; !ok {
+			if !parents {
+				fmt.Fprintf(errOut, "mkdir: can't create directory '%s': No such file or directory\n", name)
+				return 1
+			}
+			if status := fakeMkdir(h, []string{"-p", path.Dir(name)}, in, out, errOut); status != 0 {
+				return status
+			}
+		}
+		h.files[name] = &fakeFile{dir: true}
+	}
+	return 0
+}
+
+func fakeRm(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	flags, operands := splitFlags(args)
+	force := strings.Contains(flags, "f")
+	recursive := strings.Contains(flags, "r")
+
+	for _, name := range operands {
+		f, ok := h.stat(name)
+		if !ok {
+			if !force {
+				fmt.Fprintf(errOut, "rm: can't remove '%s': No such file or directory\n", name)
+				return 1
+			}
+			continue
+		}
+		if f.dir && !recursive {
+			fmt.Fprintf(errOut, "rm: '%s' is a directory\n", name)
+			return 1
+		}
+		h.removeAll(name)
+	}
+	return 0
+}
+
+func fakeRmdir(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	for _, name := range args {
+		f, ok := h.stat(name)
+		if !ok || !f.dir {
+			fmt.Fprintf(errOut, "rmdir: '%s': No such file or directory\n", name)
+			return 1
+		}
+		if len(h.children(name)) > 0 {
+			fmt.Fprintf(errOut, "rmdir: '%s': Directory not empty\n", name)
+			return 1
+		}
+		delete(h.files, path.Clean(name))
+	}
+	return 0
+}
+
+func fakeMv(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	_, operands := splitFlags(args)
+	if len(operands) != 2 {
+		fmt.Fprintf(errOut, "mv: usage: mv [-f] SOURCE DEST\n")
+		return 1
+	}
+
+	src, dst := path.Clean(operands[0]), path.Clean(operands[1])
+	f, ok := h.files[src]
+	if !ok || f.dir {
+		fmt.Fprintf(errOut, "mv: can't rename '%s': No such file or directory\n", src)
+		return 1
+	}
+	if _, ok := h.files[path.Dir(dst)]; !ok {
+		fmt.Fprintf(errOut, "mv: can't rename '%s': No such file or directory\n", src)
+		return 1
+	}
+
+	delete(h.files, src)
+	h.files[dst] = f
+	return 0
+}
+
+func fakeCp(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	_, operands := splitFlags(args)
+	if len(operands) != 2 {
+		fmt.Fprintf(errOut, "cp: usage: cp [-p] SOURCE DEST\n")
+		return 1
+	}
+
+	data, err := h.readFile(operands[0])
+	if err != nil {
+		fmt.Fprintf(errOut, "cp: can't stat '%s': %s\n", operands[0], err)
+		return 1
+	}
+	if err := h.writeFile(operands[1], data); err != nil {
+		fmt.Fprintf(errOut, "cp: can't create '%s': %s\n", operands[1], err)
+		return 1
+	}
+	return 0
+}
+
+//
+//  ESXi commands
+//
+
+func fakeVmware(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	fmt.Fprintln(out, "VMware ESXi 6.7.0 build-8169922")
+	return 0
+}
+
+func fakeEsxcli(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	switch strings.Join(args, " ") {
+	case "--formatter=csv storage filesystem list":
+		fmt.Fprintln(out, "Mount Point,Volume Name,UUID,Mounted,Type,Size,Free,")
+		for i, ds := range h.datastores {
+			uuid := fmt.Sprintf("5b1a0000-%08x-0000-000c29000000", i)
+			fmt.Fprintf(out, "/vmfs/volumes/%s,%s,%s,true,VMFS-6,536602476544,268301238272,\n", uuid, ds, uuid)
+		}
+		fmt.Fprintln(out, "/vmfs/volumes/5b19ffff-00000000-0000-000c29000000,,5b19ffff-00000000-0000-000c29000000,true,vfat,4293591040,4264493056,")
+		return 0
+	case "storage filesystem rescan":
+		return 0
+	}
+
+	fmt.Fprintf(errOut, "Error: Unknown command or namespace %s\n", strings.Join(args, " "))
+	return 1
+}
+
+// parseDiskSize parses a vmkfstools size such as 10G into bytes
+func parseDiskSize(size string) (int64, error) {
+	units := map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30, 't': 1 << 40}
+
+	size = strings.ToLower(size)
+	unit, ok := units[size[len(size)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	n, err := strconv.ParseInt(size[:len(size)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * unit, nil
+}
+
+// flatPath returns the extent file of a vmdk descriptor
+func flatPath(descriptor string) string {
+	return strings.TrimSuffix(path.Clean(descriptor), ".vmdk") + "-flat.vmdk"
+}
+
+func fakeVmkfstools(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprintf(errOut, "vmkfstools: missing arguments\n")
+		return 1
+	}
+
+	switch args[0] {
+	case "-c":
+		size, err := parseDiskSize(args[1])
+		if err != nil {
+			fmt.Fprintf(errOut, "Failed to create virtual disk: %s\n", err)
+			return 1
+		}
+		diskType := "zeroedthick"
+		rest := args[2:]
+		if len(rest) >= 2 && rest[0] == "-d" {
+			diskType = rest[1]
+			rest = rest[2:]
+		}
+		if len(rest) != 1 {
+			fmt.Fprintf(errOut, "vmkfstools: missing disk path\n")
+			return 1
+		}
+
+		disk := path.Clean(rest[0])
+		if _, ok := h.files[disk]; ok {
+			fmt.Fprintf(errOut, "Failed to create virtual disk: The file already exists (393222).\n")
+			return 1
+		}
+		descriptor := fmt.Sprintf("# Disk DescriptorFile\nversion=1\ncreateType=\"vmfs\"\nRW %d VMFS \"%s\"\n",
+			size/512, path.Base(flatPath(disk)))
+		if err := h.writeFile(disk, []byte(descriptor)); err != nil {
+			fmt.Fprintf(errOut, "Failed to create virtual disk: The system cannot find the file specified (25).\n")
+			return 1
+		}
+		h.files[disk].diskType = diskType
+		h.files[flatPath(disk)] = &fakeFile{flatSize: size}
+		fmt.Fprintf(out, "Create: 100%% done.\n")
+		return 0
+
+	case "-X":
+		size, err := parseDiskSize(args[1])
+		if err != nil || len(args) != 3 {
+			fmt.Fprintf(errOut, "Failed to extend disk: invalid arguments\n")
+			return 1
+		}
+		flat, ok := h.files[flatPath(args[2])]
+		if !ok {
+			fmt.Fprintf(errOut, "Failed to open '%s': The system cannot find the file specified (25).\n", args[2])
+			return 1
+		}
+		if size < flat.flatSize {
+			fmt.Fprintf(errOut, "Failed to extend the disk. The new disk size must be greater than the current disk size.\n")
+			return 1
+		}
+		flat.flatSize = size
+		return 0
+
+	case "-U":
+		disk := path.Clean(args[1])
+		if _, ok := h.files[disk]; !ok {
+			fmt.Fprintf(errOut, "Failed to delete virtual disk: The system cannot find the file specified (25).\n")
+			return 255
+		}
+		delete(h.files, disk)
+		delete(h.files, flatPath(disk))
+		return 0
+
+	case "-t0":
+		disk, ok := h.files[path.Clean(args[1])]
+		flat, flatOk := h.files[flatPath(args[1])]
+		if !ok || !flatOk {
+			fmt.Fprintf(errOut, "Failed to open '%s': The system cannot find the file specified (25).\n", args[1])
+			return 1
+		}
+		mapping := map[string]string{
+			"thin":             "NOMP -- :",
+			"zeroedthick":      "VMFS Z- LVID:5b1a0000-00000000-0000-000c29000000/5b1a0000-00000000-0000-000c29000000/1:",
+			"eagerzeroedthick": "VMFS -- LVID:5b1a0000-00000000-0000-000c29000000/5b1a0000-00000000-0000-000c29000000/1:",
+		}[disk.diskType]
+		fmt.Fprintf(out, "Mapping for file %s (%d bytes in size):\n", args[1], flat.flatSize)
+		fmt.Fprintf(out, "[           0:  %d] --> [%s        0 -->  %d)]\n", flat.flatSize, mapping, flat.flatSize)
+		return 0
+	}
+
+	fmt.Fprintf(errOut, "vmkfstools: unsupported option %s\n", args[0])
+	return 1
+}
+
+// fakeVimCmdNotFound prints what hostd says about a missing managed object
+func fakeVimCmdNotFound(errOut io.Writer, kind string, id string) int {
+	fmt.Fprintf(errOut, "(vmodl.fault.ManagedObjectNotFound) {\n   faultCause = (vmodl.MethodFault) null,\n"+
+		"   obj = 'vim.%s:%s',\n   msg = \"The object 'vim.%s:%s' has already been deleted or has not been completely created\"\n}\n",
+		kind, id, kind, id)
+	return 1
+}
+
+func (h *fakeESXiHost) vm(id string) (*fakeVM, bool) {
+	vmid, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, false
+	}
+	vm, ok := h.vms[vmid]
+	return vm, ok
+}
+
+// vmx returns the parsed vmx file of a guest
+func (h *fakeESXiHost) vmx(vm *fakeVM) map[string]string {
+	data, _ := h.readFile(vm.vmxPath)
+	return parseVmxFile(string(data))
+}
+
+// vmxDiskPath resolves a disk fileName from a vmx to an absolute path
+func vmxDiskPath(vm *fakeVM, fileName string) string {
+	if strings.HasPrefix(fileName, "/") {
+		return path.Clean(fileName)
+	}
+	return path.Join(path.Dir(vm.vmxPath), fileName)
+}
+
+func (vm *fakeVM) ipAddress() string {
+	return fmt.Sprintf("192.0.2.%d", vm.id)
+}
+
+func fakeVimCmd(h *fakeESXiHost, args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintf(errOut, "Commands available under /:\nhostsvc/  solo/  vmsvc/\n")
+		return 1
+	}
+	if strings.HasPrefix(args[0], "hostsvc/rsrc/") {
+		return fakeVimCmdRsrc(h, strings.TrimPrefix(args[0], "hostsvc/rsrc/"), args[1:], out, errOut)
+	}
+
+	switch args[0] {
+	case "vmsvc/getallvms":
+		fmt.Fprintln(out, "Vmid       Name                    File                      Guest OS          Version   Annotation")
+		var ids []int
+		for id := range h.vms {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			vm := h.vms[id]
+			vmx := h.vmx(vm)
+			fmt.Fprintf(out, "%-10d %-23s %-25s %-17s vmx-%-5s %s\n", vm.id, vm.name, datastorePath(vm.vmxPath),
+				vmx["guestOS"]+"Guest", vmx["virtualHW.version"], vmx["annotation"])
+		}
+		return 0
+
+	case "solo/registervm":
+		if len(args) < 2 {
+			fmt.Fprintf(errOut, "Insufficient arguments.\n")
+			return 1
+		}
+		vmxPath := path.Clean(args[1])
+		if f, ok := h.files[vmxPath]; !ok || f.dir {
+			fmt.Fprintf(errOut, "(vim.fault.NotFound) {\n   msg = \"The object or item referred to could not be found.\"\n}\n")
+			return 1
+		}
+		vm := &fakeVM{id: h.nextVMID, vmxPath: vmxPath, poolID: "ha-root-pool", power: "off"}
+		vm.name = h.vmx(vm)["displayName"]
+		if len(args) > 2 && args[2] != "" {
+			vm.name = args[2]
+		}
+		if len(args) > 3 && args[3] != "" {
+			if _, ok := h.pools[args[3]]; !ok && args[3] != "ha-root-pool" {
+				return fakeVimCmdNotFound(errOut, "ResourcePool", args[3])
+			}
+			vm.poolID = args[3]
+		}
+		h.vms[vm.id] = vm
+		h.nextVMID++
+		fmt.Fprintln(out, vm.id)
+		return 0
+	}
+
+	if !strings.HasPrefix(args[0], "vmsvc/") || len(args) < 2 {
+		fmt.Fprintf(errOut, "Unknown command '%s'\n", args[0])
+		return 1
+	}
+
+	vm, ok := h.vm(args[1])
+	if !ok {
+		fmt.Fprintf(out, "Unable to find a VM corresponding to \"%s\"\n", args[1])
+		return 1
+	}
+
+	switch strings.TrimPrefix(args[0], "vmsvc/") {
+	case "get.summary":
+		uptime := 0
+		if vm.power == "on" {
+			uptime = 500
+		}
+		fmt.Fprintf(out, "Listsummary:\n(vim.vm.Summary) {\n   vm = 'vim.VirtualMachine:%d',\n", vm.id)
+		fmt.Fprintf(out, "   runtime = (vim.vm.RuntimeInfo) {\n      powerState = \"powered%s\",\n   },\n", strings.Title(vm.power))
+		fmt.Fprintf(out, "   config = (vim.vm.Summary.ConfigSummary) {\n      name = \"%s\",\n      vmPathName = \"%s\",\n   },\n",
+			vm.name, datastorePath(vm.vmxPath))
+		fmt.Fprintf(out, "   quickStats = (vim.vm.Summary.QuickStats) {\n      uptimeSeconds = %d,\n   },\n}\n", uptime)
+
+	case "get.config":
+		fmt.Fprintf(out, "Config:\n(vim.vm.ConfigInfo) {\n   name = \"%s\",\n   files = (vim.vm.FileInfo) {\n", vm.name)
+		fmt.Fprintf(out, "      vmPathName = \"%s\",\n   },\n}\n", datastorePath(vm.vmxPath))
+
+	case "get.guest":
+		fmt.Fprintf(out, "Guest information:\n\n(vim.vm.GuestInfo) {\n")
+		if vm.power == "on" {
+			fmt.Fprintf(out, "   toolsRunningStatus = \"guestToolsRunning\",\n   ipAddress = \"%s\",\n", vm.ipAddress())
+			fmt.Fprintf(out, "   net = (vim.vm.GuestInfo.NicInfo) [\n      (vim.vm.GuestInfo.NicInfo) {\n")
+			fmt.Fprintf(out, "         network = \"VM Network\",\n         connected = true,\n         deviceConfigId = 4000,\n")
+			fmt.Fprintf(out, "         dnsConfig = (vim.net.DnsConfigInfo) null,\n         ipConfig = (vim.net.IpConfigInfo) {\n")
+			fmt.Fprintf(out, "            ipAddress = (vim.net.IpConfigInfo.IpAddress) [\n               (vim.net.IpConfigInfo.IpAddress) {\n")
+			fmt.Fprintf(out, "                  ipAddress = \"%s\",\n               }\n            ],\n         },\n      }\n   ],\n", vm.ipAddress())
+		} else {
+			fmt.Fprintf(out, "   toolsRunningStatus = \"guestToolsNotRunning\",\n   net = (vim.vm.GuestInfo.NicInfo) [],\n")
+		}
+		fmt.Fprintf(out, "}\n")
+
+	case "device.getdevices":
+		fmt.Fprintf(out, "(vim.vm.VirtualHardware) {\n   numCPU = 1,\n   device = (vim.vm.device.VirtualDevice) [\n")
+		if fileName, ok := h.vmx(vm)["scsi0:0.fileName"]; ok {
+			disk := vmxDiskPath(vm, fileName)
+			var size int64
+			diskType := ""
+			if f, ok := h.files[disk]; ok {
+				diskType = f.diskType
+			}
+			if flat, ok := h.files[flatPath(disk)]; ok {
+				size = flat.flatSize
+			}
+			fmt.Fprintf(out, "      (vim.vm.device.VirtualDisk) {\n         key = 2000,\n")
+			fmt.Fprintf(out, "         deviceInfo = (vim.Description) {\n            label = \"Hard disk 1\",\n            summary = \"%d KB\"\n         },\n", size/1024)
+			fmt.Fprintf(out, "         backing = (vim.vm.device.VirtualDisk.FlatVer2BackingInfo) {\n")
+			fmt.Fprintf(out, "            fileName = \"%s\",\n            diskMode = \"persistent\",\n", datastorePath(disk))
+			fmt.Fprintf(out, "            thinProvisioned = %t,\n", diskType == "thin")
+			if diskType == "eagerzeroedthick" {
+				fmt.Fprintf(out, "            eagerlyScrub = true,\n")
+			} else {
+				fmt.Fprintf(out, "            eagerlyScrub = <unset>,\n")
+			}
+			fmt.Fprintf(out, "            parent = (vim.vm.device.VirtualDisk.FlatVer2BackingInfo) null,\n         },\n")
+			fmt.Fprintf(out, "         controllerKey = 1000,\n         unitNumber = 0,\n")
+			fmt.Fprintf(out, "         capacityInKB = %d,\n         capacityInBytes = %d,\n      },\n", size/1024, size)
+		}
+		fmt.Fprintf(out, "   ],\n}\n")
+
+	case "power.getstate":
+		fmt.Fprintf(out, "Retrieved runtime info\nPowered %s\n", vm.power)
+
+	case "power.on":
+		if vm.power == "on" {
+			fmt.Fprintf(errOut, "Power on failed: (vim.fault.InvalidPowerState)\n")
+			return 1
+		}
+		if memSize, _ := strconv.Atoi(h.vmx(vm)["memSize"]); memSize > fakeHostMemSize {
+			fmt.Fprintf(errOut, "Power on failed: (vim.fault.InsufficientMemoryResourcesFault) {\n"+
+				"   msg = \"The available Memory resources in the parent resource pool are insufficient for the operation.\"\n}\n")
+			return 1
+		}
+		vm.power = "on"
+		fmt.Fprintln(out, "Powering on VM:")
+
+	case "power.off", "power.shutdown":
+		if vm.power == "off" {
+			fmt.Fprintf(errOut, "Power off failed: (vim.fault.InvalidPowerState)\n")
+			return 1
+		}
+		vm.power = "off"
+		fmt.Fprintln(out, "Powering off VM:")
+
+	case "reload":
+		if _, err := h.readFile(vm.vmxPath); err != nil {
+			fmt.Fprintf(errOut, "(vim.fault.InvalidState) {\n   msg = \"The vmx file is missing\"\n}\n")
+			return 1
+		}
+		if name, ok := h.vmx(vm)["displayName"]; ok {
+			vm.name = name
+		}
+
+	case "destroy":
+		if vm.power == "on" {
+			fmt.Fprintf(errOut, "(vim.fault.InvalidPowerState) {\n   msg = \"The attempted operation cannot be performed in the current state (Powered on).\"\n}\n")
+			return 1
+		}
+		for key, fileName := range h.vmx(vm) {
+			if strings.HasPrefix(key, "scsi") && strings.HasSuffix(key, ".fileName") {
+				disk := vmxDiskPath(vm, fileName)
+				delete(h.files, disk)
+				delete(h.files, flatPath(disk))
+			}
+		}
+		h.removeAll(path.Dir(vm.vmxPath))
+		delete(h.vms, vm.id)
+
+	default:
+		fmt.Fprintf(errOut, "Unknown command '%s'\n", args[0])
+		return 1
+	}
+	return 0
+}
+
+//
+//  Resource pools
+//
+
+// poolPath returns the pools.xml path of a pool: host/user/<ids from the root>
+func (h *fakeESXiHost) poolPath(id string) string {
+	var ids []string
+	for id != "ha-root-pool" && id != "" {
+		ids = append([]string{id}, ids...)
+		id = h.pools[id].parent
+	}
+	return "host/user/" + strings.Join(ids, "/")
+}
+
+func (h *fakeESXiHost) poolsXML() string {
+	var buf bytes.Buffer
+	buf.WriteString("<ConfigRoot>\n")
+
+	var ids []string
+	for id := range h.pools {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		fmt.Fprintf(&buf, "  <resourcePool id=\"%04d\">\n    <name>%s</name>\n    <objID>%s</objID>\n    <path>%s</path>\n  </resourcePool>\n",
+			i, h.pools[id].name, id, h.poolPath(id))
+	}
+
+	//  Like hostd, only guests below the root pool are listed
+	var vmids []int
+	for id, vm := range h.vms {
+		if vm.poolID != "ha-root-pool" {
+			vmids = append(vmids, id)
+		}
+	}
+	sort.Ints(vmids)
+	for i, id := range vmids {
+		fmt.Fprintf(&buf, "  <vm id=\"%04d\">\n    <objID>%d</objID>\n    <resourcePool>%s</resourcePool>\n  </vm>\n",
+			i, id, h.vms[id].poolID)
+	}
+
+	buf.WriteString("</ConfigRoot>\n")
+	return buf.String()
+}
+
+var fakeSharesLevels = map[string][2]int{
+	"low":    {2000, 81920},
+	"normal": {4000, 163840},
+	"high":   {8000, 327680},
+}
+
+// applyPoolOptions applies the --cpu-*/--mem-* options of hostsvc/rsrc/create
+// and pool_config_set
+func (p *fakePool) applyOptions(options map[string]string) error {
+	for key, value := range options {
+		var err error
+		switch key {
+		case "cpu-min":
+			p.cpuMin, err = strconv.Atoi(value)
+		case "cpu-max":
+			p.cpuMax, err = strconv.Atoi(value)
+		case "cpu-min-expandable":
+			p.cpuExpandable = value == "true"
+		case "cpu-shares":
+			p.cpuShares = value
+		case "mem-min":
+			p.memMin, err = strconv.Atoi(value)
+		case "mem-max":
+			p.memMax, err = strconv.Atoi(value)
+		case "mem-min-expandable":
+			p.memExpandable = value == "true"
+		case "mem-shares":
+			p.memShares = value
+		default:
+			return fmt.Errorf("unknown option --%s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for --%s: %s", key, value)
+		}
+	}
+	return nil
+}
+
+func fakeWriteAllocation(out io.Writer, name string, reservation int, expandable bool, limit int, shares string, cpu bool) {
+	if limit == 0 {
+		limit = -1
+	}
+
+	level, count := shares, 0
+	if levels, ok := fakeSharesLevels[shares]; ok {
+		count = levels[1]
+		if cpu {
+			count = levels[0]
+		}
+	} else {
+		level = "custom"
+		count, _ = strconv.Atoi(shares)
+	}
+
+	fmt.Fprintf(out, "   %s = (vim.ResourceAllocationInfo) {\n      reservation = %d,\n      expandableReservation = %t,\n      limit = %d,\n",
+		name, reservation, expandable, limit)
+	fmt.Fprintf(out, "      shares = (vim.SharesInfo) {\n         shares = %d,\n         level = \"%s\"\n      },\n      overheadLimit = <unset>\n   },\n",
+		count, level)
+}
+
+func fakeVimCmdRsrc(h *fakeESXiHost, command string, args []string, out io.Writer, errOut io.Writer) int {
+	options := make(map[string]string)
+	var operands []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			kv := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+			if len(kv) != 2 {
+				fmt.Fprintf(errOut, "Invalid option %s\n", arg)
+				return 1
+			}
+			options[kv[0]] = kv[1]
+		} else {
+			operands = append(operands, arg)
+		}
+	}
+
+	switch command {
+	case "create":
+		if len(operands) != 2 {
+			fmt.Fprintf(errOut, "Insufficient arguments.\n")
+			return 1
+		}
+		parent, name := operands[0], operands[1]
+		if _, ok := h.pools[parent]; !ok && parent != "ha-root-pool" {
+			return fakeVimCmdNotFound(errOut, "ResourcePool", parent)
+		}
+		for _, p := range h.pools {
+			if p.parent == parent && p.name == name {
+				fmt.Fprintf(errOut, "(vim.fault.DuplicateName) {\n   name = \"%s\",\n   msg = \"The name '%s' already exists.\"\n}\n", name, name)
+				return 1
+			}
+		}
+
+		p := &fakePool{id: fmt.Sprintf("pool%d", h.nextPoolID), name: name, parent: parent, cpuShares: "normal", memShares: "normal"}
+		if err := p.applyOptions(options); err != nil {
+			fmt.Fprintf(errOut, "%s\n", err)
+			return 1
+		}
+		h.pools[p.id] = p
+		h.nextPoolID++
+		fmt.Fprintf(out, "'vim.ResourcePool:%s'\n", p.id)
+		return 0
+	}
+
+	if len(operands) < 1 {
+		fmt.Fprintf(errOut, "Insufficient arguments.\n")
+		return 1
+	}
+	p, ok := h.pools[operands[0]]
+	if !ok {
+		return fakeVimCmdNotFound(errOut, "ResourcePool", operands[0])
+	}
+
+	switch command {
+	case "pool_config_get":
+		fmt.Fprintf(out, "(vim.ResourceConfigSpec) {\n   entity = 'vim.ResourcePool:%s',\n   changeVersion = <unset>,\n   lastModified = <unset>,\n", p.id)
+		fakeWriteAllocation(out, "cpuAllocation", p.cpuMin, p.cpuExpandable, p.cpuMax, p.cpuShares, true)
+		fakeWriteAllocation(out, "memoryAllocation", p.memMin, p.memExpandable, p.memMax, p.memShares, false)
+		fmt.Fprintf(out, "}\n")
+
+	case "pool_config_set":
+		if err := p.applyOptions(options); err != nil {
+			fmt.Fprintf(errOut, "%s\n", err)
+			return 1
+		}
+
+	case "rename":
+		if len(operands) != 2 {
+			fmt.Fprintf(errOut, "Insufficient arguments.\n")
+			return 1
+		}
+		p.name = operands[1]
+
+	case "destroy":
+		for _, child := range h.pools {
+			if child.parent == p.id {
+				fmt.Fprintf(errOut, "(vim.fault.ResourceInUse) {\n   msg = \"The resource pool is in use.\"\n}\n")
+				return 1
+			}
+		}
+		for _, vm := range h.vms {
+			if vm.poolID == p.id {
+				vm.poolID = p.parent
+			}
+		}
+		delete(h.pools, p.id)
+
+	default:
+		fmt.Fprintf(errOut, "Unknown command 'hostsvc/rsrc/%s'\n", command)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// inventoryPart is one part of the host inventory.  Parts are bits, so
+// several can be invalidated at once.
+type inventoryPart int
+
+const (
+	inventoryGuests inventoryPart = 1 << iota
+	inventoryPools
+	inventoryDatastores
+)
+
+// hostInventory caches what nearly every resource looks up on the host:
+// the registered guests and their vmx files, pools.xml and the datastores.
+// A part is read from the host the first time it is needed and kept until
+// the provider changes it on the host, so a run over many resources reads
+// each part a constant number of times.  The zero value is empty.
+type hostInventory struct {
+	loading keyedMutex
+
+	mu         sync.Mutex
+	parts      map[inventoryPart]interface{}
+	generation int
+}
+
+// inventoryGuest is a guest as listed by vim-cmd vmsvc/getallvms
+type inventoryGuest struct {
+	vmid    string
+	name    string
+	vmxPath string
+}
+
+// getAllVmsVmidRe matches the vmid at the start of a guest in the output of
+// vim-cmd vmsvc/getallvms
+var getAllVmsVmidRe = regexp.MustCompile(`^([0-9]+)\s+`)
+
+// getAllVmsFileRe matches the rest of a guest line from the File column on:
+// the datastore and path of the vmx file, the guest OS and the version
+var getAllVmsFileRe = regexp.MustCompile(`^\[([^\]]+)\] (.+?\.vmx)\s+(\S+\s+)?vmx-[0-9]+(\s|$)`)
+
+// get returns part of the inventory, calling read if it is not cached.
+// Callers asking for the same part wait for a single read.
+func (inv *hostInventory) get(ctx context.Context, part inventoryPart, read func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if value, ok := inv.cached(part); ok {
+		return value, nil
+	}
+
+	unlock, err := inv.loading.lock(ctx, strconv.Itoa(int(part)))
+	if err != nil {
+		return nil, newTimeoutError("read host inventory", err)
+	}
+	defer unlock()
+
+	inv.mu.Lock()
+	value, ok := inv.parts[part]
+	generation := inv.generation
+	inv.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	value, err = read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	//  Whatever changed the host while we were reading may not be in value,
+	//  so only keep it if nothing was invalidated meanwhile.
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.generation == generation {
+		if inv.parts == nil {
+			inv.parts = make(map[inventoryPart]interface{})
+		}
+		inv.parts[part] = value
+	}
+	return value, nil
+}
+
+func (inv *hostInventory) cached(part inventoryPart) (interface{}, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	value, ok := inv.parts[part]
+	return value, ok
+}
+
+// invalidate drops parts from the cache.  Call it after each change to the
+// host that the parts show.
+func (inv *hostInventory) invalidate(parts inventoryPart) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	inv.generation++
+	for part := range inv.parts {
+		if parts&part != 0 {
+			delete(inv.parts, part)
+		}
+	}
+}
+
+// invalidateInventory drops parts of the host inventory after the provider
+// changed them on the host
+func (c *Config) invalidateInventory(parts inventoryPart) {
+	log.Printf("[invalidateInventory] %03b\n", parts)
+	c.inventory.invalidate(parts)
+}
+
+// hostGuests returns the guests registered on the host, ordered by vmid
+func (c *Config) hostGuests(ctx context.Context) ([]inventoryGuest, error) {
+	value, err := c.inventory.get(ctx, inventoryGuests, func(ctx context.Context) (interface{}, error) {
+		result, err := c.executor.runReadOnly(ctx, "vim-cmd vmsvc/getallvms 2>/dev/null", "get all guests")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list guests: %s", err)
+		}
+		return parseGetAllVms(result.stdout), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]inventoryGuest), nil
+}
+
+// hostPools returns the resource pools of the host and the pool of each guest
+func (c *Config) hostPools(ctx context.Context) (*hostdPools, error) {
+	value, err := c.inventory.get(ctx, inventoryPools, func(ctx context.Context) (interface{}, error) {
+		result, err := c.executor.runReadOnly(ctx, shellCommand("cat", "/etc/vmware/hostd/pools.xml"), "read pools.xml")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read pools.xml: %s", err)
+		}
+		return parseHostdPools(result.stdout)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*hostdPools), nil
+}
+
+// hostDatastores returns the names of the VMFS and NFS datastores of the host
+func (c *Config) hostDatastores(ctx context.Context) ([]string, error) {
+	value, err := c.inventory.get(ctx, inventoryDatastores, func(ctx context.Context) (interface{}, error) {
+		remoteCmd := "esxcli --formatter=csv storage filesystem list"
+		result, err := c.executor.runReadOnly(ctx, remoteCmd, "Get list of disk stores")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get list of disk stores: %s", err)
+		}
+		return parseDatastores(result.stdout)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// guestVmxPath returns the absolute path of the vmx file of guest vmid.  A
+// guest missing from the inventory may have been registered by someone
+// else, so the guests are read again before it is reported not found.
+func (c *Config) guestVmxPath(ctx context.Context, vmid string) (string, error) {
+	for retry := 0; retry < 2; retry++ {
+		guests, err := c.hostGuests(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, guest := range guests {
+			if guest.vmid == vmid {
+				return guest.vmxPath, nil
+			}
+		}
+		c.invalidateInventory(inventoryGuests)
+	}
+	return "", newNotFoundError("get vmx path", fmt.Errorf("no guest with vmid %s", vmid))
+}
+
+// guestResourcePoolName returns the name of the resource pool guest vmid
+// is in.  pools.xml only lists guests below the root pool, so a guest that
+// is not in it is in the root pool.
+func (c *Config) guestResourcePoolName(ctx context.Context, vmid string) (string, error) {
+	pools, err := c.hostPools(ctx)
+	if err != nil {
+		return "", err
+	}
+	poolID := pools.guestPool(vmid)
+	if poolID == "" {
+		poolID = "ha-root-pool"
+	}
+	return pools.poolName(poolID), nil
+}
+
+// parseGetAllVms parses the output of vim-cmd vmsvc/getallvms.  Lines that
+// are not a guest, such as the header and the rest of a multi-line
+// annotation, are skipped.
+func parseGetAllVms(output string) []inventoryGuest {
+	var guests []inventoryGuest
+	for _, line := range strings.Split(output, "\n") {
+		if guest, ok := parseGetAllVmsLine(strings.TrimRight(line, "\r")); ok {
+			guests = append(guests, guest)
+		}
+	}
+
+	sort.SliceStable(guests, func(i, j int) bool {
+		a, _ := strconv.Atoi(guests[i].vmid)
+		b, _ := strconv.Atoi(guests[j].vmid)
+		return a < b
+	})
+	return guests
+}
+
+// parseGetAllVmsLine parses one guest line of vim-cmd vmsvc/getallvms.
+// Names and paths may both contain brackets, so each "[" is tried as the
+// start of the File column.  The columns are padded with spaces, so a vmx
+// path with a run of spaces in it has most likely swallowed part of the
+// name column and is only used if nothing else fits.
+func parseGetAllVmsLine(line string) (inventoryGuest, bool) {
+	m := getAllVmsVmidRe.FindStringSubmatch(line)
+	if m == nil {
+		return inventoryGuest{}, false
+	}
+	rest := line[len(m[0]):]
+
+	var fallback *inventoryGuest
+	for i := 1; i < len(rest); i++ {
+		if rest[i] != '[' || (rest[i-1] != ' ' && rest[i-1] != '\t') {
+			continue
+		}
+		name := strings.TrimRight(rest[:i], " \t")
+		file := getAllVmsFileRe.FindStringSubmatch(rest[i:])
+		if name == "" || file == nil {
+			continue
+		}
+
+		guest := inventoryGuest{
+			vmid:    m[1],
+			name:    name,
+			vmxPath: "/vmfs/volumes/" + file[1] + "/" + file[2],
+		}
+		if !strings.Contains(file[2], "  ") {
+			return guest, true
+		}
+		if fallback == nil {
+			fallback = &guest
+		}
+	}
+
+	if fallback != nil {
+		return *fallback, true
+	}
+	return inventoryGuest{}, false
+}
@@ -0,0 +1,166 @@
+package esxi
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestParseGetAllVms(t *testing.T) {
+	guests := parseGetAllVms(`Vmid     Name                File                          Guest OS       Version   Annotation
+12     db 01     [ssd 1] db 01/db 01.vmx     ubuntu64Guest    vmx-13    first line
+second line of the annotation
+3      web01     [ds1] web01/web01.vmx       centos64Guest    vmx-8
+Skipping invalid VM '9'
+14     web [old] x     [ds1] web [old] x/web [old] x.vmx    otherGuest    vmx-13    moved from [ds2] web/web.vmx
+15     [a] b           [ds2] ab/ab.vmx                               vmx-14
+`)
+
+	if len(guests) != 4 {
+		t.Fatalf("guests: %+v", guests)
+	}
+	if g := guests[0]; g.vmid != "3" || g.name != "web01" || g.vmxPath != "/vmfs/volumes/ds1/web01/web01.vmx" {
+		t.Errorf("guest 3: %+v", g)
+	}
+	if g := guests[1]; g.vmid != "12" || g.name != "db 01" || g.vmxPath != "/vmfs/volumes/ssd 1/db 01/db 01.vmx" {
+		t.Errorf("guest 12: %+v", g)
+	}
+	if g := guests[2]; g.vmid != "14" || g.name != "web [old] x" || g.vmxPath != "/vmfs/volumes/ds1/web [old] x/web [old] x.vmx" {
+		t.Errorf("guest 14: %+v", g)
+	}
+	if g := guests[3]; g.vmid != "15" || g.name != "[a] b" || g.vmxPath != "/vmfs/volumes/ds2/ab/ab.vmx" {
+		t.Errorf("guest 15: %+v", g)
+	}
+}
+
+func TestHostInventory(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`^vim-cmd vmsvc/getallvms`, testGetAllVms).
+		on(`^cat /etc/vmware/hostd/pools.xml$`, testPoolsXML)
+	c := testConfig(host)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vmid, err := getGuestVMID(ctx, c, "web01"); err != nil || vmid != "7" {
+				t.Errorf("getGuestVMID: %q, %v", vmid, err)
+			}
+			if _, err := getResourcePoolID(ctx, c, "child"); err != nil {
+				t.Errorf("getResourcePoolID: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := host.count(`getallvms`); n != 1 {
+		t.Errorf("getallvms ran %d times, want 1", n)
+	}
+	if n := host.count(`pools\.xml`); n != 1 {
+		t.Errorf("pools.xml read %d times, want 1", n)
+	}
+
+	// Invalidating one part leaves the others cached.
+	c.invalidateInventory(inventoryPools)
+	if _, err := getGuestVMID(ctx, c, "web01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getResourcePoolName(ctx, c, "pool7"); err != nil {
+		t.Fatal(err)
+	}
+	if host.count(`getallvms`) != 1 || host.count(`pools\.xml`) != 2 {
+		t.Errorf("after invalidating pools: getallvms %d, pools.xml %d", host.count(`getallvms`), host.count(`pools\.xml`))
+	}
+
+	// pools.xml does not list guests in the root pool.
+	if name, err := c.guestResourcePoolName(ctx, "7"); err != nil || name != "/" {
+		t.Errorf("root pool guest: %q, %v", name, err)
+	}
+	if n := host.count(`pools\.xml`); n != 2 {
+		t.Errorf("pools.xml read %d times, want 2", n)
+	}
+
+	// A guest that is not listed is looked for once more, then not found.
+	if _, err := c.guestVmxPath(ctx, "8"); !isRemoteNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if n := host.count(`getallvms`); n != 2 {
+		t.Errorf("getallvms ran %d times, want 2", n)
+	}
+}
+
+func TestHostInventoryInvalidatedWhileReading(t *testing.T) {
+	c := testConfig(newFakeExecutor(t))
+	ctx := context.Background()
+
+	value, err := c.inventory.get(ctx, inventoryDatastores, func(ctx context.Context) (interface{}, error) {
+		c.invalidateInventory(inventoryDatastores)
+		return []string{"stale"}, nil
+	})
+	if err != nil || len(value.([]string)) != 1 {
+		t.Fatalf("got %v, %v", value, err)
+	}
+	if _, ok := c.inventory.cached(inventoryDatastores); ok {
+		t.Error("a read overtaken by a change was cached")
+	}
+}
+
+func TestFakeHostInventoryCache(t *testing.T) {
+	_, server, c := testFakeHost(t)
+	pr := buildResourcePoolResourceSchema()
+	pool := testResourceData(t, pr, "", map[string]interface{}{"resource_pool_name": "dev"})
+	if err := pr.Create(pool, c); err != nil {
+		t.Fatalf("create pool: %s", err)
+	}
+
+	r := buildGuestResourceSchema()
+	var guests []*schema.ResourceData
+	// db01 is in the root pool, which pools.xml does not list guests of.
+	guestPools := map[string]string{"web01": "dev", "web02": "dev", "web03": "dev", "db01": "/"}
+	for _, name := range []string{"web01", "web02", "web03", "db01"} {
+		d := testResourceData(t, r, "", map[string]interface{}{
+			"guest_name":         name,
+			"disk_store":         "ds1",
+			"resource_pool_name": guestPools[name],
+			"power":              "off",
+		})
+		if err := r.Create(d, c); err != nil {
+			t.Fatalf("create %s: %s", name, err)
+		}
+		guests = append(guests, d)
+	}
+
+	// A new run starts with an empty inventory and reads each part once.
+	c = server.providerConfig(t)
+	before := len(server.ran())
+	if err := pr.Read(pool, c); err != nil {
+		t.Fatalf("read pool: %s", err)
+	}
+	for _, d := range guests {
+		if err := r.Read(d, c); err != nil || d.Get("resource_pool_name").(string) != guestPools[d.Get("guest_name").(string)] {
+			t.Fatalf("read %s: %v, pool %q", d.Get("guest_name"), err, d.Get("resource_pool_name"))
+		}
+	}
+
+	inventory := 0
+	for _, command := range server.ran()[before:] {
+		if strings.Contains(command, "pools.xml") || strings.Contains(command, "getallvms") {
+			inventory++
+		}
+	}
+	if inventory != 2 {
+		t.Errorf("refresh made %d inventory calls, want 2: %q", inventory, server.ran()[before:])
+	}
+
+	// Deleting a guest drops it from the inventory.
+	if err := r.Delete(guests[0], c); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if vmid, err := getGuestVMID(context.Background(), c, "web01"); err != nil || vmid != "" {
+		t.Errorf("deleted guest still listed: %q, %v", vmid, err)
+	}
+}
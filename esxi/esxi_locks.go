@@ -0,0 +1,91 @@
+package esxi
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// keyedMutex hands out one lock per key, such as a vmid.  Locks are
+// created on first use and dropped once nobody holds or waits for them.
+// The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the lock for one key.  It is a channel so waiting for it
+// can give up when the context expires.
+type keyedLock struct {
+	held chan struct{}
+	refs int
+}
+
+// lock locks every key in keys, in sorted order so that two callers
+// locking overlapping keys cannot deadlock.  The returned function
+// unlocks them again.
+func (m *keyedMutex) lock(ctx context.Context, keys ...string) (func(), error) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	var held []string
+	unlock := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			m.unlockKey(held[i])
+		}
+	}
+
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		if err := m.lockKey(ctx, key); err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, key)
+	}
+	return unlock, nil
+}
+
+func (m *keyedMutex) lockKey(ctx context.Context, key string) error {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l := m.locks[key]
+	if l == nil {
+		l = &keyedLock{held: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	select {
+	case l.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		m.release(key, l)
+		return ctx.Err()
+	}
+}
+
+func (m *keyedMutex) unlockKey(key string) {
+	m.mu.Lock()
+	l := m.locks[key]
+	m.mu.Unlock()
+
+	<-l.held
+	m.release(key, l)
+}
+
+// release drops a reference to l and forgets it when it is unused
+func (m *keyedMutex) release(key string, l *keyedLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
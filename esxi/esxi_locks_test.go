@@ -0,0 +1,116 @@
+package esxi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+	ctx := context.Background()
+
+	unlock, err := m.lock(ctx, "1")
+	if err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+
+	// Other keys are independent.
+	unlockOther, err := m.lock(ctx, "2")
+	if err != nil {
+		t.Fatalf("lock other key: %s", err)
+	}
+	unlockOther()
+
+	// The same key waits, and gives up when the context expires.
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.lock(short, "2", "1"); err != context.DeadlineExceeded {
+		t.Fatalf("lock held key: err = %v, want deadline exceeded", err)
+	}
+
+	// Giving up released "2" again.
+	unlockOther, err = m.lock(ctx, "2")
+	if err != nil {
+		t.Fatalf("lock other key again: %s", err)
+	}
+	unlockOther()
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := m.lock(ctx, "1", "1")
+		if err != nil {
+			t.Errorf("lock after unlock: %s", err)
+			return
+		}
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatalf("key locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks left after unlocking", len(m.locks))
+	}
+}
+
+func TestLockResourcePools(t *testing.T) {
+	c := testConfig(nil)
+	ctx := context.Background()
+
+	unlock, err := c.lockResourcePools(ctx, "dev/web")
+	if err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	defer unlock()
+
+	// Pools are keyed by their last path element.
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = c.lockResourcePools(short, "app", "web")
+	if !isRemoteTimeout(err) {
+		t.Errorf("lock web: err = %v, want a timeout", err)
+	}
+}
+
+func TestFakeHostMaxSessions(t *testing.T) {
+	for _, maxSessions := range []int{0, 2} {
+		host, server, c := testFakeHost(t)
+		c.maxSessions = maxSessions
+		c.sshPool, _ = newSSHClientPool(c.sshConnectionSettings())
+		c.executor = newSSHExecutor(c.sshConnectionSettings())
+
+		// Hold the host so that commands pile up in open sessions.
+		host.mu.Lock()
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.executor.run(context.Background(), "vmware --version", "version"); err != nil {
+					t.Errorf("vmware --version: %s", err)
+				}
+			}()
+		}
+		time.Sleep(200 * time.Millisecond)
+		host.mu.Unlock()
+		wg.Wait()
+
+		peak := server.maxSessions()
+		if maxSessions == 0 && peak <= 2 {
+			t.Errorf("no cap: at most %d sessions were open at once, want more than 2", peak)
+		}
+		if maxSessions > 0 && peak > maxSessions {
+			t.Errorf("cap %d: %d sessions were open at once", maxSessions, peak)
+		}
+	}
+}
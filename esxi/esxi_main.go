@@ -2,8 +2,30 @@ package esxi
 
 // SSHConnectionSettings contains SSH connection settings
 type SSHConnectionSettings struct {
-	host string
-	port string
-	user string
-	pass string
+	host                 string
+	port                 string
+	user                 string
+	pass                 string
+	privateKey           string
+	privateKeyPassphrase string
+	useAgent             bool
+
+	knownHostsFile        string
+	hostKeyFingerprint    string
+	insecureIgnoreHostKey bool
+
+	retry       retryPolicy
+	maxSessions int
+	bastion     *SSHConnectionSettings
+	isBastion   bool
+	pool        *sshClientPool
+}
+
+// optionName returns the provider argument called name for these settings,
+// so that errors about the bastion point at the bastion block
+func (s SSHConnectionSettings) optionName(name string) string {
+	if s.isBastion {
+		return "bastion." + name
+	}
+	return "esxi_" + name
 }
@@ -0,0 +1,150 @@
+package esxi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ESXi limits a vm or resource pool name to 80 characters and a
+// datastore name to 42.
+const (
+	maxInventoryNameLen = 80
+	maxDatastoreNameLen = 42
+)
+
+// checkName checks a single name or path element against what ESXi
+// accepts.  badChars lists the characters not allowed on top of control
+// characters.
+func checkName(kind string, name string, maxLen int, badChars string) error {
+	if name == "" {
+		return fmt.Errorf("%s must not be empty", kind)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("%s must not be %q", kind, name)
+	}
+	if len([]rune(name)) > maxLen {
+		return fmt.Errorf("%s %q is longer than %d characters", kind, name, maxLen)
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("%s %q must not start or end with white space", kind, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%s %q must not contain control characters", kind, name)
+		}
+		if strings.ContainsRune(badChars, r) {
+			return fmt.Errorf("%s %q must not contain %q", kind, name, r)
+		}
+	}
+	return nil
+}
+
+// checkGuestName checks a guest name.  It is also the name of the guest's
+// directory and boot disk.
+func checkGuestName(name string) error {
+	return checkName("guest name", name, maxInventoryNameLen, `/\%"`)
+}
+
+// checkDiskStoreName checks a datastore name
+func checkDiskStoreName(name string) error {
+	return checkName("disk store", name, maxDatastoreNameLen, `/\%"`)
+}
+
+// checkResourcePoolName checks a resource pool path such as "dev/web".
+// "/" is the root pool.
+func checkResourcePoolName(name string) error {
+	if name == "/" {
+		return nil
+	}
+	for _, element := range strings.Split(strings.TrimPrefix(name, "/"), "/") {
+		if err := checkName("resource pool name", element, maxInventoryNameLen, `\%"<>&`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVirtualDiskDir checks a directory path below a datastore
+func checkVirtualDiskDir(dir string) error {
+	for _, element := range strings.Split(dir, "/") {
+		if err := checkName("virtual disk dir", element, maxInventoryNameLen, `\%"`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVirtualDiskName checks a virtual disk file name.  It must end in
+// .vmdk, and have no other periods since vmkfstools names the extents
+// after it.
+func checkVirtualDiskName(name string) error {
+	if !strings.HasSuffix(name, ".vmdk") {
+		return fmt.Errorf("virtual disk name %q must end with .vmdk", name)
+	}
+	base := strings.TrimSuffix(name, ".vmdk")
+	if strings.Contains(base, ".") {
+		return fmt.Errorf("virtual disk name %q must not contain a period before .vmdk", name)
+	}
+	return checkName("virtual disk name", base, maxInventoryNameLen, `/\%"',`)
+}
+
+// vmxKeyRe matches the keys ESXi writes to a vmx file, such as
+// "vhv.enable" or "RemoteDisplay.vnc.port"
+var vmxKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// checkExtraConfigKey checks an extra_config key.  It must be a plain vmx
+// key that the provider does not manage itself.
+func checkExtraConfigKey(key string) error {
+	if !vmxKeyRe.MatchString(key) {
+		return fmt.Errorf("extra_config key %q is not a vmx key", key)
+	}
+	if isManagedVmxKey(key) {
+		return fmt.Errorf("extra_config key %q is managed by the provider", key)
+	}
+	return nil
+}
+
+// validateExtraConfig is the schema.SchemaValidateFunc of extra_config.
+// vmx keys ignore case, so keys that differ only in case are the same key.
+func validateExtraConfig(v interface{}, k string) ([]string, []error) {
+	extraConfig, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, []error{fmt.Errorf("expected type of %s to be map", k)}
+	}
+
+	keys := make([]string, 0, len(extraConfig))
+	for key := range extraConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	seen := make(map[string]string)
+	for _, key := range keys {
+		if err := checkExtraConfigKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", k, err))
+		}
+		if other, ok := seen[strings.ToLower(key)]; ok {
+			errs = append(errs, fmt.Errorf("%s: extra_config keys %q and %q are the same vmx key", k, other, key))
+		}
+		seen[strings.ToLower(key)] = key
+	}
+	return nil, errs
+}
+
+// validateName wraps a name check as a schema.SchemaValidateFunc
+func validateName(check func(string) error) func(interface{}, string) ([]string, []error) {
+	return func(v interface{}, k string) ([]string, []error) {
+		name, ok := v.(string)
+		if !ok {
+			return nil, []error{fmt.Errorf("expected type of %s to be string", k)}
+		}
+		if err := check(name); err != nil {
+			return nil, []error{fmt.Errorf("%s: %s", k, err)}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,110 @@
+package esxi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckNames(t *testing.T) {
+	cases := []struct {
+		check func(string) error
+		name  string
+		ok    bool
+	}{
+		{checkGuestName, "web01", true},
+		{checkGuestName, "web 01 (prod)", true},
+		{checkGuestName, "it's $(reboot)", true},
+		{checkGuestName, "", false},
+		{checkGuestName, "..", false},
+		{checkGuestName, "dev/web01", false},
+		{checkGuestName, `web"01`, false},
+		{checkGuestName, "web%01", false},
+		{checkGuestName, "web\n01", false},
+		{checkGuestName, " web01", false},
+		{checkGuestName, strings.Repeat("a", 80), true},
+		{checkGuestName, strings.Repeat("a", 81), false},
+
+		{checkDiskStoreName, "ds1", true},
+		{checkDiskStoreName, "Least Used", true},
+		{checkDiskStoreName, "ds/1", false},
+		{checkDiskStoreName, strings.Repeat("a", 43), false},
+
+		{checkResourcePoolName, "/", true},
+		{checkResourcePoolName, "dev", true},
+		{checkResourcePoolName, "/dev/web", true},
+		{checkResourcePoolName, "dev//web", false},
+		{checkResourcePoolName, "dev/", false},
+		{checkResourcePoolName, "dev/<web>", false},
+		{checkResourcePoolName, "dev&web", false},
+
+		{checkVirtualDiskDir, "disks", true},
+		{checkVirtualDiskDir, "disks/web01", true},
+		{checkVirtualDiskDir, "../disks", false},
+		{checkVirtualDiskDir, "/disks", false},
+
+		{checkVirtualDiskName, "data.vmdk", true},
+		{checkVirtualDiskName, "data disk.vmdk", true},
+		{checkVirtualDiskName, "data", false},
+		{checkVirtualDiskName, ".vmdk", false},
+		{checkVirtualDiskName, "data.1.vmdk", false},
+		{checkVirtualDiskName, "a/data.vmdk", false},
+		{checkVirtualDiskName, "it's.vmdk", false},
+		{checkVirtualDiskName, "a,b.vmdk", false},
+
+		{checkExtraConfigKey, "vhv.enable", true},
+		{checkExtraConfigKey, "RemoteDisplay.vnc.port", true},
+		{checkExtraConfigKey, "sched.mem.min", true},
+		{checkExtraConfigKey, "", false},
+		{checkExtraConfigKey, "vhv enable", false},
+		{checkExtraConfigKey, `vhv.enable = "TRUE"`, false},
+		{checkExtraConfigKey, "memsize", false},
+		{checkExtraConfigKey, "guestinfo.userdata", false},
+		{checkExtraConfigKey, "ethernet0.virtualDev", false},
+		{checkExtraConfigKey, "scsi0:1.fileName", false},
+		{checkExtraConfigKey, "sched.scsi0:1.shares", false},
+		{checkExtraConfigKey, "pciBridge4.present", false},
+	}
+
+	for _, tc := range cases {
+		err := tc.check(tc.name)
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected error %s", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%q: expected an error", tc.name)
+		}
+	}
+}
+
+func TestValidateNameAtPlan(t *testing.T) {
+	r := buildGuestResourceSchema()
+	_, errs := r.Schema["guest_name"].ValidateFunc("web/01", "guest_name")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "guest_name") {
+		t.Errorf("errors = %v", errs)
+	}
+
+	_, errs = r.Schema["guest_name"].ValidateFunc("web01", "guest_name")
+	if len(errs) != 0 {
+		t.Errorf("errors = %v", errs)
+	}
+}
+
+func TestValidateExtraConfigAtPlan(t *testing.T) {
+	r := buildGuestResourceSchema()
+	validate := r.Schema["extra_config"].ValidateFunc
+
+	_, errs := validate(map[string]interface{}{"vhv.enable": "TRUE", "numvcpus": "4"}, "extra_config")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "numvcpus") {
+		t.Errorf("errors = %v", errs)
+	}
+
+	_, errs = validate(map[string]interface{}{"vhv.enable": "TRUE", "VHV.enable": "FALSE"}, "extra_config")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "same vmx key") {
+		t.Errorf("errors = %v", errs)
+	}
+
+	_, errs = validate(map[string]interface{}{"vhv.enable": "TRUE", "disk.EnableUUID": "TRUE"}, "extra_config")
+	if len(errs) != 0 {
+		t.Errorf("errors = %v", errs)
+	}
+}
@@ -0,0 +1,89 @@
+package esxi
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactedText replaces secrets in log output and error messages
+const redactedText = "<redacted>"
+
+// secretRedactor masks registered secrets in everything written through it
+type secretRedactor struct {
+	mu      sync.RWMutex
+	secrets []string
+	out     io.Writer
+}
+
+// logRedactor filters the provider's log output
+var logRedactor = &secretRedactor{}
+
+var installLogRedactorOnce sync.Once
+
+// installLogRedactor routes the standard logger through logRedactor, so
+// every log.Printf in the provider is filtered
+func installLogRedactor() {
+	installLogRedactorOnce.Do(func() {
+		logRedactor.out = log.Writer()
+		log.SetOutput(logRedactor)
+	})
+}
+
+// registerSecret masks secret, and its URL-escaped and vmx-escaped forms,
+// from now on
+func registerSecret(secret string) {
+	logRedactor.add(secret)
+}
+
+// redactSecrets masks all registered secrets in s
+func redactSecrets(s string) string {
+	return logRedactor.redact(s)
+}
+
+func (r *secretRedactor) add(secret string) {
+	if secret == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret), vmxEscape(secret)} {
+		known := false
+		for _, existing := range r.secrets {
+			if existing == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			r.secrets = append(r.secrets, s)
+		}
+	}
+
+	// Longest first, so a secret containing another is masked whole
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, redactedText, -1)
+	}
+	return s
+}
+
+func (r *secretRedactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.out, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package esxi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	r := &secretRedactor{out: &buf}
+	r.add("p@ss word")
+	r.add("p@ss")
+	r.add("")
+
+	line := "vi://root:p%40ss+word@esxi/ cmd:/echo p@ss word/ other:/p@ss/\n"
+	n, err := r.Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+
+	got := buf.String()
+	if strings.Contains(got, "p@ss") || strings.Contains(got, "p%40ss") {
+		t.Errorf("secret leaked: %s", got)
+	}
+	if strings.Count(got, redactedText) != 3 {
+		t.Errorf("expected 3 redactions: %s", got)
+	}
+}
+
+func TestSecretRedactorVmxEscaped(t *testing.T) {
+	var buf bytes.Buffer
+	r := &secretRedactor{out: &buf}
+	r.add("line1\nline2 #1 a|b \"q\"")
+
+	vmx := parseVmx("guestOS = \"centos-64\"\n")
+	vmx.set("guestinfo.secret", "line1\nline2 #1 a|b \"q\"")
+	if _, err := r.Write([]byte(vmx.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	if strings.Contains(got, "line2") {
+		t.Errorf("secret leaked: %s", got)
+	}
+	if !strings.Contains(got, "guestinfo.secret = \""+redactedText+"\"") {
+		t.Errorf("expected the vmx value to be redacted: %s", got)
+	}
+}
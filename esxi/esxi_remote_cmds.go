@@ -1,97 +1,272 @@
 package esxi
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"os"
+	"regexp"
 	"strings"
-	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-
-	"github.com/tmc/scp"
 )
 
-// connectToHost connect to ESXi host using SSH
-func connectToHost(esxiSSHinfo SSHConnectionSettings) (*ssh.Client, *ssh.Session, error) {
+// connectToHost opens a new session on the pooled SSH connection to the ESXi host
+func connectToHost(ctx context.Context, esxiSSHinfo SSHConnectionSettings) (*ssh.Client, *ssh.Session, error) {
+	if esxiSSHinfo.pool == nil {
+		return nil, nil, fmt.Errorf("No SSH connection pool for %s:%s", esxiSSHinfo.host, esxiSSHinfo.port)
+	}
 
-	sshConfig := &ssh.ClientConfig{
-		User: esxiSSHinfo.user,
-		Auth: []ssh.AuthMethod{
-			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-				// Reply password to all questions
-				answers := make([]string, len(questions))
-				for i := range answers {
-					answers[i] = esxiSSHinfo.pass
-				}
+	return esxiSSHinfo.pool.newSession(ctx)
+}
 
-				return answers, nil
-			}),
-		},
-	}
+// remoteCmdResult holds the output and exit status of a command run on the host
+type remoteCmdResult struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
 
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+// runCommandOnHost runs a command on the remote host.  A non-zero exit status
+// is returned as a *remoteCmdError along with the result.
+func runCommandOnHost(ctx context.Context, esxiSSHinfo SSHConnectionSettings, remoteSSHCommand string, shortCmdDesc string) (remoteCmdResult, error) {
+	return runCommandWithInputOnHost(ctx, esxiSSHinfo, remoteSSHCommand, shortCmdDesc, nil)
+}
 
-	esxiHostAndPort := fmt.Sprintf("%s:%s", esxiSSHinfo.host, esxiSSHinfo.port)
+// runCommandWithInputOnHost runs a command on the remote host with stdin
+// read from input
+func runCommandWithInputOnHost(ctx context.Context, esxiSSHinfo SSHConnectionSettings, remoteSSHCommand string, shortCmdDesc string, input io.Reader) (remoteCmdResult, error) {
+	log.Println("[runRemoteSshCommand] :" + shortCmdDesc)
 
-	attempt := 10
-	for attempt > 0 {
-		client, err := ssh.Dial("tcp", esxiHostAndPort, sshConfig)
-		if err != nil {
-			log.Printf("[runRemoteSshCommand] Retry connection: %d\n", attempt)
-			attempt--
-			time.Sleep(1 * time.Second)
-		} else {
+	var result remoteCmdResult
 
-			session, err := client.NewSession()
-			if err != nil {
-				client.Close()
-				return nil, nil, fmt.Errorf("Session Connection Error")
-			}
+	if esxiSSHinfo.pool != nil {
+		if err := esxiSSHinfo.pool.acquireSession(ctx); err != nil {
+			result.exitCode = -1
+			return result, newTimeoutError(shortCmdDesc, err)
+		}
+		defer esxiSSHinfo.pool.releaseSession()
+	}
 
-			return client, session, nil
+	_, session, err := connectToHost(ctx, esxiSSHinfo)
+	if err != nil {
+		log.Println("[runRemoteSshCommand] Failed err: " + err.Error())
+		result.exitCode = -1
+		if ctx.Err() != nil {
+			return result, newTimeoutError(shortCmdDesc, ctx.Err())
+		}
+		return result, newConnectError(shortCmdDesc, err)
+	}
+	defer session.Close()
 
+	var stdoutBuf, stderrBuf bytes.Buffer
+	session.Stdout = &stdoutBuf
+	session.Stderr = &stderrBuf
+	session.Stdin = input
+
+	err = runSessionWithContext(ctx, session, func() error {
+		return session.Run(remoteSSHCommand)
+	})
+	if ctx.Err() != nil {
+		log.Printf("[runRemoteSshCommand] cmd:/%s/ %s\n", remoteSSHCommand, ctx.Err())
+		result.exitCode = -1
+		return result, newTimeoutError(shortCmdDesc, ctx.Err())
+	}
+
+	//  stdout is kept as is, so files read with cat come back byte for byte
+	result.stdout = stdoutBuf.String()
+	result.stderr = strings.TrimSpace(stderrBuf.String())
+	log.Printf("[runRemoteSshCommand] cmd:/%s/\n stdout:/%s/\nstderr:/%s/\nerr:/%v/\n", remoteSSHCommand, result.stdout, result.stderr, err)
+
+	if err != nil {
+		exitErr, ok := err.(*ssh.ExitError)
+		if !ok {
+			result.exitCode = -1
+			return result, newTransportError(shortCmdDesc, err)
 		}
+
+		result.exitCode = exitErr.ExitStatus()
+		return result, newRemoteCmdError(shortCmdDesc, result, err)
 	}
-	return nil, nil, fmt.Errorf("Client Connection Error")
+
+	return result, nil
 }
 
-// runCommandOnHost runs a command on the remote host
-func runCommandOnHost(esxiSSHinfo SSHConnectionSettings, remoteSSHCommand string, shortCmdDesc string) (string, error) {
-	log.Println("[runRemoteSshCommand] :" + shortCmdDesc)
+// runReadOnlyCommandOnHost runs a command that does not change anything on
+// the host, so it is safe to retry on the error classes the retry policy
+// allows.  Failures to connect are not retried here, the connection pool
+// already retried them.
+func runReadOnlyCommandOnHost(ctx context.Context, esxiSSHinfo SSHConnectionSettings, remoteSSHCommand string, shortCmdDesc string) (remoteCmdResult, error) {
+	policy := esxiSSHinfo.retry
 
-	client, session, err := connectToHost(esxiSSHinfo)
-	if err != nil {
-		log.Println("[runRemoteSshCommand] Failed err: " + err.Error())
-		return "Failed to ssh to esxi host", err
+	for attempt := 1; ; attempt++ {
+		result, err := runCommandOnHost(ctx, esxiSSHinfo, remoteSSHCommand, shortCmdDesc)
+		if err == nil || attempt >= policy.maxAttempts || !policy.retryable(err) || isRemoteConnectFailure(err) {
+			return result, err
+		}
+
+		log.Printf("[runReadOnlyCommandOnHost] %s: %s\n", shortCmdDesc, err)
+		if policy.wait(ctx, attempt) != nil {
+			return result, err
+		}
 	}
+}
 
-	stdoutRaw, err := session.CombinedOutput(remoteSSHCommand)
-	stdout := strings.TrimSpace(string(stdoutRaw))
-	log.Printf("[runRemoteSshCommand] cmd:/%s/\n stdout:/%s/\nstderr:/%s/\n", remoteSSHCommand, stdout, err)
+// runSessionWithContext runs fn, which uses session, and closes the session
+// if ctx expires first so that a hung remote command cannot block forever
+func runSessionWithContext(ctx context.Context, session *ssh.Session, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
 
-	client.Close()
-	return stdout, err
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Close()
+		return ctx.Err()
+	}
 }
 
-// copyFileToHost copies a file to the host via SCP
-func copyFileToHost(esxiSSHinfo SSHConnectionSettings, localfileName string, remoteFileName string) error {
-	log.Println("[copyFileViaScp] :" + localfileName)
+// writeFileOnHost copies content to path on the host over SFTP.  It is
+// written to a temporary file next to path and renamed over it, so path is
+// never left half written.  With backup set the previous file is kept as
+// path.bak.
+func writeFileOnHost(ctx context.Context, esxiSSHinfo SSHConnectionSettings, path string, content string, backup bool) error {
+	log.Println("[writeFileOnHost] :" + path)
+
+	shortCmdDesc := "write " + path
+
+	if esxiSSHinfo.pool != nil {
+		if err := esxiSSHinfo.pool.acquireSession(ctx); err != nil {
+			return newTimeoutError(shortCmdDesc, err)
+		}
+		defer esxiSSHinfo.pool.releaseSession()
+	}
+
+	_, session, err := connectToHost(ctx, esxiSSHinfo)
+	if err != nil {
+		log.Println("[writeFileOnHost] Failed err: " + err.Error())
+		if ctx.Err() != nil {
+			return newTimeoutError(shortCmdDesc, ctx.Err())
+		}
+		return newConnectError(shortCmdDesc, err)
+	}
+	defer session.Close()
 
-	_, session, err := connectToHost(esxiSSHinfo)
+	err = runSessionWithContext(ctx, session, func() error {
+		return sftpWriteFile(session, path, content, backup)
+	})
+	if ctx.Err() != nil {
+		log.Printf("[writeFileOnHost] %s: %s\n", path, ctx.Err())
+		return newTimeoutError(shortCmdDesc, ctx.Err())
+	}
+	if err != nil {
+		log.Printf("[writeFileOnHost] %s: %s\n", path, err)
+		return newFileTransferError(shortCmdDesc, err)
+	}
+	return nil
+}
 
+// sftpWriteFile starts the sftp subsystem on session and does the work of
+// writeFileOnHost.  The temporary file is removed if anything fails.
+func sftpWriteFile(session *ssh.Session, path string, content string, backup bool) error {
+	stdin, err := session.StdinPipe()
 	if err != nil {
-		log.Println("[copyFileViaScp] Failed to connect to ESXi host via SSH: " + err.Error())
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
 
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
 		return err
 	}
 
-	err = scp.CopyPath(localfileName, remoteFileName, session)
+	tmpPath := fmt.Sprintf("%s.tmp%d", path, rand.Int63())
 
+	err = sftpPutFile(client, tmpPath, strings.NewReader(content))
+	if err == nil && backup {
+		err = sftpCopyFile(client, path, path+".bak")
+	}
+	if err == nil {
+		//  A plain SFTP rename refuses to replace an existing file
+		err = client.PosixRename(tmpPath, path)
+	}
 	if err != nil {
-		log.Println("[copyFileViaScp] Failed to copy file to ESXi host: " + err.Error())
+		client.Remove(tmpPath)
+	}
+
+	//  Close waits for sftp-server to exit, so the session is over before it
+	//  is given to the next command
+	if closeErr := client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
+// sftpPutFile writes everything read from r to path, replacing any file there
+func sftpPutFile(client *sftp.Client, path string, r io.Reader) error {
+	f, err := client.Create(path)
+	if err != nil {
 		return err
 	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-	return nil
+// sftpCopyFile copies src to dst.  A missing src is not an error, there is
+// nothing to copy.
+func sftpCopyFile(client *sftp.Client, src string, dst string) error {
+	f, err := client.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return sftpPutFile(client, dst, f)
+}
+
+// shellQuote quotes s as a single word for the host's shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// shellPlainWord matches arguments that need no quoting
+var shellPlainWord = regexp.MustCompile(`^[A-Za-z0-9_./:=@+,-]+$`)
+
+// shellArg quotes s for the host's shell unless it is a plain word
+func shellArg(s string) string {
+	if shellPlainWord.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// shellCommand builds a command line from name and args.  Every argument is
+// quoted, so names and paths can never be read as shell syntax.  Build
+// pipelines by joining shellCommand results with constant shell text.
+func shellCommand(name string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	words = append(words, name)
+	for _, arg := range args {
+		words = append(words, shellArg(arg))
+	}
+	return strings.Join(words, " ")
 }
@@ -0,0 +1,326 @@
+package esxi
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"/vmfs/volumes/ds1/vm/vm.vmx":   `'/vmfs/volumes/ds1/vm/vm.vmx'`,
+		"/vmfs/volumes/my ds/vm/vm.vmx": `'/vmfs/volumes/my ds/vm/vm.vmx'`,
+		"it's":                          `'it'"'"'s'`,
+		"$(reboot)":                     `'$(reboot)'`,
+	}
+
+	for in, want := range cases {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"mkdir", []string{"/vmfs/volumes/ds1/web01"}, `mkdir /vmfs/volumes/ds1/web01`},
+		{"mkdir", []string{"/vmfs/volumes/ds1/my vm"}, `mkdir '/vmfs/volumes/ds1/my vm'`},
+		{"vim-cmd", []string{"hostsvc/rsrc/create", "--cpu-shares=normal", "pool1", "$(reboot)"},
+			`vim-cmd hostsvc/rsrc/create --cpu-shares=normal pool1 '$(reboot)'`},
+		{"grep", []string{"-F", `<name>a"b</name>`}, `grep -F '<name>a"b</name>'`},
+		{"rm", []string{"-f", ""}, `rm -f ''`},
+	}
+
+	for _, tc := range cases {
+		if got := shellCommand(tc.name, tc.args...); got != tc.want {
+			t.Errorf("shellCommand(%q, %q) = %s, want %s", tc.name, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestConnectFailures(t *testing.T) {
+	_, server, _ := testFakeHost(t)
+	connect := func(c *Config) error {
+		c.retryPolicy, _ = newRetryPolicy(5, "1ms", "1ms", nil)
+		c.sshPool, _ = newSSHClientPool(c.sshConnectionSettings())
+		c.executor = newSSHExecutor(c.sshConnectionSettings())
+		_, err := c.executor.runReadOnly(context.Background(), "vmware --version", "version")
+		return err
+	}
+
+	// A wrong password is tried once, so it cannot lock the account
+	bad := server.providerConfig(t)
+	bad.esxiPassword = "wrong"
+	before := server.connections()
+	if err := connect(bad); remoteErrorKindOf(err) != remoteErrorAuthentication {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if n := server.connections() - before; n != 1 {
+		t.Errorf("wrong password dialed %d times, want 1", n)
+	}
+
+	// So is a host key mismatch
+	bad = server.providerConfig(t)
+	bad.esxiHostKeyFingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	before = server.connections()
+	if err := connect(bad); remoteErrorKindOf(err) != remoteErrorHostKey {
+		t.Errorf("wrong host key: got %v", err)
+	}
+	if n := server.connections() - before; n != 1 {
+		t.Errorf("wrong host key dialed %d times, want 1", n)
+	}
+
+	// A host that drops connections is retried by the pool only
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var mu sync.Mutex
+	accepted := 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+
+	bad = server.providerConfig(t)
+	bad.esxiHostName, bad.esxiHostPort, _ = net.SplitHostPort(listener.Addr().String())
+	if err := connect(bad); !isRemoteTransport(err) {
+		t.Errorf("dropped connections: got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if accepted != 5 {
+		t.Errorf("dropped connections dialed %d times, want 5", accepted)
+	}
+}
+
+func TestFakeHostConnect(t *testing.T) {
+	_, server, c := testFakeHost(t)
+
+	if err := c.validateEsxiCredentials(context.Background()); err != nil {
+		t.Fatalf("validateEsxiCredentials: %s", err)
+	}
+
+	result, err := c.executor.runReadOnly(context.Background(), "vmware --version", "version")
+	if err != nil || !strings.HasPrefix(result.stdout, "VMware ESXi") {
+		t.Errorf("vmware --version: %q, %v", result.stdout, err)
+	}
+
+	_, err = c.executor.run(context.Background(), "vmkfstools -U /vmfs/volumes/ds1/none.vmdk", "delete missing disk")
+	if !isRemoteNotFound(err) {
+		t.Errorf("deleting a missing disk: got %v, want a not-found error", err)
+	}
+
+	// The pooled connection is re-established after the host drops it
+	server.dropConnections()
+	if err := c.validateEsxiCredentials(context.Background()); err != nil {
+		t.Errorf("after dropped connection: %s", err)
+	}
+
+	// A wrong password is refused
+	bad := server.providerConfig(t)
+	bad.esxiPassword = "wrong"
+	bad.sshPool, _ = newSSHClientPool(bad.sshConnectionSettings())
+	bad.executor = newSSHExecutor(bad.sshConnectionSettings())
+	if err := bad.validateEsxiCredentials(context.Background()); err == nil {
+		t.Error("expected wrong password to be refused")
+	}
+}
+
+func TestFakeHostWriteFile(t *testing.T) {
+	host, server, c := testFakeHost(t)
+	ctx := context.Background()
+	path := "/vmfs/volumes/ds1/it's here.vmx"
+
+	if err := c.executor.writeFile(ctx, path, "first\n", true); err != nil {
+		t.Fatalf("writeFile: %s", err)
+	}
+	if _, ok := host.file(path + ".bak"); ok {
+		t.Error("backup written for a new file")
+	}
+
+	if err := c.executor.writeFile(ctx, path, "second\n", true); err != nil {
+		t.Fatalf("writeFile: %s", err)
+	}
+	if got, _ := host.file(path); got != "second\n" {
+		t.Errorf("content: got %q", got)
+	}
+	if got, _ := host.file(path + ".bak"); got != "first\n" {
+		t.Errorf("backup: got %q", got)
+	}
+	if ran := server.ran(); len(ran) != 0 || server.sftpSessions() != 2 {
+		t.Errorf("expected two sftp sessions and no commands, ran %q", ran)
+	}
+	if result, err := c.executor.runReadOnly(ctx, shellCommand("cat", path), "cat"); err != nil || result.stdout != "second\n" {
+		t.Errorf("cat: got %q, %v", result.stdout, err)
+	}
+
+	if err := c.executor.writeFile(ctx, "/vmfs/volumes/nods/x.vmx", "x", false); err == nil {
+		t.Error("expected write to a missing directory to fail")
+	}
+	for name := range host.files {
+		if strings.Contains(name, ".tmp") {
+			t.Errorf("temp file left behind: %s", name)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	_, server, c := testFakeHost(t)
+	c.maxSessions = 1
+	c.sshPool, _ = newSSHClientPool(c.sshConnectionSettings())
+	c.executor = newSSHExecutor(c.sshConnectionSettings())
+
+	// A command that hangs is abandoned when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.executor.run(ctx, "sleep 60", "sleep")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s", elapsed)
+	}
+	if !isRemoteTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	// Its session is closed on the host
+	for deadline := time.Now().Add(5 * time.Second); server.openSessions() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still open", server.openSessions())
+		}
+	}
+
+	// And the only session slot is free for the next command
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.executor.run(ctx, "vmware --version", "version"); err != nil {
+		t.Errorf("next command: %s", err)
+	}
+}
+
+// testBastionSettings returns settings that log in to bastion with password
+func testBastionSettings(bastion *fakeSSHServer, password string) *SSHConnectionSettings {
+	host, port, _ := net.SplitHostPort(bastion.listener.Addr().String())
+	return &SSHConnectionSettings{
+		host:               host,
+		port:               port,
+		user:               fakeSSHUser,
+		pass:               password,
+		hostKeyFingerprint: ssh.FingerprintSHA256(bastion.hostKey),
+		isBastion:          true,
+	}
+}
+
+// testBastionConfig returns a provider config that reaches server through bastion
+func testBastionConfig(t *testing.T, server *fakeSSHServer, bastion *SSHConnectionSettings) *Config {
+	c := server.providerConfig(t)
+	c.retryPolicy, _ = newRetryPolicy(5, "1ms", "1ms", nil)
+	bastion.retry = c.retryPolicy
+	c.esxiBastion = bastion
+
+	var err error
+	c.sshPool, err = newSSHClientPool(c.sshConnectionSettings())
+	if err != nil {
+		t.Fatalf("Failed to create SSH pool: %s", err)
+	}
+	c.executor = newSSHExecutor(c.sshConnectionSettings())
+	return c
+}
+
+func TestBastion(t *testing.T) {
+	host, server, _ := testFakeHost(t)
+	bastion := startFakeSSHServer(t, newFakeESXiHost())
+	c := testBastionConfig(t, server, testBastionSettings(bastion, fakeSSHPassword))
+	ctx := context.Background()
+
+	result, err := c.executor.runReadOnly(ctx, "vmware --version", "version")
+	if err != nil || !strings.Contains(result.stdout, "VMware ESXi") {
+		t.Fatalf("command through bastion: %q, %v", result.stdout, err)
+	}
+
+	if _, err := c.executor.run(ctx, "mkdir -p /vmfs/volumes/ds1/web01", "mkdir"); err != nil {
+		t.Fatalf("mkdir through bastion: %s", err)
+	}
+	path := "/vmfs/volumes/ds1/web01/web01.vmx"
+	if err := c.executor.writeFile(ctx, path, "memSize = \"1024\"\n", false); err != nil {
+		t.Fatalf("write file through bastion: %s", err)
+	}
+	if content, _ := host.file(path); content != "memSize = \"1024\"\n" {
+		t.Errorf("file written through bastion: %q", content)
+	}
+
+	// One tunnel carries every command, and nothing runs on the bastion itself
+	if tunnels := bastion.tunneled(); len(tunnels) != 1 || tunnels[0] != server.listener.Addr().String() {
+		t.Errorf("tunnels: %v", tunnels)
+	}
+	if ran := bastion.ran(); len(ran) != 0 {
+		t.Errorf("commands ran on the bastion: %v", ran)
+	}
+}
+
+func TestBastionConnectFailures(t *testing.T) {
+	_, server, _ := testFakeHost(t)
+	bastion := startFakeSSHServer(t, newFakeESXiHost())
+	bastionAddress := bastion.listener.Addr().String()
+	connect := func(c *Config) error {
+		_, err := c.executor.runReadOnly(context.Background(), "vmware --version", "version")
+		return err
+	}
+
+	// A bastion that is down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := testBastionSettings(bastion, fakeSSHPassword)
+	down.host, down.port, _ = net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	err = connect(testBastionConfig(t, server, down))
+	if err == nil || !strings.Contains(err.Error(), "Failed to connect to bastion host "+listener.Addr().String()) || !isRemoteConnectFailure(err) {
+		t.Errorf("bastion down: got %v", err)
+	}
+
+	// A wrong bastion password is tried once
+	before := bastion.connections()
+	err = connect(testBastionConfig(t, server, testBastionSettings(bastion, "wrong")))
+	if remoteErrorKindOf(err) != remoteErrorAuthentication || !strings.Contains(err.Error(), "Failed to connect to bastion host "+bastionAddress) {
+		t.Errorf("wrong bastion password: got %v", err)
+	}
+	if n := bastion.connections() - before; n != 1 {
+		t.Errorf("wrong bastion password dialed %d times, want 1", n)
+	}
+
+	// A wrong bastion host key names the bastion option
+	wrongKey := testBastionSettings(bastion, fakeSSHPassword)
+	wrongKey.hostKeyFingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	before = bastion.connections()
+	err = connect(testBastionConfig(t, server, wrongKey))
+	if remoteErrorKindOf(err) != remoteErrorHostKey || !strings.Contains(err.Error(), "does not match bastion.host_key_fingerprint") {
+		t.Errorf("wrong bastion host key: got %v", err)
+	}
+	if n := bastion.connections() - before; n != 1 {
+		t.Errorf("wrong bastion host key dialed %d times, want 1", n)
+	}
+
+	if n := len(bastion.tunneled()); n != 0 {
+		t.Errorf("%d tunnels opened to the host", n)
+	}
+}
@@ -0,0 +1,257 @@
+package esxi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// remoteErrorKind classifies why a command on the ESXi host failed
+type remoteErrorKind int
+
+const (
+	remoteErrorUnknown remoteErrorKind = iota
+	remoteErrorNotFound
+	remoteErrorPermissionDenied
+	remoteErrorHostBusy
+	remoteErrorTransport
+	remoteErrorTimeout
+	remoteErrorHostKey
+	remoteErrorAuthentication
+)
+
+func (k remoteErrorKind) String() string {
+	switch k {
+	case remoteErrorNotFound:
+		return "not found"
+	case remoteErrorPermissionDenied:
+		return "permission denied"
+	case remoteErrorHostBusy:
+		return "host busy"
+	case remoteErrorTransport:
+		return "transport failure"
+	case remoteErrorTimeout:
+		return "timed out"
+	case remoteErrorHostKey:
+		return "host key rejected"
+	case remoteErrorAuthentication:
+		return "authentication failed"
+	default:
+		return "command failed"
+	}
+}
+
+// remoteErrorPatterns maps host output to error kinds, first match wins
+var remoteErrorPatterns = []struct {
+	kind    remoteErrorKind
+	pattern string
+}{
+	{remoteErrorPermissionDenied, "permission denied"},
+	{remoteErrorPermissionDenied, "nopermission"},
+	{remoteErrorPermissionDenied, "access denied"},
+	{remoteErrorPermissionDenied, "read-only file system"},
+	{remoteErrorNotFound, "unable to find a vm corresponding"},
+	{remoteErrorNotFound, "no such file or directory"},
+	{remoteErrorNotFound, "cannot find the file specified"},
+	{remoteErrorNotFound, "managedobjectnotfound"},
+	{remoteErrorNotFound, "vim.fault.notfound"},
+	{remoteErrorNotFound, "has already been deleted"},
+	{remoteErrorHostBusy, "taskinprogress"},
+	{remoteErrorHostBusy, "resource busy"},
+	{remoteErrorHostBusy, "device or resource busy"},
+	{remoteErrorHostBusy, "failed to connect to hostd"},
+	{remoteErrorHostBusy, "connection failed"},
+	{remoteErrorHostBusy, "failed to login"},
+}
+
+// remoteCmdError is returned when a command on the ESXi host could not be run
+// or exited non-zero.  connect is set when no connection to the host could be
+// made, which the connection pool has already retried.
+type remoteCmdError struct {
+	kind     remoteErrorKind
+	desc     string
+	exitCode int
+	stderr   string
+	err      error
+	connect  bool
+}
+
+func (e *remoteCmdError) Error() string {
+	if e.exitCode < 0 {
+		return fmt.Sprintf("%s: %s: %s", e.desc, e.kind, e.err)
+	}
+
+	msg := fmt.Sprintf("%s: %s (exit status %d)", e.desc, e.kind, e.exitCode)
+	if e.stderr != "" {
+		msg = msg + ": " + e.stderr
+	}
+	return msg
+}
+
+// newRemoteCmdError builds the error for a command that exited non-zero,
+// classifying it from what the host printed
+func newRemoteCmdError(desc string, result remoteCmdResult, err error) *remoteCmdError {
+	return &remoteCmdError{
+		kind:     classifyRemoteOutput(result.stderr + "\n" + result.stdout),
+		desc:     desc,
+		exitCode: result.exitCode,
+		stderr:   result.stderr,
+		err:      err,
+	}
+}
+
+// newTransportError builds the error for a command that never got a result
+func newTransportError(desc string, err error) *remoteCmdError {
+	return &remoteCmdError{
+		kind:     remoteErrorTransport,
+		desc:     desc,
+		exitCode: -1,
+		err:      err,
+	}
+}
+
+// newConnectError builds the error for a command that could not be run
+// because connecting to the host failed.  Host key and authentication
+// failures get their own kinds, since trying again cannot fix them.
+func newConnectError(desc string, err error) *remoteCmdError {
+	kind := remoteErrorTransport
+	var hostKeyErr *sshHostKeyError
+	if errors.As(err, &hostKeyErr) {
+		kind = remoteErrorHostKey
+	} else if isSSHAuthFailure(err) {
+		kind = remoteErrorAuthentication
+	}
+
+	return &remoteCmdError{
+		kind:     kind,
+		desc:     desc,
+		exitCode: -1,
+		err:      err,
+		connect:  true,
+	}
+}
+
+// newTimeoutError builds the error for a command abandoned because its
+// operation timeout expired
+func newTimeoutError(desc string, err error) *remoteCmdError {
+	return &remoteCmdError{
+		kind:     remoteErrorTimeout,
+		desc:     desc,
+		exitCode: -1,
+		err:      err,
+	}
+}
+
+// newNotFoundError builds the error for an object the host inventory does
+// not list
+func newNotFoundError(desc string, err error) *remoteCmdError {
+	return &remoteCmdError{
+		kind:     remoteErrorNotFound,
+		desc:     desc,
+		exitCode: -1,
+		err:      err,
+	}
+}
+
+// sftpStatusPermissionDenied is SSH_FX_PERMISSION_DENIED, which pkg/sftp
+// does not export
+const sftpStatusPermissionDenied = 3
+
+// newFileTransferError builds the error for a file copy to the host that
+// failed.  Status replies from sftp-server are classified like command
+// output, anything else means the session broke.
+func newFileTransferError(desc string, err error) *remoteCmdError {
+	kind := remoteErrorTransport
+	var status *sftp.StatusError
+	if os.IsNotExist(err) {
+		kind = remoteErrorNotFound
+	} else if errors.As(err, &status) {
+		kind = classifyRemoteOutput(status.Error())
+		if status.Code == sftpStatusPermissionDenied {
+			kind = remoteErrorPermissionDenied
+		}
+	}
+
+	return &remoteCmdError{
+		kind:     kind,
+		desc:     desc,
+		exitCode: -1,
+		err:      err,
+	}
+}
+
+// classifyRemoteOutput picks the error kind matching the host's output
+func classifyRemoteOutput(output string) remoteErrorKind {
+	output = strings.ToLower(output)
+	for _, p := range remoteErrorPatterns {
+		if strings.Contains(output, p.pattern) {
+			return p.kind
+		}
+	}
+	return remoteErrorUnknown
+}
+
+// remoteErrorKindOf returns the kind of err, or remoteErrorUnknown if it does
+// not wrap a remote command error
+func remoteErrorKindOf(err error) remoteErrorKind {
+	var e *remoteCmdError
+	if errors.As(err, &e) {
+		return e.kind
+	}
+	return remoteErrorUnknown
+}
+
+// isRemoteNotFound reports whether err says the object does not exist on the host
+func isRemoteNotFound(err error) bool {
+	return remoteErrorKindOf(err) == remoteErrorNotFound
+}
+
+// isRemotePermissionDenied reports whether err was a permission failure on the host
+func isRemotePermissionDenied(err error) bool {
+	return remoteErrorKindOf(err) == remoteErrorPermissionDenied
+}
+
+// isRemoteHostBusy reports whether err says hostd was busy or restarting
+func isRemoteHostBusy(err error) bool {
+	return remoteErrorKindOf(err) == remoteErrorHostBusy
+}
+
+// isRemoteTimeout reports whether err was caused by the operation timeout expiring
+func isRemoteTimeout(err error) bool {
+	return remoteErrorKindOf(err) == remoteErrorTimeout
+}
+
+// isRemoteTransient reports whether err may clear up on its own, so the object
+// should not be assumed gone
+func isRemoteTransient(err error) bool {
+	switch remoteErrorKindOf(err) {
+	case remoteErrorTransport, remoteErrorHostBusy, remoteErrorTimeout:
+		return true
+	}
+	return false
+}
+
+// isRemoteTransport reports whether err was an SSH failure rather than a command failure
+func isRemoteTransport(err error) bool {
+	return remoteErrorKindOf(err) == remoteErrorTransport
+}
+
+// isRemoteConnectFailure reports whether err came from connecting to the
+// host rather than from running the command
+func isRemoteConnectFailure(err error) bool {
+	e, ok := err.(*remoteCmdError)
+	return ok && e.connect
+}
+
+// permissionDeniedError explains a permission failure on the host, which
+// otherwise reads like a problem with the object itself.  Other errors are
+// returned unchanged.
+func permissionDeniedError(c *Config, action string, err error) error {
+	if !isRemotePermissionDenied(err) {
+		return err
+	}
+	return fmt.Errorf("Permission denied to %s as ESXi user %s.  Check the role of the user on the host and that the datastore is writable: %s", action, c.esxiUserName, err)
+}
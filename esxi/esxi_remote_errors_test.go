@@ -0,0 +1,99 @@
+package esxi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestClassifyRemoteOutput(t *testing.T) {
+	cases := []struct {
+		output string
+		kind   remoteErrorKind
+	}{
+		{`Unable to find a VM corresponding to "42"`, remoteErrorNotFound},
+		{"ls: /vmfs/volumes/ds1/vm: No such file or directory", remoteErrorNotFound},
+		{"(vim.fault.NotFound) {\n   msg = \"The object has already been deleted\"", remoteErrorNotFound},
+		{"mkdir: can't create directory 'x': Permission denied", remoteErrorPermissionDenied},
+		{"(vim.fault.NoPermission) {", remoteErrorPermissionDenied},
+		{"(vim.fault.TaskInProgress) {", remoteErrorHostBusy},
+		{"Failed to login: Connection failed", remoteErrorHostBusy},
+		{"something else entirely", remoteErrorUnknown},
+	}
+
+	for _, c := range cases {
+		if kind := classifyRemoteOutput(c.output); kind != c.kind {
+			t.Errorf("%q: got %s, want %s", c.output, kind, c.kind)
+		}
+	}
+}
+
+func TestRemoteCmdError(t *testing.T) {
+	result := remoteCmdResult{stderr: "rmdir: '/vmfs/volumes/ds1/x': No such file or directory", exitCode: 1}
+	err := error(newRemoteCmdError("rmdir", result, errors.New("Process exited with status 1")))
+
+	if !isRemoteNotFound(err) {
+		t.Errorf("expected not found: %s", err)
+	}
+	if isRemoteTransport(err) || isRemoteHostBusy(err) || isRemotePermissionDenied(err) {
+		t.Errorf("misclassified: %s", err)
+	}
+
+	err = newTransportError("get vmid", errors.New("Client Connection Error"))
+	if !isRemoteTransport(err) {
+		t.Errorf("expected transport failure: %s", err)
+	}
+
+	err = newTimeoutError("vmkfstools", context.DeadlineExceeded)
+	if !isRemoteTimeout(err) || isRemoteTransport(err) {
+		t.Errorf("expected timeout: %s", err)
+	}
+
+	if isRemoteNotFound(errors.New("plain error")) {
+		t.Errorf("plain errors have no kind")
+	}
+}
+
+func TestFileTransferError(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind remoteErrorKind
+	}{
+		{os.ErrNotExist, remoteErrorNotFound},
+		{&sftp.StatusError{Code: sftpStatusPermissionDenied}, remoteErrorPermissionDenied},
+		{&sftp.StatusError{Code: 4}, remoteErrorUnknown},
+		{io.EOF, remoteErrorTransport},
+	}
+
+	for _, c := range cases {
+		err := newFileTransferError("write /vmfs/volumes/ds1/x.vmx", c.err)
+		if kind := remoteErrorKindOf(err); kind != c.kind {
+			t.Errorf("%v: got %s, want %s", c.err, kind, c.kind)
+		}
+	}
+}
+
+func TestPermissionDeniedError(t *testing.T) {
+	c := testConfig(nil)
+	result := remoteCmdResult{stderr: "mkdir: can't create directory 'web01': Permission denied", exitCode: 1}
+	err := fmt.Errorf("Failed to create guest path: %w", newRemoteCmdError("mkdir", result, errors.New("Process exited with status 1")))
+
+	if !isRemotePermissionDenied(err) {
+		t.Fatalf("wrapped error lost its kind: %s", err)
+	}
+	msg := permissionDeniedError(c, "create guest web01", err).Error()
+	if !strings.Contains(msg, "Permission denied to create guest web01 as ESXi user root") || !strings.Contains(msg, "Failed to create guest path") {
+		t.Errorf("got %q", msg)
+	}
+
+	other := newTransportError("mkdir", errors.New("EOF"))
+	if got := permissionDeniedError(c, "create guest web01", other); got != error(other) {
+		t.Errorf("other errors must be returned unchanged, got %v", got)
+	}
+}
@@ -0,0 +1,129 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// retryErrorKinds maps the esxi_retry_on names to error kinds
+var retryErrorKinds = map[string]remoteErrorKind{
+	"transport":         remoteErrorTransport,
+	"host_busy":         remoteErrorHostBusy,
+	"not_found":         remoteErrorNotFound,
+	"permission_denied": remoteErrorPermissionDenied,
+}
+
+// defaultRetryOn are the error classes retried when esxi_retry_on is not set
+var defaultRetryOn = []string{"transport", "host_busy"}
+
+// retryPolicy controls how often and how fast failed connections and
+// read-only commands are retried
+type retryPolicy struct {
+	maxAttempts     int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	retryOn         map[remoteErrorKind]bool
+}
+
+// defaultRetryPolicy matches the provider schema defaults
+func defaultRetryPolicy() retryPolicy {
+	policy, _ := newRetryPolicy(10, "1s", "30s", nil)
+	return policy
+}
+
+// newRetryPolicy builds a retry policy from provider arguments
+func newRetryPolicy(maxAttempts int, initialInterval string, maxInterval string, retryOn []string) (retryPolicy, error) {
+	var err error
+	policy := retryPolicy{
+		maxAttempts: maxAttempts,
+		retryOn:     make(map[remoteErrorKind]bool),
+	}
+
+	if policy.maxAttempts < 1 {
+		policy.maxAttempts = 1
+	}
+
+	policy.initialInterval, err = time.ParseDuration(initialInterval)
+	if err != nil {
+		return policy, fmt.Errorf("Invalid esxi_retry_initial_interval %q: %s", initialInterval, err)
+	}
+
+	policy.maxInterval, err = time.ParseDuration(maxInterval)
+	if err != nil {
+		return policy, fmt.Errorf("Invalid esxi_retry_max_interval %q: %s", maxInterval, err)
+	}
+	if policy.maxInterval < policy.initialInterval {
+		policy.maxInterval = policy.initialInterval
+	}
+
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, name := range retryOn {
+		kind, ok := retryErrorKinds[name]
+		if !ok {
+			return policy, fmt.Errorf("Invalid esxi_retry_on value %q", name)
+		}
+		policy.retryOn[kind] = true
+	}
+
+	return policy, nil
+}
+
+// retryable reports whether err belongs to a class the policy retries
+func (r retryPolicy) retryable(err error) bool {
+	return err != nil && r.retryOn[remoteErrorKindOf(err)]
+}
+
+// backoff returns the delay before the given retry (starting at 1):
+// exponential growth capped at maxInterval, jittered over its upper half
+func (r retryPolicy) backoff(retry int) time.Duration {
+	interval := r.initialInterval
+	for i := 1; i < retry && interval < r.maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > r.maxInterval {
+		interval = r.maxInterval
+	}
+	if interval <= 0 {
+		return 0
+	}
+
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// wait sleeps before the given retry, returning early if ctx expires
+func (r retryPolicy) wait(ctx context.Context, retry int) error {
+	delay := r.backoff(retry)
+	log.Printf("[retryPolicy] Retry %d/%d in %s\n", retry, r.maxAttempts-1, delay)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// runRetryingHostBusy runs a command that changes the host, trying it again
+// while hostd is busy.  A busy host turns the command away before doing
+// anything, so it cannot be applied twice.  Other failures are returned at
+// once, since the command may have partly run.
+func (c *Config) runRetryingHostBusy(ctx context.Context, remoteCmd string, shortCmdDesc string) (remoteCmdResult, error) {
+	policy := c.retryPolicy
+
+	for attempt := 1; ; attempt++ {
+		result, err := c.executor.run(ctx, remoteCmd, shortCmdDesc)
+		if !isRemoteHostBusy(err) || !policy.retryable(err) || attempt >= policy.maxAttempts {
+			return result, err
+		}
+
+		log.Printf("[runRetryingHostBusy] %s: %s\n", shortCmdDesc, err)
+		if policy.wait(ctx, attempt) != nil {
+			return result, err
+		}
+	}
+}
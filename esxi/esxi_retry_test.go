@@ -0,0 +1,59 @@
+package esxi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	policy, err := newRetryPolicy(5, "2s", "10s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.retryable(newTransportError("get vmid", errors.New("EOF"))) {
+		t.Errorf("transport errors should be retried by default")
+	}
+	if !policy.retryable(newRemoteCmdError("get vmid", remoteCmdResult{stderr: "(vim.fault.TaskInProgress) {"}, nil)) {
+		t.Errorf("host busy errors should be retried by default")
+	}
+	if policy.retryable(newRemoteCmdError("get vmid", remoteCmdResult{stderr: "No such file or directory"}, nil)) {
+		t.Errorf("not found errors should not be retried by default")
+	}
+	if policy.retryable(newTimeoutError("get vmid", context.DeadlineExceeded)) {
+		t.Errorf("timeouts must never be retried")
+	}
+
+	if _, err := newRetryPolicy(5, "soon", "10s", nil); err == nil {
+		t.Errorf("expected invalid interval error")
+	}
+	if _, err := newRetryPolicy(5, "1s", "10s", []string{"everything"}); err == nil {
+		t.Errorf("expected invalid retry_on error")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy, err := newRetryPolicy(10, "1s", "8s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 1 * time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{9, 8 * time.Second},
+	}
+
+	for _, c := range cases {
+		delay := policy.backoff(c.retry)
+		if delay < c.max/2 || delay > c.max {
+			t.Errorf("retry %d: delay %s outside [%s, %s]", c.retry, delay, c.max/2, c.max)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package esxi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// buildSSHAuthMethods returns the SSH auth methods for the ESXi host.
+// They are offered in this order: private key, ssh-agent, password,
+// then keyboard-interactive answering every prompt with the password.
+func buildSSHAuthMethods(esxiSSHinfo SSHConnectionSettings) ([]ssh.AuthMethod, error) {
+	var authMethods []ssh.AuthMethod
+
+	if esxiSSHinfo.privateKey != "" {
+		signer, err := parseSSHPrivateKey(esxiSSHinfo.privateKey, esxiSSHinfo.privateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+
+	if esxiSSHinfo.useAgent {
+		signers, err := sshAgentSigners(esxiSSHinfo)
+		if err != nil {
+			return nil, err
+		}
+		authMethods = append(authMethods, ssh.PublicKeysCallback(signers))
+	}
+
+	if esxiSSHinfo.pass != "" {
+		authMethods = append(authMethods,
+			ssh.Password(esxiSSHinfo.pass),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				// Reply password to all questions
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = esxiSSHinfo.pass
+				}
+
+				return answers, nil
+			}))
+	}
+
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("No SSH authentication configured.  Set %s, %s or %s",
+			esxiSSHinfo.optionName("password"), esxiSSHinfo.optionName("private_key"), esxiSSHinfo.optionName("use_agent"))
+	}
+
+	return authMethods, nil
+}
+
+// parseSSHPrivateKey parses a PEM private key given inline or as a path to a key file
+func parseSSHPrivateKey(privateKey string, passphrase string) (ssh.Signer, error) {
+	keyBytes := []byte(privateKey)
+
+	if !strings.Contains(privateKey, "PRIVATE KEY") {
+		keyPath, err := homedir.Expand(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to expand private key path %s: %s", privateKey, err)
+		}
+
+		keyBytes, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read private key %s: %s", keyPath, err)
+		}
+	}
+
+	var signer ssh.Signer
+	var err error
+
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(keyBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key: %s", err)
+	}
+
+	return signer, nil
+}
+
+// sshAgentSigners connects to the ssh-agent listening on SSH_AUTH_SOCK
+func sshAgentSigners(esxiSSHinfo SSHConnectionSettings) (func() ([]ssh.Signer, error), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("%s is set, but SSH_AUTH_SOCK is empty", esxiSSHinfo.optionName("use_agent"))
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to ssh-agent at %s: %s", socket, err)
+	}
+	log.Printf("[sshAgentSigners] Using ssh-agent at %s\n", socket)
+
+	return agent.NewClient(conn).Signers, nil
+}
@@ -0,0 +1,78 @@
+package esxi
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPrivateKeyPEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+}
+
+func TestParseSSHPrivateKey(t *testing.T) {
+	keyPEM := testPrivateKeyPEM(t)
+
+	if _, err := parseSSHPrivateKey(keyPEM, ""); err != nil {
+		t.Errorf("inline key: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "esxi-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(keyPath, []byte(keyPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseSSHPrivateKey(keyPath, ""); err != nil {
+		t.Errorf("key path: %s", err)
+	}
+
+	if _, err := parseSSHPrivateKey(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Errorf("expected error for missing key file")
+	}
+}
+
+func TestBuildSSHAuthMethods(t *testing.T) {
+	if _, err := buildSSHAuthMethods(SSHConnectionSettings{}); err == nil {
+		t.Errorf("expected error when no authentication is configured")
+	}
+
+	methods, err := buildSSHAuthMethods(SSHConnectionSettings{pass: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 2 {
+		t.Errorf("password should offer password and keyboard-interactive, got %d methods", len(methods))
+	}
+
+	methods, err = buildSSHAuthMethods(SSHConnectionSettings{pass: "secret", privateKey: testPrivateKeyPEM(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 3 {
+		t.Errorf("expected key, password and keyboard-interactive, got %d methods", len(methods))
+	}
+
+	os.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := buildSSHAuthMethods(SSHConnectionSettings{useAgent: true}); err == nil {
+		t.Errorf("expected error when SSH_AUTH_SOCK is unset")
+	}
+}
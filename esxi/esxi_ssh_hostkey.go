@@ -0,0 +1,135 @@
+package esxi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHostsFile is used when no other host key option is configured
+const defaultKnownHostsFile = "~/.ssh/known_hosts"
+
+// sshHostKeyError is returned when the ESXi host presents an unexpected host key
+type sshHostKeyError struct {
+	host        string
+	fingerprint string
+	reason      string
+}
+
+func (e *sshHostKeyError) Error() string {
+	return fmt.Sprintf("Host key verification failed for %s: %s.  The host presented %s",
+		e.host, e.reason, e.fingerprint)
+}
+
+// buildHostKeyCallback returns the host key check for the ESXi host.
+// A pinned fingerprint and a known_hosts file may both be given, in which case
+// both must match.  With neither, the user's ~/.ssh/known_hosts is used.
+func buildHostKeyCallback(esxiSSHinfo SSHConnectionSettings) (ssh.HostKeyCallback, error) {
+	fingerprint := esxiSSHinfo.hostKeyFingerprint
+	knownHostsFile := esxiSSHinfo.knownHostsFile
+
+	if esxiSSHinfo.insecureIgnoreHostKey {
+		if fingerprint != "" || knownHostsFile != "" {
+			return nil, fmt.Errorf("%s cannot be combined with %s or %s", esxiSSHinfo.optionName("insecure_ignore_host_key"),
+				esxiSSHinfo.optionName("host_key_fingerprint"), esxiSSHinfo.optionName("known_hosts_file"))
+		}
+		log.Printf("[buildHostKeyCallback] WARNING: host key verification is disabled\n")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	var callbacks []ssh.HostKeyCallback
+
+	if fingerprint != "" {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			fingerprint = "SHA256:" + fingerprint
+		}
+		callbacks = append(callbacks, fingerprintHostKeyCallback(fingerprint, esxiSSHinfo.optionName("host_key_fingerprint")))
+	}
+
+	if knownHostsFile != "" || fingerprint == "" {
+		if knownHostsFile == "" {
+			knownHostsFile = defaultKnownHostsFile
+		}
+		callback, err := knownHostsHostKeyCallback(esxiSSHinfo, knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, callback)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, callback := range callbacks {
+			if err := callback(hostname, remote, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// fingerprintHostKeyCallback accepts only a host key with the given SHA256
+// fingerprint, which was set by the provider argument option
+func fingerprintHostKeyCallback(fingerprint string, option string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := ssh.FingerprintSHA256(key)
+		if presented != fingerprint {
+			return &sshHostKeyError{
+				host:        hostname,
+				fingerprint: presented,
+				reason:      fmt.Sprintf("host key does not match %s %s", option, fingerprint),
+			}
+		}
+		return nil
+	}
+}
+
+// knownHostsHostKeyCallback verifies host keys against a known_hosts file
+func knownHostsHostKeyCallback(esxiSSHinfo SSHConnectionSettings, knownHostsFile string) (ssh.HostKeyCallback, error) {
+	path, err := homedir.Expand(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to expand known_hosts path %s: %s", knownHostsFile, err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("Unable to read known_hosts file %s: %s.  Set %s, %s or %s", path, err,
+			esxiSSHinfo.optionName("known_hosts_file"), esxiSSHinfo.optionName("host_key_fingerprint"),
+			esxiSSHinfo.optionName("insecure_ignore_host_key"))
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse known_hosts file %s: %s", path, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		hostKeyErr := &sshHostKeyError{
+			host:        hostname,
+			fingerprint: ssh.FingerprintSHA256(key),
+			reason:      err.Error(),
+		}
+
+		switch e := err.(type) {
+		case *knownhosts.KeyError:
+			if len(e.Want) == 0 {
+				hostKeyErr.reason = fmt.Sprintf("host is not listed in %s", path)
+			} else {
+				hostKeyErr.reason = fmt.Sprintf("host key does not match %s line %d", e.Want[0].Filename, e.Want[0].Line)
+			}
+		case *knownhosts.RevokedError:
+			hostKeyErr.reason = fmt.Sprintf("host key is revoked in %s", path)
+		}
+
+		return hostKeyErr
+	}, nil
+}
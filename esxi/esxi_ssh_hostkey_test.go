@@ -0,0 +1,105 @@
+package esxi
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostPublicKey(t *testing.T) ssh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer.PublicKey()
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	hostKey := testHostPublicKey(t)
+	otherKey := testHostPublicKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+
+	callback, err := buildHostKeyCallback(SSHConnectionSettings{hostKeyFingerprint: ssh.FingerprintSHA256(hostKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := callback("esxi:22", remote, hostKey); err != nil {
+		t.Errorf("pinned key rejected: %s", err)
+	}
+
+	err = callback("esxi:22", remote, otherKey)
+	if _, ok := err.(*sshHostKeyError); !ok {
+		t.Fatalf("expected sshHostKeyError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), ssh.FingerprintSHA256(otherKey)) {
+		t.Errorf("error does not show presented fingerprint: %s", err)
+	}
+}
+
+func TestHostKeyKnownHosts(t *testing.T) {
+	hostKey := testHostPublicKey(t)
+	otherKey := testHostPublicKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+
+	dir, err := ioutil.TempDir("", "esxi-known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"esxi"}, hostKey) + "\n"
+	if err := ioutil.WriteFile(knownHostsFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := buildHostKeyCallback(SSHConnectionSettings{knownHostsFile: knownHostsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := callback("esxi:22", remote, hostKey); err != nil {
+		t.Errorf("known key rejected: %s", err)
+	}
+
+	if err := callback("esxi:22", remote, otherKey); err == nil {
+		t.Errorf("mismatched key accepted")
+	}
+
+	err = callback("other:22", remote, hostKey)
+	if err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("expected unknown host error, got %v", err)
+	}
+}
+
+func TestHostKeyInsecureConflicts(t *testing.T) {
+	_, err := buildHostKeyCallback(SSHConnectionSettings{insecureIgnoreHostKey: true, hostKeyFingerprint: "SHA256:abc"})
+	if err == nil || !strings.Contains(err.Error(), "esxi_insecure_ignore_host_key cannot be combined") {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+
+	// The same conflict in the bastion block names the bastion options
+	_, err = buildHostKeyCallback(SSHConnectionSettings{insecureIgnoreHostKey: true, hostKeyFingerprint: "SHA256:abc", isBastion: true})
+	if err == nil || !strings.Contains(err.Error(), "bastion.insecure_ignore_host_key cannot be combined with bastion.host_key_fingerprint") {
+		t.Errorf("expected bastion conflict error, got %v", err)
+	}
+
+	if _, err := buildHostKeyCallback(SSHConnectionSettings{insecureIgnoreHostKey: true}); err != nil {
+		t.Errorf("insecure: %s", err)
+	}
+}
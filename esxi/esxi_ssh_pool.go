@@ -0,0 +1,263 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeepAliveInterval is how often an idle pooled connection is probed
+const sshKeepAliveInterval = 30 * time.Second
+
+// sshClientPool owns the long-lived SSH connection to the ESXi host.
+// Remote commands open sessions on it instead of dialing per command,
+// and the connection is re-established when the host drops it.
+// When bastion is set, the connection is tunneled through that host.
+// sessions caps the sessions open at once, it is nil when there is no cap.
+type sshClientPool struct {
+	mu       sync.Mutex
+	address  string
+	config   *ssh.ClientConfig
+	client   *ssh.Client
+	retry    retryPolicy
+	bastion  *sshClientPool
+	sessions chan struct{}
+}
+
+// newSSHClientPool creates a pool for the host described in esxiSSHinfo.
+// No connection is made until the first session is requested.
+func newSSHClientPool(esxiSSHinfo SSHConnectionSettings) (*sshClientPool, error) {
+	authMethods, err := buildSSHAuthMethods(esxiSSHinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := buildHostKeyCallback(esxiSSHinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            esxiSSHinfo.user,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	pool := &sshClientPool{
+		address: fmt.Sprintf("%s:%s", esxiSSHinfo.host, esxiSSHinfo.port),
+		config:  sshConfig,
+		retry:   esxiSSHinfo.retry,
+	}
+	if esxiSSHinfo.maxSessions > 0 {
+		pool.sessions = make(chan struct{}, esxiSSHinfo.maxSessions)
+	}
+
+	if esxiSSHinfo.bastion != nil {
+		pool.bastion, err = newSSHClientPool(*esxiSSHinfo.bastion)
+		if err != nil {
+			return nil, fmt.Errorf("bastion: %s", err)
+		}
+	}
+
+	return pool, nil
+}
+
+// getClient returns the pooled client, dialing the host if there is none
+func (p *sshClientPool) getClient(ctx context.Context) (*ssh.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	// The ssh package flattens callback errors into strings, so keep
+	// the host key error to fail fast instead of retrying.
+	var hostKeyErr error
+	sshConfig := *p.config
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = p.config.HostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+
+	for attempt := 1; ; attempt++ {
+		client, retryable, err := p.dial(ctx, &sshConfig)
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		if err == nil {
+			p.client = client
+			go p.watch(client)
+			return client, nil
+		}
+		if !retryable {
+			return nil, err
+		}
+		if isSSHAuthFailure(err) {
+			//  Repeating a bad login only risks locking the account
+			return nil, fmt.Errorf("Client Connection Error: %s", err)
+		}
+
+		if attempt >= p.retry.maxAttempts || !p.retry.retryOn[remoteErrorTransport] {
+			return nil, fmt.Errorf("Client Connection Error: %s", err)
+		}
+		log.Printf("[sshClientPool] Connection to %s failed: %s\n", p.address, err)
+		if err := p.retry.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isSSHAuthFailure reports whether err says the host refused every
+// authentication method.  The ssh package only reports this as text.
+func isSSHAuthFailure(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// dial connects to the host, tunneling through the bastion host if there is one.
+// Bastion failures are not worth retrying here, the bastion pool already did.
+func (p *sshClientPool) dial(ctx context.Context, sshConfig *ssh.ClientConfig) (*ssh.Client, bool, error) {
+	if p.bastion == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", p.address)
+		if err != nil {
+			return nil, true, err
+		}
+		client, err := p.handshake(ctx, conn, sshConfig)
+		return client, true, err
+	}
+
+	bastionClient, err := p.bastion.getClient(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to connect to bastion host %s: %w", p.bastion.address, err)
+	}
+
+	conn, err := bastionClient.Dial("tcp", p.address)
+	if err != nil {
+		log.Printf("[sshClientPool] Tunnel via %s failed: %s\n", p.bastion.address, err)
+		p.bastion.discard(bastionClient)
+		return nil, true, err
+	}
+
+	client, err := p.handshake(ctx, conn, sshConfig)
+	return client, true, err
+}
+
+// handshake sets up the SSH connection on conn, giving up when ctx expires
+func (p *sshClientPool) handshake(ctx context.Context, conn net.Conn, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, p.address, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// newSession opens a session on the pooled client.  If the connection
+// turns out to be dead, it is dropped and redialed once.
+func (p *sshClientPool) newSession(ctx context.Context) (*ssh.Client, *ssh.Session, error) {
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := client.NewSession()
+	if err == nil {
+		return client, session, nil
+	}
+
+	log.Printf("[sshClientPool] Session failed, reconnecting: %s\n", err)
+	p.discard(client)
+
+	client, err = p.getClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err = client.NewSession()
+	if err != nil {
+		p.discard(client)
+		return nil, nil, fmt.Errorf("Session Connection Error")
+	}
+
+	return client, session, nil
+}
+
+// acquireSession waits for a free session slot.  Every successful call
+// must be paired with releaseSession.
+func (p *sshClientPool) acquireSession(ctx context.Context) error {
+	if p.sessions == nil {
+		return nil
+	}
+
+	select {
+	case p.sessions <- struct{}{}:
+		return nil
+	default:
+	}
+
+	log.Printf("[sshClientPool] Waiting for one of %d sessions to %s\n", cap(p.sessions), p.address)
+	select {
+	case p.sessions <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseSession frees the slot taken by acquireSession
+func (p *sshClientPool) releaseSession() {
+	if p.sessions != nil {
+		<-p.sessions
+	}
+}
+
+// discard closes client and forgets it if it is still the pooled one
+func (p *sshClientPool) discard(client *ssh.Client) {
+	p.mu.Lock()
+	if p.client == client {
+		p.client = nil
+	}
+	p.mu.Unlock()
+
+	client.Close()
+}
+
+// watch sends keepalives on client and discards it once the host stops answering
+func (p *sshClientPool) watch(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			log.Printf("[sshClientPool] Connection to %s closed\n", p.address)
+			p.discard(client)
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				log.Printf("[sshClientPool] Keepalive to %s failed: %s\n", p.address, err)
+				p.discard(client)
+				return
+			}
+		}
+	}
+}
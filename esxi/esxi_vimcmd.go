@@ -0,0 +1,299 @@
+package esxi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// vimKind is the kind of a value printed by vim-cmd
+type vimKind int
+
+const (
+	vimNull vimKind = iota
+	vimScalar
+	vimObject
+	vimArray
+)
+
+// vimValue is a value in the nested dump vim-cmd prints, such as
+//
+//	(vim.vm.Summary) {
+//	   runtime = (vim.vm.RuntimeInfo) {
+//	      powerState = "poweredOn",
+//	   },
+//	   net = (vim.vm.GuestInfo.NicInfo) [ ... ],
+//	   changeVersion = <unset>,
+//	}
+//
+// Data objects keep their fields in order, arrays their items.  Strings,
+// numbers, booleans and managed object references are scalars, kept as
+// text without quotes.  null and <unset> are vimNull.  The methods are
+// safe to call on a nil value, so a missing field reads as empty.
+type vimValue struct {
+	kind     vimKind
+	typeName string
+	scalar   string
+	fields   []vimField
+	items    []*vimValue
+}
+
+// vimField is a named field of a data object
+type vimField struct {
+	name  string
+	value *vimValue
+}
+
+// parseVimDump parses the output of a vim-cmd command.  Lines before the
+// dump, such as "Listsummary:", are skipped.
+func parseVimDump(output string) (*vimValue, error) {
+	start, offset := -1, 0
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "(") {
+			start = offset
+			break
+		}
+		offset += len(line)
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("Failed to parse vim-cmd output: no data object in %q", output)
+	}
+
+	p := &vimParser{input: output, pos: start}
+	value, err := p.value()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse vim-cmd output: %s", err)
+	}
+	return value, nil
+}
+
+// get returns the value at path, a list of field names, or nil
+func (v *vimValue) get(path ...string) *vimValue {
+	for _, name := range path {
+		if v == nil || v.kind != vimObject {
+			return nil
+		}
+		var next *vimValue
+		for _, field := range v.fields {
+			if field.name == name {
+				next = field.value
+				break
+			}
+		}
+		v = next
+	}
+	return v
+}
+
+// str returns a scalar as text, or "" for anything else
+func (v *vimValue) str() string {
+	if v == nil || v.kind != vimScalar {
+		return ""
+	}
+	return v.scalar
+}
+
+// int returns a numeric scalar, or 0
+func (v *vimValue) int() int64 {
+	n, _ := strconv.ParseInt(v.str(), 10, 64)
+	return n
+}
+
+// bool reports whether a scalar is true
+func (v *vimValue) bool() bool {
+	return v.str() == "true"
+}
+
+// list returns the items of an array
+func (v *vimValue) list() []*vimValue {
+	if v == nil || v.kind != vimArray {
+		return nil
+	}
+	return v.items
+}
+
+// vimParser is a recursive descent parser for vim-cmd dumps
+type vimParser struct {
+	input string
+	pos   int
+}
+
+func (p *vimParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.input[:p.pos], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *vimParser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *vimParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// value parses [ "(" type ")" ] followed by an object, an array or a scalar
+func (p *vimParser) value() (*vimValue, error) {
+	v := &vimValue{}
+	if p.peek() == '(' {
+		end := strings.IndexByte(p.input[p.pos:], ')')
+		if end < 0 {
+			return nil, p.errorf("unterminated type name")
+		}
+		v.typeName = p.input[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+	}
+
+	switch p.peek() {
+	case '{':
+		p.pos++
+		v.kind = vimObject
+		return v, p.fields(v)
+	case '[':
+		p.pos++
+		v.kind = vimArray
+		return v, p.items(v)
+	case 0:
+		return nil, p.errorf("unexpected end of output")
+	}
+
+	text, err := p.scalar()
+	if err != nil {
+		return nil, err
+	}
+	if text == "null" || text == "<unset>" {
+		v.kind = vimNull
+		return v, nil
+	}
+	v.kind = vimScalar
+	v.scalar = text
+	return v, nil
+}
+
+// fields parses name = value pairs up to the closing brace
+func (p *vimParser) fields(v *vimValue) error {
+	for {
+		switch p.peek() {
+		case '}':
+			p.pos++
+			return nil
+		case ',':
+			p.pos++
+			continue
+		case 0:
+			return p.errorf("unterminated data object %s", v.typeName)
+		}
+
+		name := p.word()
+		if name == "" {
+			return p.errorf("expected a field name, got %q", p.input[p.pos:p.pos+1])
+		}
+		if p.peek() != '=' {
+			return p.errorf("expected = after %s", name)
+		}
+		p.pos++
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+		v.fields = append(v.fields, vimField{name: name, value: value})
+	}
+}
+
+// items parses values up to the closing bracket
+func (p *vimParser) items(v *vimValue) error {
+	for {
+		switch p.peek() {
+		case ']':
+			p.pos++
+			return nil
+		case ',':
+			p.pos++
+			continue
+		case 0:
+			return p.errorf("unterminated array %s", v.typeName)
+		}
+
+		item, err := p.value()
+		if err != nil {
+			return err
+		}
+		v.items = append(v.items, item)
+	}
+}
+
+// scalar parses a quoted string, a 'managed object reference', <unset>
+// or a bare word such as a number
+func (p *vimParser) scalar() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.quoted()
+	case '\'':
+		end := strings.IndexByte(p.input[p.pos+1:], '\'')
+		if end < 0 {
+			return "", p.errorf("unterminated reference")
+		}
+		text := p.input[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return text, nil
+	case '<':
+		end := strings.IndexByte(p.input[p.pos:], '>')
+		if end < 0 {
+			return "", p.errorf("unterminated %q", "<")
+		}
+		text := p.input[p.pos : p.pos+end+1]
+		p.pos += end + 1
+		return text, nil
+	}
+
+	text := p.word()
+	if text == "" {
+		return "", p.errorf("unexpected %q", p.input[p.pos:p.pos+1])
+	}
+	return text, nil
+}
+
+// quoted parses a double quoted string with backslash escapes
+func (p *vimParser) quoted() (string, error) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.input); i++ {
+		switch c := p.input[i]; c {
+		case '"':
+			p.pos = i + 1
+			return b.String(), nil
+		case '\\':
+			i++
+			if i == len(p.input) {
+				break
+			}
+			switch e := p.input[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// word parses a run of characters up to a space or punctuation
+func (p *vimParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n,=(){}[]\"", p.input[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
@@ -0,0 +1,269 @@
+package esxi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// vimVersions are the ESXi releases with fixtures in testdata/vimcmd
+var vimVersions = []string{"esxi65", "esxi67", "esxi70", "esxi80"}
+
+func readVimFixture(t *testing.T, command string, version string) *vimValue {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "vimcmd", command, version+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := parseVimDump(string(data))
+	if err != nil {
+		t.Fatalf("%s %s: %s", command, version, err)
+	}
+	return value
+}
+
+func TestParseVimDump(t *testing.T) {
+	value, err := parseVimDump(`Guest information:
+
+(vim.vm.GuestInfo) {
+   toolsStatus = "toolsOk",
+   hostName = "say \"hi\"\n",
+   ipAddress = <unset>,
+   host = 'vim.HostSystem:ha-host',
+   dnsConfig = (vim.net.DnsConfigInfo) null,
+   empty = (string) [],
+   net = (vim.vm.GuestInfo.NicInfo) [
+      (vim.vm.GuestInfo.NicInfo) {
+         deviceConfigId = 4000,
+         connected = true
+      }
+   ]
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value.kind != vimObject || value.typeName != "vim.vm.GuestInfo" || len(value.fields) != 7 {
+		t.Fatalf("value: %+v", value)
+	}
+	if s := value.get("toolsStatus").str(); s != "toolsOk" {
+		t.Errorf("toolsStatus = %q", s)
+	}
+	if s := value.get("hostName").str(); s != "say \"hi\"\n" {
+		t.Errorf("hostName = %q", s)
+	}
+	if v := value.get("ipAddress"); v == nil || v.kind != vimNull || v.str() != "" {
+		t.Errorf("ipAddress: %+v", v)
+	}
+	if s := value.get("host").str(); s != "vim.HostSystem:ha-host" {
+		t.Errorf("host = %q", s)
+	}
+	if v := value.get("dnsConfig"); v.kind != vimNull || v.typeName != "vim.net.DnsConfigInfo" {
+		t.Errorf("dnsConfig: %+v", v)
+	}
+	if v := value.get("empty"); v.kind != vimArray || len(v.list()) != 0 {
+		t.Errorf("empty: %+v", v)
+	}
+	nics := value.get("net").list()
+	if len(nics) != 1 || nics[0].get("deviceConfigId").int() != 4000 || !nics[0].get("connected").bool() {
+		t.Errorf("net: %+v", nics)
+	}
+
+	// Missing fields and fields of scalars read as empty
+	if v := value.get("net", "deviceConfigId"); v != nil {
+		t.Errorf("field of an array: %+v", v)
+	}
+	if value.get("missing", "field").str() != "" || value.get("missing").int() != 0 ||
+		value.get("missing").bool() || value.get("toolsStatus").list() != nil {
+		t.Error("missing values are not empty")
+	}
+}
+
+func TestParseVimDumpErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"Unable to find a VM corresponding to \"42\"\n",
+		"(vim.vm.Summary) {\n   vm = 'vim.VirtualMachine:1',\n",
+		"(vim.vm.Summary) {\n   config = (vim.vm.Summary.ConfigSummary) {\n      name = \"web01\n   }\n}\n",
+		"(vim.vm.Summary) {\n   = 1\n}\n",
+		"(vim.vm.Summary) {\n   vm 'vim.VirtualMachine:1'\n}\n",
+		"(vim.vm.Summary {\n}\n",
+		"(string) [\n   \"a\",\n",
+		"(vim.vm.Summary) {\n   vm = 'vim.VirtualMachine:1\n}\n",
+		"(vim.vm.Summary) {\n   ipAddress = <unset\n}\n",
+	}
+
+	for _, output := range cases {
+		if value, err := parseVimDump(output); err == nil {
+			t.Errorf("%q parsed: %+v", output, value)
+		} else if !strings.HasPrefix(err.Error(), "Failed to parse vim-cmd output: ") {
+			t.Errorf("%q: %s", output, err)
+		}
+	}
+}
+
+// flattenVimValue writes v as one "path = value" line per scalar, null and
+// empty object or array, with the type of each object and array
+func flattenVimValue(b *strings.Builder, path string, v *vimValue) {
+	typeName := ""
+	if v.typeName != "" {
+		typeName = "(" + v.typeName + ") "
+	}
+
+	switch v.kind {
+	case vimNull:
+		fmt.Fprintf(b, "%s = %snull\n", path, typeName)
+	case vimScalar:
+		fmt.Fprintf(b, "%s = %s%q\n", path, typeName, v.scalar)
+	case vimObject:
+		fmt.Fprintf(b, "%s = %s{%d}\n", path, typeName, len(v.fields))
+		for _, field := range v.fields {
+			flattenVimValue(b, path+"."+field.name, field.value)
+		}
+	case vimArray:
+		fmt.Fprintf(b, "%s = %s[%d]\n", path, typeName, len(v.items))
+		for i, item := range v.items {
+			flattenVimValue(b, fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	}
+}
+
+// TestVimDumpGolden checks that each vim-cmd fixture parses into the tree in
+// the matching .golden file.  Run with -update to rewrite the golden files.
+func TestVimDumpGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "vimcmd", "*", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no vim-cmd output in testdata: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := parseVimDump(string(data))
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+
+		var b strings.Builder
+		flattenVimValue(&b, "value", value)
+
+		golden := strings.TrimSuffix(file, ".txt") + ".golden"
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, []byte(b.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != string(want) {
+			t.Errorf("%s: parsed tree does not match %s:\n%s", file, golden, b.String())
+		}
+	}
+}
+
+func TestVimCmdSummaryVersions(t *testing.T) {
+	expected := map[string]struct {
+		name, diskStore, power string
+		uptime                 int64
+	}{
+		"esxi65": {"web01", "datastore1", "poweredOff", 0},
+		"esxi67": {"db 01", "ssd 1", "poweredOn", 86412},
+		"esxi70": {"app01", "datastore1", "poweredOn", 3605},
+		"esxi80": {"k8s-node-1", "nvme-ds", "poweredOn", 45},
+	}
+
+	for _, version := range vimVersions {
+		summary := readVimFixture(t, "get.summary", version)
+		want := expected[version]
+
+		if summary.typeName != "vim.vm.Summary" {
+			t.Errorf("%s: type %s", version, summary.typeName)
+		}
+		if name := summary.get("config", "name").str(); name != want.name {
+			t.Errorf("%s: name = %q", version, name)
+		}
+		diskStore, path := splitDatastorePath(summary.get("config", "vmPathName").str())
+		if diskStore != want.diskStore || path != want.name+"/"+want.name+".vmx" {
+			t.Errorf("%s: vmPathName = [%s] %s", version, diskStore, path)
+		}
+		if power := summary.get("runtime", "powerState").str(); power != want.power {
+			t.Errorf("%s: powerState = %q", version, power)
+		}
+		if uptime := summary.get("quickStats", "uptimeSeconds").int(); uptime != want.uptime {
+			t.Errorf("%s: uptimeSeconds = %d", version, uptime)
+		}
+		if notes := summary.get("config", "annotation").str(); notes != "managed by terraform\nowner: \"ops\"" {
+			t.Errorf("%s: annotation = %q", version, notes)
+		}
+	}
+}
+
+func TestVimCmdGuestIPAddressVersions(t *testing.T) {
+	// 6.5 is powered off, 7.0 lists the IPv6 address first and 8.0 has only
+	// an IPv6 address on its first nic.
+	expected := map[string]string{
+		"esxi65": "",
+		"esxi67": "192.168.10.21",
+		"esxi70": "10.0.0.15",
+		"esxi80": "",
+	}
+
+	for _, version := range vimVersions {
+		guest := readVimFixture(t, "get.guest", version)
+		if ip := guestIPAddress(guest, 3600); ip != expected[version] {
+			t.Errorf("%s: ip = %q, want %q", version, ip, expected[version])
+		}
+	}
+}
+
+func TestVimCmdBootDiskVersions(t *testing.T) {
+	expected := map[string]guestDiskInfo{
+		"esxi65": {"/vmfs/volumes/datastore1/web01/web01.vmdk", 16, "thin"},
+		"esxi67": {"/vmfs/volumes/ssd 1/db 01/db 01.vmdk", 40, "zeroedthick"},
+		"esxi70": {"/vmfs/volumes/datastore1/app01/app01.vmdk", 60, "eagerzeroedthick"},
+		"esxi80": {"/vmfs/volumes/nvme-ds/k8s-node-1/k8s-node-1.vmdk", 100, "thin"},
+	}
+
+	for _, version := range vimVersions {
+		disk := guestBootDisk(readVimFixture(t, "device.getdevices", version))
+		if disk == nil {
+			t.Errorf("%s: no boot disk", version)
+		} else if *disk != expected[version] {
+			t.Errorf("%s: boot disk %+v, want %+v", version, *disk, expected[version])
+		}
+	}
+}
+
+func TestVimCmdResourcePoolVersions(t *testing.T) {
+	type allocation struct {
+		reservation int
+		expandable  string
+		limit       int
+		shares      string
+	}
+	expected := map[string][2]allocation{
+		"esxi65": {{0, "true", 0, "normal"}, {0, "true", 0, "normal"}},
+		"esxi67": {{500, "true", 2400, "high"}, {1024, "false", 8192, "high"}},
+		"esxi70": {{1000, "false", 0, "3000"}, {2048, "true", 0, "100000"}},
+		"esxi80": {{0, "true", 4800, "low"}, {512, "true", 16384, "low"}},
+	}
+
+	for _, version := range vimVersions {
+		config := readVimFixture(t, "pool_config_get", version)
+		for i, name := range []string{"cpuAllocation", "memoryAllocation"} {
+			var got allocation
+			got.reservation, got.expandable, got.limit, got.shares = parseResourceAllocation(config.get(name))
+			if got != expected[version][i] {
+				t.Errorf("%s: %s = %+v, want %+v", version, name, got, expected[version][i])
+			}
+		}
+	}
+}
@@ -2,13 +2,13 @@ package esxi
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
 
@@ -18,6 +18,8 @@ import (
 // createGuestResource creates the guest resource
 func createGuestResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutCreate))
+	defer cancel()
 
 	log.Printf("[resourceGUESTCreate]\n")
 
@@ -40,11 +42,13 @@ func createGuestResource(d *schema.ResourceData, m interface{}) error {
 	notes := d.Get("notes").(string)
 	power := d.Get("power").(string)
 	guestShutdownTimeout := d.Get("guest_shutdown_timeout").(int)
+	adoptExisting := d.Get("adopt_existing").(bool)
 
-	guestinfo, ok := d.Get("guestinfo").(map[string]interface{})
-	if !ok {
-		return errors.New("guestinfo is wrong type")
+	guestinfo, err := guestinfoFromResource(d)
+	if err != nil {
+		return err
 	}
+	extraConfig, _ := extraConfigFromResource(d)
 
 	// Validations
 	if resourcePoolName == "ha-root-pool" {
@@ -52,8 +56,7 @@ func createGuestResource(d *schema.ResourceData, m interface{}) error {
 	}
 
 	if cloneFromVM != "" {
-		password := url.QueryEscape(c.esxiPassword)
-		srcPath = fmt.Sprintf("vi://%s:%s@%s/%s", c.esxiUserName, password, c.esxiHostName, cloneFromVM)
+		srcPath = fmt.Sprintf("vi://%s@%s/%s", url.QueryEscape(c.esxiUserName), c.esxiHostName, cloneFromVM)
 	} else if ovfSource != "" {
 		srcPath = ovfSource
 	} else {
@@ -118,7 +121,7 @@ func createGuestResource(d *schema.ResourceData, m interface{}) error {
 	}
 
 	//  Validate virtual_disks
-	virtualDiskCount, ok = d.Get("virtual_disks.#").(int)
+	virtualDiskCount, ok := d.Get("virtual_disks.#").(int)
 	if !ok {
 		virtualDiskCount = 0
 		virtualDisks[0][0] = ""
@@ -144,24 +147,24 @@ func createGuestResource(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	vmid, err := createGuest(c, guestName, diskStore, srcPath, resourcePoolName, memsize,
+	vmid, snapshot, err := createGuest(ctx, c, guestName, diskStore, srcPath, resourcePoolName, memsize,
 		numvcpus, virthwver, guestos, bootDiskType, bootDiskSize, virtualNetworks,
-		virtualDisks, guestShutdownTimeout, notes, guestinfo)
+		virtualDisks, guestShutdownTimeout, notes, guestinfo, extraConfig, adoptExisting)
 	if err != nil {
 		tmpint, _ = strconv.Atoi(vmid)
 		if tmpint > 0 {
 			d.SetId(vmid)
 		}
-		return err
+		return permissionDeniedError(c, "create guest "+guestName, err)
 	}
 
 	//  set vmid
 	d.SetId(vmid)
 
 	if power == "on" {
-		_, err = powerOnGuest(c, vmid)
+		_, err = powerOnGuest(ctx, c, vmid)
 		if err != nil {
-			return errors.New("Failed to power on")
+			return snapshot.restore(c, fmt.Errorf("Failed to power on: %s", err))
 		}
 	}
 	d.Set("power", "on")
@@ -170,19 +173,18 @@ func createGuestResource(d *schema.ResourceData, m interface{}) error {
 	return readGuestDataIntoResource(d, m)
 }
 
-// createGuest creates a guest VM on the host
-func createGuest(c *Config, guestName string, diskStore string,
+// createGuest creates a guest VM on the host.  The returned snapshot holds
+// the vmx file from before updateVmx, so a failed power on can restore it.
+func createGuest(ctx context.Context, c *Config, guestName string, diskStore string,
 	srcPath string, resourcePoolName string, memSize string, numVCPUs string, virtHWver string, guestos string,
 	bootDiskType string, bootDiskSize string, virtualNetworks [10][3]string,
 	virtualDisks [60][2]string, guestShutdownTimeout int, notes string,
-	guestinfo map[string]interface{}) (string, error) {
+	guestinfo map[string]interface{}, extraConfig map[string]interface{}, adoptExisting bool) (string, *vmxSnapshot, error) {
 
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
 	log.Printf("[guestCREATE]\n")
 
 	var memsize, numvcpus, virthwver int
-	var bootDiskVmdkPath, remoteCmd, vmid, stdout, vmxContent string
-	var osShellCmd, osShellCmdOpt string
+	var bootDiskVmdkPath, remoteCmd, vmid, vmxContent string
 	var out bytes.Buffer
 	var err error
 	err = nil
@@ -194,54 +196,65 @@ func createGuest(c *Config, guestName string, diskStore string,
 	//
 	//  Check if Disk Store already exists
 	//
-	err = validateDiskStore(c, diskStore)
+	err = validateDiskStore(ctx, c, diskStore)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	//
 	//  Check if guest already exists
 	//
 	// get VMID (by name)
-	vmid, err = getGuestVMID(c, guestName)
+	vmid, err = getGuestVMID(ctx, c, guestName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if vmid != "" && !adoptExisting {
+		return "", nil, fmt.Errorf("Guest %s already exists (vmid %s), import it with terraform import or set adopt_existing = true", guestName, vmid)
+	}
+
+	//  A guest that was just built or cloned gets only the declared network
+	//  adapters.  An adopted guest keeps the ones the config does not declare.
+	ethernets := ethernetsReplaceAll
 
 	if vmid != "" {
 		// We don't need to create the VM.   It already exists.
-		fmt.Printf("[guestCREATE] guest %s already exists vmid: %s\n", guestName, stdout)
+		fmt.Printf("[guestCREATE] adopting existing guest %s vmid: %s\n", guestName, vmid)
+		ethernets = ethernetsKeepUndeclared
 
 		//
 		//   Power off guest if it's powered on.
 		//
-		currentpowerstate := getGuestPowerState(c, vmid)
+		currentpowerstate := getGuestPowerState(ctx, c, vmid)
 		if currentpowerstate == "on" || currentpowerstate == "suspended" {
-			_, err = powerOffGuest(c, vmid, guestShutdownTimeout)
+			_, err = powerOffGuest(ctx, c, vmid, guestShutdownTimeout)
 			if err != nil {
-				return "", fmt.Errorf("Failed to power off existing guest. vmid:%s", vmid)
+				return "", nil, fmt.Errorf("Failed to power off existing guest. vmid:%s: %w", vmid, err)
 			}
 		}
 
 	} else if srcPath == "none" {
 
 		// check if path already exists.
-		fullPATH := fmt.Sprintf("\"/vmfs/volumes/%s/%s\"", diskStore, guestName)
-		bootDiskVmdkPath = fmt.Sprintf("\"/vmfs/volumes/%s/%s/%s.vmdk\"", diskStore, guestName, guestName)
-		remoteCmd = fmt.Sprintf("ls -d %s", fullPATH)
-		stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "check if guest path already exists.")
-		if stdout == fullPATH {
+		fullPATH := fmt.Sprintf("/vmfs/volumes/%s/%s", diskStore, guestName)
+		bootDiskVmdkPath = fmt.Sprintf("%s/%s.vmdk", fullPATH, guestName)
+		remoteCmd = shellCommand("ls", "-d", fullPATH)
+		_, err = c.executor.runReadOnly(ctx, remoteCmd, "check if guest path already exists.")
+		if err == nil {
 			fmt.Printf("Error: Guest path already exists. fullPATH:%s\n", fullPATH)
-			return "", fmt.Errorf("Guest path already exists. fullPATH:%s", fullPATH)
+			return "", nil, fmt.Errorf("Guest path already exists. fullPATH:%s", fullPATH)
 		}
 
-		remoteCmd = fmt.Sprintf("mkdir %s", fullPATH)
-		stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "create guest path")
+		remoteCmd = shellCommand("mkdir", fullPATH)
+		_, err = c.executor.run(ctx, remoteCmd, "create guest path")
 		if err != nil {
 			log.Printf("Failed to create guest path. fullPATH:%s\n", fullPATH)
-			return "", fmt.Errorf("Failed to create guest path. fullPATH:%s", fullPATH)
+			return "", nil, fmt.Errorf("Failed to create guest path. fullPATH:%s: %w", fullPATH, err)
 		}
 
 		hasISO := false
 		isofilename := ""
-		notes = strings.Replace(notes, "\"", "|22", -1)
 
 		if numvcpus == 0 {
 			numvcpus = 1
@@ -260,81 +273,79 @@ func createGuest(c *Config, guestName string, diskStore string,
 		}
 
 		// Build VM by default/black config
-		vmxContent =
-			fmt.Sprintf("config.version = \\\"8\\\"\n") +
-				fmt.Sprintf("virtualHW.version = \\\"%d\\\"\n", virthwver) +
-				fmt.Sprintf("displayName = \\\"%s\\\"\n", guestName) +
-				fmt.Sprintf("numvcpus = \\\"%d\\\"\n", numvcpus) +
-				fmt.Sprintf("memSize = \\\"%d\\\"\n", memsize) +
-				fmt.Sprintf("guestOS = \\\"%s\\\"\n", guestos) +
-				fmt.Sprintf("annotation = \\\"%s\\\"\n", notes) +
-				fmt.Sprintf("floppy0.present = \\\"FALSE\\\"\n") +
-				fmt.Sprintf("scsi0.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("scsi0.sharedBus = \\\"none\\\"\n") +
-				fmt.Sprintf("scsi0.virtualDev = \\\"lsilogic\\\"\n") +
-				fmt.Sprintf("pciBridge0.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("pciBridge4.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("pciBridge4.virtualDev = \\\"pcieRootPort\\\"\n") +
-				fmt.Sprintf("pciBridge4.functions = \\\"8\\\"\n") +
-				fmt.Sprintf("pciBridge5.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("pciBridge5.virtualDev = \\\"pcieRootPort\\\"\n") +
-				fmt.Sprintf("pciBridge5.functions = \\\"8\\\"\n") +
-				fmt.Sprintf("pciBridge6.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("pciBridge6.virtualDev = \\\"pcieRootPort\\\"\n") +
-				fmt.Sprintf("pciBridge6.functions = \\\"8\\\"\n") +
-				fmt.Sprintf("pciBridge7.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("pciBridge7.virtualDev = \\\"pcieRootPort\\\"\n") +
-				fmt.Sprintf("pciBridge7.functions = \\\"8\\\"\n") +
-				fmt.Sprintf("scsi0:0.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("scsi0:0.fileName = \\\"%s.vmdk\\\"\n", guestName) +
-				fmt.Sprintf("scsi0:0.deviceType = \\\"scsi-hardDisk\\\"\n")
+		vmx := parseVmx("")
+		vmx.set("config.version", "8")
+		vmx.set("virtualHW.version", strconv.Itoa(virthwver))
+		vmx.set("displayName", guestName)
+		vmx.set("numvcpus", strconv.Itoa(numvcpus))
+		vmx.set("memSize", strconv.Itoa(memsize))
+		vmx.set("guestOS", guestos)
+		vmx.set("annotation", notes)
+		vmx.set("floppy0.present", "FALSE")
+
+		hw := parseVmxHardware(vmx)
+		hw.controllers = []*vmxController{{bus: "scsi", index: 0, virtualDev: "lsilogic", sharedBus: "none"}}
+		hw.pciBridges = []*vmxPCIBridge{{index: 0}}
+		for i := 4; i <= 7; i++ {
+			hw.pciBridges = append(hw.pciBridges, &vmxPCIBridge{index: i, virtualDev: "pcieRootPort", functions: "8"})
+		}
+		hw.disks = []*vmxDisk{{bus: "scsi", controller: 0, unit: 0, fileName: guestName + ".vmdk", deviceType: "scsi-hardDisk"}}
 		if hasISO == true {
-			vmxContent = vmxContent +
-				fmt.Sprintf("ide1:0.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("ide1:0.fileName = \\\"emptyBackingString\\\"\n") +
-				fmt.Sprintf("ide1:0.deviceType = \\\"atapi-cdrom\\\"\n") +
-				fmt.Sprintf("ide1:0.startConnected = \\\"FALSE\\\"\n") +
-				fmt.Sprintf("ide1:0.clientDevice = \\\"TRUE\\\"\n")
+			hw.cdroms = []*vmxCdrom{{bus: "ide", controller: 1, unit: 0, fileName: "emptyBackingString",
+				deviceType: "atapi-cdrom", startConnected: "FALSE", clientDevice: "TRUE"}}
 		} else {
-			vmxContent = vmxContent +
-				fmt.Sprintf("ide1:0.present = \\\"TRUE\\\"\n") +
-				fmt.Sprintf("ide1:0.fileName = \\\"%s\\\"\n", isofilename) +
-				fmt.Sprintf("ide1:0.deviceType = \\\"cdrom-image\\\"\n")
+			hw.cdroms = []*vmxCdrom{{bus: "ide", controller: 1, unit: 0, fileName: isofilename, deviceType: "cdrom-image"}}
 		}
+		hw.apply(vmx)
+		vmxContent = vmx.String()
 
 		//
 		//  Write vmx file to esxi host
 		//
 		log.Printf("[guestCREATE] New guest_name.vmx: %s\n", vmxContent)
 
-		destVmxFile := fmt.Sprintf("%s/%s.vmx", fullPATH, guestName)
+		destVmxFile := fmt.Sprintf("/vmfs/volumes/%s/%s/%s.vmx", diskStore, guestName, guestName)
 
-		remoteCmd = fmt.Sprintf("echo \"%s\" >%s", vmxContent, destVmxFile)
-		vmxContent, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "write guest_name.vmx file")
+		err = c.executor.writeFile(ctx, destVmxFile, vmxContent, false)
+		if err != nil {
+			remoteCmd = shellCommand("rm", "-fr", fullPATH)
+			_, _ = c.executor.run(ctx, remoteCmd, "cleanup guest path because of failed events")
+			return "", nil, fmt.Errorf("Failed to write guest vmx file: %w", err)
+		}
 
 		//  Create boot disk (vmdk)
-		remoteCmd = fmt.Sprintf("vmkfstools -c %sG -d %s %s/%s.vmdk", bootDiskSize, bootDiskType, fullPATH, guestName)
-		_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmkfstools (make boot disk)")
+		remoteCmd = shellCommand("vmkfstools", "-c", bootDiskSize+"G", "-d", bootDiskType, bootDiskVmdkPath)
+		_, err = c.executor.run(ctx, remoteCmd, "vmkfstools (make boot disk)")
 		if err != nil {
-			remoteCmd = fmt.Sprintf("rm -fr %s", fullPATH)
-			stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "cleanup guest path because of failed events")
+			remoteCmd = shellCommand("rm", "-fr", fullPATH)
+			_, _ = c.executor.run(ctx, remoteCmd, "cleanup guest path because of failed events")
 			log.Printf("Failed to vmkfstools (make boot disk):%s\n", err.Error())
-			return "", fmt.Errorf("Failed to vmkfstools (make boot disk):%s", err.Error())
+			return "", nil, fmt.Errorf("Failed to vmkfstools (make boot disk):%w", err)
 		}
 
-		poolID, err := getResourcePoolID(c, resourcePoolName)
+		//  Keep the pool from being created or renamed under us until the guest is in it.
+		unlockPool, err := c.lockResourcePools(ctx, resourcePoolName)
+		if err != nil {
+			remoteCmd = shellCommand("rm", "-fr", fullPATH)
+			_, _ = c.executor.run(ctx, remoteCmd, "cleanup guest path because of failed events")
+			return "", nil, err
+		}
+		poolID, err := getResourcePoolID(ctx, c, resourcePoolName)
 		log.Println("[guestCREATE] DEBUG: " + poolID)
 		if err != nil {
+			unlockPool()
 			log.Printf("Failed to use Resource Pool ID:%s\n", poolID)
-			return "", fmt.Errorf("Failed to use Resource Pool ID:%s", poolID)
+			return "", nil, fmt.Errorf("Failed to use Resource Pool ID:%s", poolID)
 		}
-		remoteCmd = fmt.Sprintf("vim-cmd solo/registervm %s %s %s", destVmxFile, guestName, poolID)
-		_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "solo/registervm")
+		remoteCmd = shellCommand("vim-cmd", "solo/registervm", destVmxFile, guestName, poolID)
+		_, err = c.executor.run(ctx, remoteCmd, "solo/registervm")
+		c.invalidateInventory(inventoryGuests | inventoryPools)
+		unlockPool()
 		if err != nil {
 			log.Printf("Failed to register guest:%s\n", err.Error())
-			remoteCmd = fmt.Sprintf("rm -fr %s", fullPATH)
-			stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "cleanup guest path because of failed events")
-			return "", fmt.Errorf("Failed to register guest:%s", err.Error())
+			remoteCmd = shellCommand("rm", "-fr", fullPATH)
+			_, _ = c.executor.run(ctx, remoteCmd, "cleanup guest path because of failed events")
+			return "", nil, fmt.Errorf("Failed to register guest:%w", err)
 		}
 
 	} else {
@@ -343,7 +354,7 @@ func createGuest(c *Config, guestName string, diskStore string,
 		//  Check if source file exist.
 		if !strings.HasPrefix(srcPath, "vi://") {
 			if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-				return "", fmt.Errorf("File not found: %s", srcPath)
+				return "", nil, fmt.Errorf("File not found: %s", srcPath)
 			}
 		}
 
@@ -351,95 +362,65 @@ func createGuest(c *Config, guestName string, diskStore string,
 		if bootDiskType == "zeroedthick" {
 			bootDiskType = "thick"
 		}
-		password := url.QueryEscape(c.esxiPassword)
-		destPath := fmt.Sprintf("vi://%s:%s@%s/%s", c.esxiUserName, password, c.esxiHostName, resourcePoolName)
+		destPath := fmt.Sprintf("vi://%s@%s/%s", url.QueryEscape(c.esxiUserName), c.esxiHostName, resourcePoolName)
 
-		networkParam := ""
+		ovfArgs := []string{"--acceptAllEulas", "--noSSLVerify", "--X:useMacNaming=false",
+			"-dm=" + bootDiskType, "--name=" + guestName, "--overwrite", "-ds=" + diskStore}
 		if (strings.HasSuffix(srcPath, ".ova") || strings.HasSuffix(srcPath, ".ovf")) && virtualNetworks[0][0] != "" {
-			networkParam = " --network='" + virtualNetworks[0][0] + "'"
+			ovfArgs = append(ovfArgs, "--network="+virtualNetworks[0][0])
 		}
+		ovfArgs = append(ovfArgs, srcPath, destPath)
 
-		ovfCmd := fmt.Sprintf("ovftool --acceptAllEulas --noSSLVerify --X:useMacNaming=false "+
-			"-dm=%s --name='%s' --overwrite -ds='%s' %s '%s' '%s'", bootDiskType, guestName, diskStore, networkParam, srcPath, destPath)
-
-		if runtime.GOOS == "windows" {
-			osShellCmd = "cmd.exe"
-			osShellCmdOpt = "/c"
-
-			ovfCmd = strings.Replace(ovfCmd, "'", "\"", -1)
-
-			var ovfBat = "ovf_cmd.bat"
-
-			_, err = os.Stat(ovfBat)
-
-			// delete file if exists
-			if os.IsExist(err) {
-				err = os.Remove(ovfBat)
-				if err != nil {
-					return "", fmt.Errorf("Unable to delete %s: %s", ovfBat, err.Error())
-				}
-			}
-
-			//  create new batch file
-			file, err := os.Create(ovfBat)
-			if err != nil {
-				defer file.Close()
-				return "", fmt.Errorf("Unable to create %s: %s", ovfBat, err.Error())
-			}
-
-			_, err = file.WriteString(ovfCmd)
-			if err != nil {
-				defer file.Close()
-				return "", fmt.Errorf("Unable to write to %s: %s", ovfBat, err.Error())
-			}
-
-			err = file.Sync()
-			defer file.Close()
-			ovfCmd = ovfBat
-
-		} else {
-			osShellCmd = "/bin/bash"
-			osShellCmdOpt = "-c"
+		//  The vi:// locators carry no password, so ovftool prompts for one
+		//  per locator.  Answer on stdin so it is never on a command line or on disk.
+		ovfPassword := c.esxiPassword + "\n"
+		if strings.HasPrefix(srcPath, "vi://") {
+			ovfPassword = ovfPassword + c.esxiPassword + "\n"
 		}
 
-		//  Execute ovftool script (or batch) here.
-		cmd := exec.Command(osShellCmd, osShellCmdOpt, ovfCmd)
-
-		log.Printf("[guestCREATE] ovf_cmd: %s\n", ovfCmd)
-
+		cmd := exec.CommandContext(ctx, "ovftool", ovfArgs...)
+		cmd.Stdin = strings.NewReader(ovfPassword)
 		cmd.Stdout = &out
+		cmd.Stderr = &out
+
+		log.Printf("[guestCREATE] ovftool args: %q\n", ovfArgs)
 		err = cmd.Run()
+		c.invalidateInventory(inventoryGuests | inventoryPools)
 		log.Printf("[guestCREATE] ovftool output: %q\n", out.String())
 
+		if ctx.Err() != nil {
+			return "", nil, fmt.Errorf("Timed out waiting for ovftool: %s", ctx.Err())
+		}
 		if err != nil {
-			log.Printf("Failed, There was an ovftool Error: %s\n%s\n", out.String(), err.Error())
-			return "", fmt.Errorf("There was an ovftool Error: %s\n%s", out.String(), err.Error())
+			ovfOutput := redactSecrets(out.String())
+			log.Printf("Failed, There was an ovftool Error: %s\n%s\n", ovfOutput, err.Error())
+			return "", nil, fmt.Errorf("There was an ovftool Error: %s\n%s", ovfOutput, err.Error())
 		}
 	}
 
 	// get VMID (by name)
-	vmid, err = getGuestVMID(c, guestName)
+	vmid, err = getGuestVMID(ctx, c, guestName)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	//
 	//  Grow boot disk to boot_disk_size
 	//
-	bootDiskVmdkPath, _ = getBootDiskPath(c, vmid)
+	bootDiskVmdkPath, _ = getBootDiskPath(ctx, c, vmid)
 
-	err = growVirtualDisk(c, bootDiskVmdkPath, bootDiskSize)
+	err = growVirtualDisk(ctx, c, bootDiskVmdkPath, bootDiskSize)
 	if err != nil {
-		return vmid, fmt.Errorf("Failed to grow boot disk")
+		return vmid, nil, fmt.Errorf("Failed to grow boot disk")
 	}
 
 	//
 	//  make updates to vmx file
 	//
-	err = updateVmx(c, vmid, true, memsize, numvcpus, virthwver, guestos, virtualNetworks, virtualDisks, notes, guestinfo)
+	snapshot, err := updateVmx(ctx, c, vmid, ethernets, memsize, numvcpus, virthwver, guestos, virtualNetworks, virtualDisks, notes, guestinfo, extraConfig, nil)
 	if err != nil {
-		return vmid, err
+		return vmid, nil, err
 	}
 
-	return vmid, nil
+	return vmid, snapshot, nil
 }
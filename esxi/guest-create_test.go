@@ -0,0 +1,84 @@
+package esxi
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testOvftoolStub puts an ovftool on PATH that records its arguments and
+// standard input in dir, then fails so createGuest stops after running it
+func testOvftoolStub(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the ovftool stub is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "esxi-ovftool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	stub := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > '" + filepath.Join(dir, "args") + "'\n" +
+		"cat > '" + filepath.Join(dir, "stdin") + "'\n" +
+		"echo 'stub ovftool'\n" +
+		"exit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ovftool"), []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestCreateGuestOvftoolCredentials(t *testing.T) {
+	cases := map[string]struct {
+		source  string
+		prompts int
+	}{
+		"local ova": {"web01.ova", 1},
+		"clone":     {"vi://root@esxi-old/web-old", 2},
+	}
+
+	for name, tc := range cases {
+		dir := testOvftoolStub(t)
+		_, _, c := testFakeHost(t)
+
+		srcPath := tc.source
+		if !strings.HasPrefix(srcPath, "vi://") {
+			srcPath = filepath.Join(dir, srcPath)
+			if err := ioutil.WriteFile(srcPath, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var networks [10][3]string
+		var disks [60][2]string
+		_, _, err := createGuest(context.Background(), c, "web01", "ds1", srcPath, "/", "512", "1", "13", "",
+			"thin", "16", networks, disks, 10, "", nil, nil, false)
+		if err == nil || !strings.Contains(err.Error(), "ovftool Error") {
+			t.Fatalf("%s: expected the stub ovftool to fail, got %v", name, err)
+		}
+
+		args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+		if err != nil {
+			t.Fatalf("%s: ovftool did not run: %s", name, err)
+		}
+		for _, arg := range strings.Split(strings.TrimSpace(string(args)), "\n") {
+			if strings.Contains(arg, c.esxiPassword) || strings.Contains(arg, c.esxiUserName+":") {
+				t.Errorf("%s: credentials on the ovftool command line: %q", name, arg)
+			}
+		}
+
+		stdin, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Repeat(c.esxiPassword+"\n", tc.prompts); string(stdin) != want {
+			t.Errorf("%s: ovftool stdin %q, want %q", name, stdin, want)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package esxi
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"time"
 
@@ -11,33 +11,36 @@ import (
 // deleteGuestResource deletes the guest resource
 func deleteGuestResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutDelete))
+	defer cancel()
 	log.Println("[resourceGUESTDelete]")
 
-	var remoteCmd, stdout string
+	var remoteCmd string
 	var err error
 
 	vmid := d.Id()
 	guestShutdownTimeout := d.Get("guest_shutdown_timeout").(int)
 
-	_, err = powerOffGuest(c, vmid, guestShutdownTimeout)
+	_, err = powerOffGuest(ctx, c, vmid, guestShutdownTimeout)
 	if err != nil {
-		return err
+		return permissionDeniedError(c, "power off guest "+vmid, err)
 	}
 
 	// remove storage from vmx so it doesn't get deleted by the vim-cmd destroy
-	err = cleanVmxStorage(c, vmid)
+	err = cleanVmxStorage(ctx, c, vmid)
 	if err != nil {
 		log.Printf("[resourceGUESTDelete] Failed clean storage from vmid: %s (to be deleted)\n", vmid)
 	}
 
 	time.Sleep(5 * time.Second)
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/destroy %s", vmid)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/destroy")
-	if err != nil {
-		// todo more descriptive err message
-		log.Printf("[resourceGUESTDelete] Failed destroy vmid: %s\n", stdout)
-		return err
+	remoteCmd = shellCommand("vim-cmd", "vmsvc/destroy", vmid)
+	_, err = c.runRetryingHostBusy(ctx, remoteCmd, "vmsvc/destroy")
+	c.invalidateInventory(inventoryGuests | inventoryPools)
+	if isRemoteNotFound(err) {
+		log.Printf("[resourceGUESTDelete] Already deleted vmid: %s\n", vmid)
+	} else if err != nil {
+		log.Printf("[resourceGUESTDelete] Failed destroy vmid: %s\n", err)
+		return permissionDeniedError(c, "destroy guest "+vmid, err)
 	}
 
 	d.SetId("")
@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -10,6 +11,8 @@ import (
 // importGuestResource imports a guest resource from ESXi
 func importGuestResource(d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
 	log.Println("[resourceGUESTImport]")
 
 	var vmid string
@@ -19,13 +22,15 @@ func importGuestResource(d *schema.ResourceData, m interface{}) ([]*schema.Resou
 	results[0] = d
 
 	// get VMID (by name)
-	vmid, err = validateGuestVMID(c, d.Id())
+	vmid, err = validateGuestVMID(ctx, c, d.Id())
 	if err != nil {
 		return results, err
 	}
 
 	if vmid == d.Id() {
 		d.SetId(vmid)
+		//  Only used on create, so an imported guest gets the default
+		d.Set("adopt_existing", false)
 	} else {
 		return results, fmt.Errorf("Failed to validate vmid: %s", err)
 	}
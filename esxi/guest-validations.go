@@ -8,12 +8,10 @@ import (
 	//"errors"
 )
 
-func validateVirtualDiskSlot(slot string) string {
-	log.Printf("[validateVirtualDiskSlot]\n")
-
-	var result string
-
-	// Split on comma.
+// parseVirtualDiskSlot splits a slot into scsi controller and scsi id.  The
+// simple format, a scsi id alone, is on controller 0.
+func parseVirtualDiskSlot(slot string) (int, int) {
+	// Split on colon.
 	fields := strings.Split(slot+":UnSet", ":")
 
 	// if using simple format
@@ -24,6 +22,15 @@ func validateVirtualDiskSlot(slot string) string {
 
 	field0i, _ := strconv.Atoi(fields[0])
 	field1i, _ := strconv.Atoi(fields[1])
+	return field0i, field1i
+}
+
+func validateVirtualDiskSlot(slot string) string {
+	log.Printf("[validateVirtualDiskSlot]\n")
+
+	var result string
+
+	field0i, field1i := parseVirtualDiskSlot(slot)
 	result = "ok"
 
 	if field0i < 0 || field0i > 3 {
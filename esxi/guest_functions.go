@@ -1,229 +1,203 @@
 package esxi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// getGuestVMID gets the guest VM's ID by the name
-func getGuestVMID(c *Config, guestName string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+// getGuestVMID gets the guest VM's ID by the name.  The name must match
+// exactly.  A name shared by several guests is an error rather than a guess,
+// since the caller may go on to reconfigure the guest.
+func getGuestVMID(ctx context.Context, c *Config, guestName string) (string, error) {
 	log.Printf("[guestGetVMID]\n")
 
-	var remoteCmd, vmid string
-	var err error
-
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/getallvms 2>/dev/null | sort -n | "+
-		"grep \"[0-9] * %s .*%s\" | awk '{print $1}' | "+
-		"tail -1", guestName, guestName)
-
-	vmid, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "get vmid")
-	log.Printf("[guestGetVMID] result: %s\n", vmid)
+	guests, err := c.hostGuests(ctx)
 	if err != nil {
 		log.Printf("[guestGetVMID] Failed get vmid: %s\n", err)
 		return "", fmt.Errorf("Failed get vmid: %s", err)
 	}
 
+	var vmids []string
+	for _, guest := range guests {
+		if guest.name == guestName {
+			vmids = append(vmids, guest.vmid)
+		}
+	}
+	if len(vmids) > 1 {
+		log.Printf("[guestGetVMID] %s matches vmids %s\n", guestName, strings.Join(vmids, ", "))
+		return "", fmt.Errorf("Found %d guests named %s (vmids %s), rename or remove all but one", len(vmids), guestName, strings.Join(vmids, ", "))
+	}
+
+	vmid := ""
+	if len(vmids) == 1 {
+		vmid = vmids[0]
+	}
+	log.Printf("[guestGetVMID] result: %s\n", vmid)
+
 	return vmid, nil
 }
 
 // validateGuestVMID validates a guest VM's ID
-func validateGuestVMID(c *Config, vmid string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func validateGuestVMID(ctx context.Context, c *Config, vmid string) (string, error) {
 	log.Printf("[guestValidateVMID]\n")
 
-	var remoteCmd string
-	var err error
-
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/getallvms 2>/dev/null | awk '{print $1}' | "+
-		"grep '^%s$'", vmid)
-
-	vmid, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "validate vmid exists")
-	log.Printf("[guestValidateVMID] result: %s\n", vmid)
+	guests, err := c.hostGuests(ctx)
 	if err != nil {
 		log.Printf("[guestValidateVMID] Failed get vmid: %s\n", err)
 		return "", fmt.Errorf("Failed get vmid: %s", err)
 	}
 
-	return vmid, nil
+	for _, guest := range guests {
+		if guest.vmid == vmid {
+			log.Printf("[guestValidateVMID] result: %s\n", vmid)
+			return vmid, nil
+		}
+	}
+	return "", fmt.Errorf("Failed get vmid: no guest with vmid %s", vmid)
 }
 
 // getBootDiskPath gets the path of the VM's book disk VMDK
-func getBootDiskPath(c *Config, vmid string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getBootDiskPath(ctx context.Context, c *Config, vmid string) (string, error) {
 	log.Printf("[getBootDiskPath]\n")
 
-	var remoteCmd, stdout string
-	var err error
+	remoteCmd := shellCommand("vim-cmd", "vmsvc/device.getdevices", vmid)
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "get boot disk")
+	if err != nil {
+		log.Printf("[getBootDiskPath] Failed get boot disk path: %s\n", err)
+		return "", err
+	}
 
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/device.getdevices %s | grep -A10 'key = 2000'|grep -m 1 fileName", vmid)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "get boot disk")
+	devices, err := parseVimDump(result.stdout)
 	if err != nil {
-		log.Printf("[getBootDiskPath] Failed get boot disk path: %s\n", stdout)
-		return "Failed get boot disk path:", err
+		return "", err
 	}
-	r := strings.NewReplacer("fileName = \"[", "/vmfs/volumes/",
-		"] ", "/", "\",", "")
-	return r.Replace(stdout), err
+	disk := guestBootDisk(devices)
+	if disk == nil {
+		return "", fmt.Errorf("Guest %s has no boot disk", vmid)
+	}
+	return disk.path, nil
 }
 
 // getDestVmxAbsPath gets the absolute path for the VMX file on the host
-func getDestVmxAbsPath(c *Config, vmid string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getDestVmxAbsPath(ctx context.Context, c *Config, vmid string) (string, error) {
 	log.Printf("[getDst_vmx_file]\n")
 
-	var destVmxDiskStore, destVmxPath, destVmxAbsPath string
-
-	//      -Get location of vmx file on esxi host
-	remoteCmd := fmt.Sprintf("vim-cmd vmsvc/get.config %s | grep vmPathName|grep -oE \"\\[.*\\]\"", vmid)
-	stdout, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "get dst_vmx_ds")
-	destVmxDiskStore = stdout
-	destVmxDiskStore = strings.Trim(destVmxDiskStore, "[")
-	destVmxDiskStore = strings.Trim(destVmxDiskStore, "]")
-
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/get.config %s | grep vmPathName|awk '{print $NF}'|sed 's/[\"|,]//g'", vmid)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "get dst_vmx")
-	destVmxPath = stdout
-
-	destVmxAbsPath = "/vmfs/volumes/" + destVmxDiskStore + "/" + destVmxPath
-	return destVmxAbsPath, err
+	return c.guestVmxPath(ctx, vmid)
 }
 
 // readVmxContent reads the content of a VMX file on the host machine
-func readVmxContent(c *Config, vmid string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func readVmxContent(ctx context.Context, c *Config, vmid string) (string, error) {
 	log.Printf("[getVmx_contents]\n")
 
-	var remoteCmd, vmxContent string
+	var remoteCmd string
 
-	destVmxFile, err := getDestVmxAbsPath(c, vmid)
-	remoteCmd = fmt.Sprintf("cat \"%s\"", destVmxFile)
-	vmxContent, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "read guest_name.vmx file")
+	destVmxFile, err := getDestVmxAbsPath(ctx, c, vmid)
+	if err != nil {
+		return "", err
+	}
+	remoteCmd = shellCommand("cat", destVmxFile)
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "read guest_name.vmx file")
 
-	return vmxContent, err
+	return result.stdout, err
 }
 
+// ethernetMode says what updateVmx does with the network adapters of a guest
+type ethernetMode int
+
+const (
+	// ethernetsSync removes the adapters the configuration does not declare
+	ethernetsSync ethernetMode = iota
+	// ethernetsReplaceAll drops every adapter first.  Only for a guest that
+	// was just built or cloned.
+	ethernetsReplaceAll
+	// ethernetsKeepUndeclared leaves the adapters the configuration does not
+	// declare alone, so adopting a guest keeps its hand-made adapters.
+	ethernetsKeepUndeclared
+)
+
 // updateVmx updates the VMX file on the host
-func updateVmx(c *Config, vmid string, iscreate bool, memsize int, numvcpus int,
+func updateVmx(ctx context.Context, c *Config, vmid string, ethernets ethernetMode, memsize int, numvcpus int,
 	virthwver int, guestos string, virtualNetworks [10][3]string, virtualDisks [60][2]string, notes string,
-	guestinfo map[string]interface{}) error {
+	guestinfo map[string]interface{}, extraConfig map[string]interface{}, removedExtraConfig []string) (*vmxSnapshot, error) {
 
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
 	log.Printf("[updateVmx_contents]\n")
 
-	var regexReplacement, remoteCmd string
+	unlock, err := c.lockGuest(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	vmxContent, err := readVmxContent(c, vmid)
+	vmxContent, err := readVmxContent(ctx, c, vmid)
+	if isRemoteNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
 		log.Printf("[updateVmx_contents] Failed get vmx contents: %s\n", err)
-		return err
-	}
-	if strings.Contains(vmxContent, "Unable to find a VM corresponding") {
-		return nil
+		return nil, err
 	}
+	vmx := parseVmx(vmxContent)
 
-	// modify memsize
 	if memsize != 0 {
-		re := regexp.MustCompile("memSize = \".*\"")
-		regexReplacement = fmt.Sprintf("memSize = \"%d\"", memsize)
-		vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
+		vmx.set("memSize", strconv.Itoa(memsize))
 	}
-
-	// modify numvcpus
 	if numvcpus != 0 {
-		re := regexp.MustCompile("numvcpus = \".*\"")
-		regexReplacement = fmt.Sprintf("numvcpus = \"%d\"", numvcpus)
-		vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
+		vmx.set("numvcpus", strconv.Itoa(numvcpus))
 	}
-
-	// modify virthwver
 	if virthwver != 0 {
-		re := regexp.MustCompile("virtualHW.version = \".*\"")
-		regexReplacement = fmt.Sprintf("virtualHW.version = \"%d\"", virthwver)
-		vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
+		vmx.set("virtualHW.version", strconv.Itoa(virthwver))
 	}
-
-	// modify guestos
 	if guestos != "" {
-		re := regexp.MustCompile("guestOS = \".*\"")
-		regexReplacement = fmt.Sprintf("guestOS = \"%s\"", guestos)
-		vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
+		vmx.set("guestOS", guestos)
 	}
-
-	// modify annotation
 	if notes != "" {
-		notes = strings.Replace(notes, "\"", "|22", -1)
-		if strings.Contains(vmxContent, "annotation") {
-			re := regexp.MustCompile("annotation = \".*\"")
-			regexReplacement = fmt.Sprintf("annotation = \"%s\"", notes)
-			vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-		} else {
-			regexReplacement = fmt.Sprintf("\nannotation = \"%s\"", notes)
-			vmxContent += regexReplacement
-		}
+		vmx.set("annotation", notes)
 	}
 
-	if len(guestinfo) > 0 {
-		parsedVmx := parseVmxFile(vmxContent)
-		for k, v := range guestinfo {
-			log.Println("SAVING", k, v)
-			parsedVmx["guestinfo."+k] = v.(string)
-		}
-		vmxContent = buildVmxString(parsedVmx)
+	keys := make([]string, 0, len(guestinfo))
+	for k := range guestinfo {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		log.Println("SAVING", k, guestinfo[k])
+		vmx.set("guestinfo."+k, guestinfo[k].(string))
 	}
 
-	//
-	//  add/modify virtual disks
-	//
-	var tmpvar string
-	var newVmxContent string
-	var i, j int
-
-	//
-	//  Remove all disks
-	//
-	regexReplacement = fmt.Sprintf("")
-	for i = 0; i < 4; i++ {
-		for j = 0; j < 16; j++ {
-
-			if (i != 0 || j != 0) && j != 7 {
-				re := regexp.MustCompile(fmt.Sprintf("scsi%d:%d.*\n", i, j))
-				vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-			}
-		}
+	//  Remove the extra_config settings dropped from the config before
+	//  writing the current ones, a key may only have changed case.
+	for _, k := range removedExtraConfig {
+		log.Printf("[updateVmx_contents] Remove extra_config: %s\n", k)
+		vmx.delete(k)
+	}
+	keys = keys[:0]
+	for k := range extraConfig {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vmx.set(k, extraConfig[k].(string))
 	}
 
+	hw := parseVmxHardware(vmx)
+
 	//
-	//  Add disks that are managed by terraform
+	//  Replace the attached disks with the ones managed by terraform.  The boot disk stays.
 	//
-	for i = 0; i < 59; i++ {
+	hw.removeDisks(func(disk *vmxDisk) bool {
+		return disk.bus == "scsi" && !(disk.controller == 0 && disk.unit == 0)
+	})
+	for i := 0; i < 59; i++ {
 		if virtualDisks[i][0] != "" {
-
 			log.Printf("[updateVmx_contents] Adding: %s\n", virtualDisks[i][1])
-			tmpvar = fmt.Sprintf("scsi%s.deviceType = \"scsi-hardDisk\"\n", virtualDisks[i][1])
-			if !strings.Contains(vmxContent, tmpvar) {
-				vmxContent += "\n" + tmpvar
-			}
-
-			tmpvar = fmt.Sprintf("scsi%s.fileName", virtualDisks[i][1])
-			if strings.Contains(vmxContent, tmpvar) {
-				re := regexp.MustCompile(tmpvar + " = \".*\"")
-				regexReplacement = fmt.Sprintf(tmpvar+" = \"%s\"", virtualDisks[i][0])
-				vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-			} else {
-				regexReplacement = fmt.Sprintf("\n"+tmpvar+" = \"%s\"", virtualDisks[i][0])
-				vmxContent += "\n" + regexReplacement
-			}
-
-			tmpvar = fmt.Sprintf("scsi%s.present = \"true\"\n", virtualDisks[i][1])
-			if !strings.Contains(vmxContent, tmpvar) {
-				vmxContent += "\n" + tmpvar
-			}
-
+			controller, unit := parseVirtualDiskSlot(virtualDisks[i][1])
+			hw.attachDisk(controller, unit, virtualDisks[i][0])
 		}
 	}
 
@@ -232,228 +206,248 @@ func updateVmx(c *Config, vmid string, iscreate bool, memsize int, numvcpus int,
 	//
 
 	//  Define default nic type.
-	var defaultNetworkType, networkType string
+	defaultNetworkType := "e1000"
 	if virtualNetworks[0][2] != "" {
 		defaultNetworkType = virtualNetworks[0][2]
-	} else {
-		defaultNetworkType = "e1000"
 	}
 
-	//  If this is first time provisioning, delete all the old ethernet configuration.
-	if iscreate == true {
+	//  If the guest was just built or cloned, delete all the old ethernet configuration.
+	if ethernets == ethernetsReplaceAll {
 		log.Printf("[updateVmx_contents] Delete old ethernet configuration\n")
-		regexReplacement = fmt.Sprintf("")
-		for i = 0; i < 9; i++ {
-			re := regexp.MustCompile(fmt.Sprintf("ethernet%d.*\n", i))
-			vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-		}
+		hw.ethernets = nil
 	}
 
-	//  Add/Modify virtual networks.
-	networkType = ""
+	for i := 0; i < 10; i++ {
+		ethernet := hw.ethernet(i)
 
-	for i := 0; i <= 9; i++ {
-		log.Printf("[updateVmx_contents] ethernet%d\n", i)
-
-		if virtualNetworks[i][0] == "" && strings.Contains(vmxContent, "ethernet"+strconv.Itoa(i)) == true {
-			//  This is Modify (Delete existing network configuration)
-			log.Printf("[updateVmx_contents] ethernet%d Delete existing.\n", i)
-			regexReplacement = fmt.Sprintf("")
-			re := regexp.MustCompile(fmt.Sprintf("ethernet%d.*\n", i))
-			vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-		}
+		switch {
+		case virtualNetworks[i][0] == "":
+			if ethernet != nil && ethernets != ethernetsKeepUndeclared {
+				log.Printf("[updateVmx_contents] ethernet%d Delete existing.\n", i)
+				hw.removeEthernet(i)
+			}
 
-		if virtualNetworks[i][0] != "" && strings.Contains(vmxContent, "ethernet"+strconv.Itoa(i)) == true {
-			//  This is Modify
+		case ethernet != nil:
 			log.Printf("[updateVmx_contents] ethernet%d Modify existing.\n", i)
-
-			//  Modify Network Name
-			re := regexp.MustCompile("ethernet" + strconv.Itoa(i) + ".networkName = \".*\"")
-			regexReplacement = fmt.Sprintf("ethernet"+strconv.Itoa(i)+".networkName = \"%s\"", virtualNetworks[i][0])
-			vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-
-			//  Modify virtual Device
-			re = regexp.MustCompile("ethernet" + strconv.Itoa(i) + ".virtualDev = \".*\"")
-			regexReplacement = fmt.Sprintf("ethernet"+strconv.Itoa(i)+".virtualDev = \"%s\"", virtualNetworks[i][2])
-			vmxContent = re.ReplaceAllString(vmxContent, regexReplacement)
-
+			ethernet.networkName = virtualNetworks[i][0]
+			if virtualNetworks[i][2] != "" {
+				ethernet.virtualDev = virtualNetworks[i][2]
+			}
 			//  Modify MAC  todo
-		}
-
-		if virtualNetworks[i][0] != "" && strings.Contains(vmxContent, "ethernet"+strconv.Itoa(i)) == false {
-			//  This is create
 
-			//  Set virtual_network name
+		default:
 			log.Printf("[updateVmx_contents] ethernet%d Create New: %s\n", i, virtualNetworks[i][0])
-			tmpvar = fmt.Sprintf("\nethernet%d.networkName = \"%s\"\n", i, virtualNetworks[i][0])
-			newVmxContent = tmpvar
-
-			//  Set mac address
-			if virtualNetworks[i][1] != "" {
-				tmpvar = fmt.Sprintf("ethernet%d.addressType = \"static\"\n", i)
-				newVmxContent = newVmxContent + tmpvar
-
-				tmpvar = fmt.Sprintf("ethernet%d.address = \"%s\"\n", i, virtualNetworks[i][1])
-				newVmxContent = newVmxContent + tmpvar
+			ethernet = &vmxEthernet{
+				index:       i,
+				networkName: virtualNetworks[i][0],
+				virtualDev:  virtualNetworks[i][2],
 			}
-
-			//  Set network type
-			if virtualNetworks[i][2] == "" {
-				networkType = defaultNetworkType
-			} else {
-				networkType = virtualNetworks[i][2]
+			if ethernet.virtualDev == "" {
+				ethernet.virtualDev = defaultNetworkType
 			}
-
-			tmpvar = fmt.Sprintf("ethernet%d.virtualDev = \"%s\"\n", i, networkType)
-			newVmxContent = newVmxContent + tmpvar
-
-			tmpvar = fmt.Sprintf("ethernet%d.present = \"TRUE\"\n", i)
-
-			vmxContent = vmxContent + newVmxContent + tmpvar
+			if virtualNetworks[i][1] != "" {
+				ethernet.addressType = "static"
+				ethernet.address = virtualNetworks[i][1]
+			}
+			hw.ethernets = append(hw.ethernets, ethernet)
 		}
 	}
 
-	//
-	//  Write vmx file to esxi host
-	//
-	log.Printf("[updateVmx_contents] New guest_name.vmx: %s\n", vmxContent)
+	hw.apply(vmx)
 
-	destVmxFilePath, err := getDestVmxAbsPath(c, vmid)
-	vmxFileName := getVmxFileFromPath(destVmxFilePath)
+	return writeVmx(ctx, c, vmid, vmxContent, vmx)
+}
 
+// cleanVmxStorage removes every disk but the boot disk from the VMX file
+func cleanVmxStorage(ctx context.Context, c *Config, vmid string) error {
+	log.Printf("[cleanStorageFromVmx]\n")
+
+	unlock, err := c.lockGuest(ctx, vmid)
 	if err != nil {
-		log.Printf("[updateVmx_contents] Failed to get VMX file name from ESXi: %s\n", err)
 		return err
 	}
+	defer unlock()
 
-	err = saveVmxStringToDisk(vmxFileName, vmxContent)
-
+	vmxContent, err := readVmxContent(ctx, c, vmid)
 	if err != nil {
+		log.Printf("[updateVmx_contents] Failed get vmx contents: %s\n", err)
 		return err
 	}
+	vmx := parseVmx(vmxContent)
+
+	hw := parseVmxHardware(vmx)
+	hw.removeDisks(func(disk *vmxDisk) bool {
+		return disk.bus == "scsi" && !(disk.controller == 0 && disk.unit == 0)
+	})
+	hw.apply(vmx)
+
+	_, err = writeVmx(ctx, c, vmid, vmxContent, vmx)
+	return err
+}
 
-	err = copyFileToHost(esxiSSHinfo, vmxFileName, destVmxFilePath)
+// vmxRestoreTimeout bounds putting back a vmx file.  It does not use the
+// operation's context, which may be what expired.
+const vmxRestoreTimeout = 2 * time.Minute
 
+// vmxSnapshot is the vmx file of a guest as it was before writeVmx replaced
+// it, so a change ESXi will not run can be undone
+type vmxSnapshot struct {
+	vmid     string
+	path     string
+	contents string
+}
+
+// writeVmx replaces the VMX file of the guest, whose contents were previous,
+// with vmx and has ESXi reload it.  The old file is kept as .vmx.bak and
+// returned as a snapshot.  If ESXi rejects the new file the old one is put
+// back straight away.  The caller holds the guest lock.
+func writeVmx(ctx context.Context, c *Config, vmid string, previous string, vmx *vmxDocument) (*vmxSnapshot, error) {
+	log.Printf("[writeVmx] New guest_name.vmx: %s\n", vmx)
+
+	destVmxFilePath, err := getDestVmxAbsPath(ctx, c, vmid)
 	if err != nil {
-		return err
+		log.Printf("[writeVmx] Failed to get VMX file name from ESXi: %s\n", err)
+		return nil, err
 	}
+	snapshot := &vmxSnapshot{vmid: vmid, path: destVmxFilePath, contents: previous}
 
-	err = deleteVmx(vmxFileName)
-
+	err = c.executor.writeFile(ctx, destVmxFilePath, vmx.String(), true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/reload %s", vmid)
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/reload")
-	return err
+	err = reloadGuest(ctx, c, vmid)
+	if err != nil {
+		return nil, snapshot.put(c, fmt.Errorf("ESXi rejected the new vmx file: %s", err))
+	}
+	return snapshot, nil
 }
 
-// cleanVmxStorage cleans the VMX file storage data
-func cleanVmxStorage(c *Config, vmid string) error {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
-	log.Printf("[cleanStorageFromVmx]\n")
+// restore puts the snapshot back because of cause, and returns cause
+// together with how restoring went.  A nil snapshot returns cause.
+func (s *vmxSnapshot) restore(c *Config, cause error) error {
+	if s == nil {
+		return cause
+	}
 
-	var remoteCmd string
+	ctx, cancel := context.WithTimeout(context.Background(), vmxRestoreTimeout)
+	defer cancel()
 
-	vmxContent, err := readVmxContent(c, vmid)
+	unlock, err := c.lockGuest(ctx, s.vmid)
 	if err != nil {
-		log.Printf("[updateVmx_contents] Failed get vmx contents: %s\n", err)
-		return err
+		return fmt.Errorf("%s, and the previous vmx file was not restored: %s", cause, err)
 	}
+	defer unlock()
 
-	for x := 0; x < 4; x++ {
-		for y := 0; y < 16; y++ {
-			if !(x == 0 && y == 0) {
-				regexReplacement := fmt.Sprintf("scsi%d:%d.*", x, y)
-				re := regexp.MustCompile(regexReplacement)
-				vmxContent = re.ReplaceAllString(vmxContent, "")
-			}
-		}
-	}
+	return s.put(c, cause)
+}
 
-	//
-	//  Write vmx file to esxi host
-	//
-	vmxContent = strings.Replace(vmxContent, "\"", "\\\"", -1)
+// put is restore for callers that hold the guest lock
+func (s *vmxSnapshot) put(c *Config, cause error) error {
+	log.Printf("[vmxSnapshot] Restoring %s: %s\n", s.path, cause)
 
-	destVmxFile, err := getDestVmxAbsPath(c, vmid)
+	ctx, cancel := context.WithTimeout(context.Background(), vmxRestoreTimeout)
+	defer cancel()
 
-	remoteCmd = fmt.Sprintf("echo \"%s\" | grep '[^[:blank:]]' >%s", vmxContent, destVmxFile)
-	vmxContent, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "write guest_name.vmx file")
+	err := c.executor.writeFile(ctx, s.path, s.contents, false)
+	if err != nil {
+		return fmt.Errorf("%s, and the previous vmx file was not restored: %s", cause, err)
+	}
+	err = reloadGuest(ctx, c, s.vmid)
+	if err != nil {
+		return fmt.Errorf("%s, and reloading the restored vmx file failed: %s", cause, err)
+	}
+	return fmt.Errorf("%s; the previous vmx file was restored", cause)
+}
 
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/reload %s", vmid)
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/reload")
+// reloadGuest has ESXi reread the VMX file of the guest.  vim-cmd does not
+// always exit non-zero when hostd refuses the file, so a fault in its
+// output is an error too.
+func reloadGuest(ctx context.Context, c *Config, vmid string) error {
+	remoteCmd := shellCommand("vim-cmd", "vmsvc/reload", vmid)
+	result, err := c.executor.run(ctx, remoteCmd, "vmsvc/reload")
+	if err == nil && strings.Contains(result.stdout, ".fault.") {
+		result.stderr = strings.TrimSpace(result.stdout)
+		err = newRemoteCmdError("vmsvc/reload", result, errors.New("vim-cmd reported a fault"))
+	}
 	return err
 }
 
 // powerOnGuest powers on the guest VM
-func powerOnGuest(c *Config, vmid string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func powerOnGuest(ctx context.Context, c *Config, vmid string) (string, error) {
 	log.Printf("[guestPowerOn]\n")
 
-	if getGuestPowerState(c, vmid) == "on" {
+	if getGuestPowerState(ctx, c, vmid) == "on" {
 		return "", nil
 	}
 
-	remoteCmd := fmt.Sprintf("vim-cmd vmsvc/power.on %s", vmid)
-	stdout, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/power.on")
+	remoteCmd := shellCommand("vim-cmd", "vmsvc/power.on", vmid)
+	result, err := c.executor.run(ctx, remoteCmd, "vmsvc/power.on")
 	time.Sleep(3 * time.Second)
 
-	if getGuestPowerState(c, vmid) == "on" {
-		return stdout, nil
+	if getGuestPowerState(ctx, c, vmid) == "on" {
+		return result.stdout, nil
 	}
 
-	return stdout, err
+	return result.stdout, err
 }
 
 // powerOffGuest powers off the guest VM
-func powerOffGuest(c *Config, vmid string, guestShutdownTimeout int) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func powerOffGuest(ctx context.Context, c *Config, vmid string, guestShutdownTimeout int) (string, error) {
 	log.Printf("[guestPowerOff]\n")
 
-	var remoteCmd, stdout string
+	var remoteCmd string
+	var result remoteCmdResult
+	var err error
 
-	savedpowerstate := getGuestPowerState(c, vmid)
+	savedpowerstate := getGuestPowerState(ctx, c, vmid)
 	if savedpowerstate == "off" {
 		return "", nil
 
 	} else if savedpowerstate == "on" {
 
 		if guestShutdownTimeout != 0 {
-			remoteCmd = fmt.Sprintf("vim-cmd vmsvc/power.shutdown %s", vmid)
-			stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/power.shutdown")
+			remoteCmd = shellCommand("vim-cmd", "vmsvc/power.shutdown", vmid)
+			result, _ = c.executor.run(ctx, remoteCmd, "vmsvc/power.shutdown")
 			time.Sleep(3 * time.Second)
 
 			for i := 0; i < (guestShutdownTimeout / 3); i++ {
-				if getGuestPowerState(c, vmid) == "off" {
-					return stdout, nil
+				if getGuestPowerState(ctx, c, vmid) == "off" {
+					return result.stdout, nil
+				}
+				select {
+				case <-ctx.Done():
+					return result.stdout, newTimeoutError("wait for guest "+vmid+" to shut down", ctx.Err())
+				case <-time.After(3 * time.Second):
 				}
-				time.Sleep(3 * time.Second)
 			}
 		}
 
-		remoteCmd = fmt.Sprintf("vim-cmd vmsvc/power.off %s", vmid)
-		stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/power.off")
+		remoteCmd = shellCommand("vim-cmd", "vmsvc/power.off", vmid)
+		result, err = c.executor.run(ctx, remoteCmd, "vmsvc/power.off")
 		time.Sleep(1 * time.Second)
 
-		return stdout, nil
-
 	} else {
-		remoteCmd = fmt.Sprintf("vim-cmd vmsvc/power.off %s", vmid)
-		stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/power.off")
-		return stdout, nil
+		remoteCmd = shellCommand("vim-cmd", "vmsvc/power.off", vmid)
+		result, err = c.executor.run(ctx, remoteCmd, "vmsvc/power.off")
+	}
+
+	//  power.off fails on a guest that is already off, so only a timeout
+	//  or a refusal is worth reporting.
+	if isRemoteTimeout(err) || isRemotePermissionDenied(err) {
+		return result.stdout, err
 	}
+	return result.stdout, nil
 }
 
 // getGuestPowerState returns whether the guest VM is powered on or off
-func getGuestPowerState(c *Config, vmid string) string {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getGuestPowerState(ctx context.Context, c *Config, vmid string) string {
 	log.Printf("[guestPowerGetState]\n")
 
-	remoteCmd := fmt.Sprintf("vim-cmd vmsvc/power.getstate %s", vmid)
-	stdout, _ := runCommandOnHost(esxiSSHinfo, remoteCmd, "vmsvc/power.getstate")
-	if strings.Contains(stdout, "Unable to find a VM corresponding") {
+	remoteCmd := shellCommand("vim-cmd", "vmsvc/power.getstate", vmid)
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "vmsvc/power.getstate")
+	stdout := result.stdout
+	if isRemoteNotFound(err) || strings.Contains(stdout, "Unable to find a VM corresponding") {
 		return "Unknown"
 	}
 
@@ -469,56 +463,49 @@ func getGuestPowerState(c *Config, vmid string) string {
 }
 
 // getGuestIPAddress gets the guest VM's IP address
-func getGuestIPAddress(c *Config, vmid string, guestStartupTimeout int) string {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getGuestIPAddress(ctx context.Context, c *Config, vmid string, guestStartupTimeout int) string {
 	log.Printf("[guestGetIpAddress]\n")
 
-	var remoteCmd, stdout, ipAddress, ipAddress2 string
+	var guest *vimValue
 	var uptime int
+	var err error
 
 	//  Check if powered off
-	if getGuestPowerState(c, vmid) != "on" {
+	if getGuestPowerState(ctx, c, vmid) != "on" {
 		return ""
 	}
 
 	//
 	//  Check uptime of guest.
 	//
-	uptime = 0
-	for uptime < guestStartupTimeout {
-		//  Primary method to get IP
-		remoteCmd = fmt.Sprintf("vim-cmd vmsvc/get.guest %s 2>/dev/null |grep -A 5 'deviceConfigId = 4000' |tail -1|grep -oE '((1?[0-9][0-9]?|2[0-4][0-9]|25[0-5]).){3}(1?[0-9][0-9]?|2[0-4][0-9]|25[0-5])'", vmid)
-		stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "get ip_address method 1")
-		ipAddress = stdout
-		if ipAddress != "" {
+	for {
+		remoteCmd := shellCommand("vim-cmd", "vmsvc/get.guest", vmid) + " 2>/dev/null"
+		result, _ := c.executor.runReadOnly(ctx, remoteCmd, "get ip_address")
+		guest, _ = parseVimDump(result.stdout)
+		if ipAddress := guestIPAddress(guest, uptime); ipAddress != "" || uptime >= guestStartupTimeout {
 			return ipAddress
 		}
 
 		time.Sleep(3 * time.Second)
 
 		//  Get uptime if above failed.
-		remoteCmd = fmt.Sprintf("vim-cmd vmsvc/get.summary %s 2>/dev/null | grep 'uptimeSeconds ='|sed 's/^.*= //g'|sed s/,//g", vmid)
-		stdout, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "get uptime")
+		uptime, err = getGuestUptime(ctx, c, vmid)
 		if err != nil {
 			return ""
 		}
-		uptime, _ = strconv.Atoi(stdout)
 	}
+}
 
-	//
-	// Alternate method to get IP
-	//
-	remoteCmd = fmt.Sprintf("vim-cmd vmsvc/get.summary %s 2>/dev/null | grep 'uptimeSeconds ='|sed 's/^.*= //g'|sed s/,//g", vmid)
-	stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "get uptime")
-	uptime, _ = strconv.Atoi(stdout)
-	if uptime > 120 {
-		remoteCmd = fmt.Sprintf("vim-cmd vmsvc/get.guest %s 2>/dev/null | grep -m 1 '^   ipAddress = ' | grep -oE '((1?[0-9][0-9]?|2[0-4][0-9]|25[0-5]).){3}(1?[0-9][0-9]?|2[0-4][0-9]|25[0-5])'", vmid)
-		stdout, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "get ip_address method 2")
-		ipAddress2 = stdout
-		if ipAddress2 != "" {
-			return ipAddress2
-		}
+// getGuestUptime returns how many seconds the guest has been running
+func getGuestUptime(ctx context.Context, c *Config, vmid string) (int, error) {
+	remoteCmd := shellCommand("vim-cmd", "vmsvc/get.summary", vmid) + " 2>/dev/null"
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "get uptime")
+	if err != nil {
+		return 0, err
 	}
-
-	return ""
+	summary, err := parseVimDump(result.stdout)
+	if err != nil {
+		return 0, err
+	}
+	return int(summary.get("quickStats", "uptimeSeconds").int()), nil
 }
@@ -0,0 +1,320 @@
+package esxi
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGuestVmx = `config.version = "8"
+virtualHW.version = "13"
+displayName = "web01"
+numvcpus = "1"
+memSize = "512"
+guestOS = "centos-64"
+scsi0.present = "TRUE"
+scsi0:0.present = "TRUE"
+scsi0:0.fileName = "web01.vmdk"
+scsi0:0.deviceType = "scsi-hardDisk"
+scsi0:1.present = "TRUE"
+scsi0:1.fileName = "/vmfs/volumes/ds1/old/old.vmdk"
+scsi0:1.deviceType = "scsi-hardDisk"
+ethernet0.virtualDev = "e1000"
+ethernet0.networkName = "VM Network"
+ethernet0.present = "TRUE"
+`
+
+const testGetAllVms = `Vmid   Name    File                      Guest OS          Version   Annotation
+7      web01   [ds1] web01/web01.vmx     centos64Guest     vmx-13
+`
+
+func testGuestHost(t *testing.T) *fakeExecutor {
+	host := newFakeExecutor(t).
+		on(`^vim-cmd vmsvc/getallvms`, testGetAllVms).
+		on(`^cat /vmfs/volumes/ds1/web01/web01.vmx$`, testGuestVmx)
+	host.files["/vmfs/volumes/ds1/web01/web01.vmx"] = testGuestVmx
+	return host
+}
+
+func TestGetGuestPowerState(t *testing.T) {
+	cases := map[string]string{
+		"Retrieved runtime info\nPowered on":  "on",
+		"Retrieved runtime info\nPowered off": "off",
+		"Retrieved runtime info\nSuspended":   "suspended",
+		"":                                    "Unknown",
+	}
+
+	for stdout, want := range cases {
+		c := testConfig(newFakeExecutor(t).on(`^vim-cmd vmsvc/power.getstate 7$`, stdout))
+		if got := getGuestPowerState(context.Background(), c, "7"); got != want {
+			t.Errorf("%q: got %s, want %s", stdout, got, want)
+		}
+	}
+
+	host := newFakeExecutor(t).onFailure(`power.getstate`, `Unable to find a VM corresponding to "7"`, 1)
+	if got := getGuestPowerState(context.Background(), testConfig(host), "7"); got != "Unknown" {
+		t.Errorf("missing guest: got %s", got)
+	}
+}
+
+func TestPowerOffGuestTimeout(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`^vim-cmd vmsvc/power.getstate 7$`, "Retrieved runtime info\nPowered on").
+		on(`^vim-cmd vmsvc/power.shutdown 7$`, "")
+
+	// The guest ignores the shutdown and the operation times out first
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := powerOffGuest(ctx, testConfig(host), "7", 300)
+	if !isRemoteTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if host.ran(`power.off`) {
+		t.Errorf("guest powered off after the timeout")
+	}
+}
+
+func TestGetGuestVMID(t *testing.T) {
+	host := newFakeExecutor(t).on(`^vim-cmd vmsvc/getallvms`, `Vmid   Name       File                            Guest OS        Version   Annotation
+3      web-old    [ds1] web-old/web-old.vmx       centos64Guest   vmx-13
+4      web.1      [ds1] web.1/web.1.vmx           centos64Guest   vmx-13
+5      db 01      [ds1] db 01/db 01.vmx           centos64Guest   vmx-13
+8      dup        [ds1] dup/dup.vmx               centos64Guest   vmx-13
+9      dup        [ds2] dup/dup.vmx               centos64Guest   vmx-13
+12     app        [ds1] web/web.vmx               centos64Guest   vmx-13    web
+14     web [old] x  [ds1] web-x/web-x.vmx         centos64Guest   vmx-13
+`)
+	c := testConfig(host)
+
+	cases := map[string]string{
+		"web-old":     "3",
+		"web.1":       "4",
+		"db 01":       "5",
+		"app":         "12",
+		"web [old] x": "14",
+		"web":         "",
+		"web.":        "",
+		"web0.1":      "",
+		"db":          "",
+		"WEB-OLD":     "",
+	}
+	for name, want := range cases {
+		if vmid, err := getGuestVMID(context.Background(), c, name); err != nil || vmid != want {
+			t.Errorf("%q: got %q, %v, want %q", name, vmid, err, want)
+		}
+	}
+
+	vmid, err := getGuestVMID(context.Background(), c, "dup")
+	if err == nil || vmid != "" {
+		t.Fatalf("duplicate name: got %q, %v", vmid, err)
+	}
+	if !strings.Contains(err.Error(), "vmids 8, 9") {
+		t.Errorf("error does not list the vmids: %s", err)
+	}
+}
+
+func TestGetDestVmxAbsPath(t *testing.T) {
+	c := testConfig(testGuestHost(t))
+
+	path, err := getDestVmxAbsPath(context.Background(), c, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/vmfs/volumes/ds1/web01/web01.vmx" {
+		t.Errorf("got %s", path)
+	}
+}
+
+func TestUpdateVmx(t *testing.T) {
+	host := testGuestHost(t).on(`^vim-cmd vmsvc/reload 7$`, "")
+	c := testConfig(host)
+
+	var virtualNetworks [10][3]string
+	var virtualDisks [60][2]string
+	virtualDisks[0] = [2]string{"/vmfs/volumes/ds1/data/data.vmdk", "0:2"}
+
+	_, err := updateVmx(context.Background(), c, "7", ethernetsSync, 2048, 2, 0, "", virtualNetworks, virtualDisks, "", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmx, ok := host.files["/vmfs/volumes/ds1/web01/web01.vmx"]
+	if !ok {
+		t.Fatalf("vmx not written: %v", host.files)
+	}
+	if host.files["/vmfs/volumes/ds1/web01/web01.vmx.bak"] != testGuestVmx {
+		t.Errorf("previous vmx not kept as .bak")
+	}
+
+	for _, want := range []string{
+		`memSize = "2048"`,
+		`numvcpus = "2"`,
+		`scsi0:0.fileName = "web01.vmdk"`,
+		`scsi0:2.fileName = "/vmfs/volumes/ds1/data/data.vmdk"`,
+	} {
+		if !strings.Contains(vmx, want) {
+			t.Errorf("vmx missing %s:\n%s", want, vmx)
+		}
+	}
+	if strings.Contains(vmx, "old.vmdk") {
+		t.Errorf("unmanaged disk not removed:\n%s", vmx)
+	}
+
+	if !host.ran(`vmsvc/reload 7`) {
+		t.Errorf("guest not reloaded")
+	}
+}
+
+func TestUpdateVmxGuestGone(t *testing.T) {
+	host := newFakeExecutor(t).on(`^vim-cmd vmsvc/getallvms`, "Vmid   Name    File    Guest OS    Version   Annotation\n")
+
+	var virtualNetworks [10][3]string
+	var virtualDisks [60][2]string
+	_, err := updateVmx(context.Background(), testConfig(host), "7", ethernetsSync, 1024, 0, 0, "", virtualNetworks, virtualDisks, "", nil, nil, nil)
+	if err != nil {
+		t.Errorf("expected missing vmx to be ignored, got %s", err)
+	}
+	if len(host.files) != 0 {
+		t.Errorf("nothing should be written: %v", host.files)
+	}
+}
+
+func TestUpdateVmxGuestinfoKeepsOrder(t *testing.T) {
+	host := testGuestHost(t).on(`^vim-cmd vmsvc/reload 7$`, "")
+	c := testConfig(host)
+
+	var virtualNetworks [10][3]string
+	var virtualDisks [60][2]string
+	virtualNetworks[0] = [3]string{"VM Network", "", "e1000"}
+	guestinfo := map[string]interface{}{"userdata": "dXNlcmRhdGE=", "metadata": "bWV0YQ=="}
+
+	_, err := updateVmx(context.Background(), c, "7", ethernetsSync, 0, 0, 0, "", virtualNetworks, virtualDisks, "", guestinfo, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vmx := host.files["/vmfs/volumes/ds1/web01/web01.vmx"]
+	unchanged := testGuestVmx[:strings.Index(testGuestVmx, "scsi0:1.")]
+	if !strings.HasPrefix(vmx, unchanged) {
+		t.Errorf("settings were reordered:\n%s", vmx)
+	}
+	if !strings.Contains(vmx, "guestinfo.metadata = \"bWV0YQ==\"\nguestinfo.userdata = \"dXNlcmRhdGE=\"\n") {
+		t.Errorf("guestinfo not added in key order:\n%s", vmx)
+	}
+}
+
+func TestUpdateVmxRestoresRejectedVmx(t *testing.T) {
+	host := testGuestHost(t).
+		onNextFailure(`^vim-cmd vmsvc/reload 7$`, "(vim.fault.InvalidState) {\n   msg = \"Invalid configuration for device '0'.\"\n}", 1).
+		on(`^vim-cmd vmsvc/reload 7$`, "")
+	c := testConfig(host)
+
+	var virtualNetworks [10][3]string
+	var virtualDisks [60][2]string
+	_, err := updateVmx(context.Background(), c, "7", ethernetsSync, 2048, 0, 0, "", virtualNetworks, virtualDisks, "", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Invalid configuration for device '0'.") ||
+		!strings.Contains(err.Error(), "previous vmx file was restored") {
+		t.Fatalf("err = %v", err)
+	}
+
+	if host.files["/vmfs/volumes/ds1/web01/web01.vmx"] != testGuestVmx {
+		t.Errorf("previous vmx not restored:\n%s", host.files["/vmfs/volumes/ds1/web01/web01.vmx"])
+	}
+	if n := host.count(`vmsvc/reload 7`); n != 2 {
+		t.Errorf("reloaded %d times, want 2", n)
+	}
+}
+
+func TestReloadGuestFault(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`^vim-cmd vmsvc/reload 7$`, "(vmodl.fault.SystemError) {\n   reason = \"Invalid fault\"\n   msg = \"\"\n}\n")
+
+	err := reloadGuest(context.Background(), testConfig(host), "7")
+	if err == nil || !strings.Contains(err.Error(), "vmodl.fault.SystemError") {
+		t.Errorf("fault printed with exit status 0 not reported: %v", err)
+	}
+}
+
+func TestFakeHostGuestPowerOnRestoresVmx(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name": "web01",
+		"disk_store": "ds1",
+		"memsize":    "1024",
+		"power":      "on",
+	}
+
+	d := testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	vm := host.vms[1]
+
+	raw["memsize"] = "65536"
+	d = testResourceData(t, r, d.Id(), raw)
+	err := r.Update(d, c)
+	if err == nil || !strings.Contains(err.Error(), "Memory resources in the parent resource pool are insufficient") {
+		t.Fatalf("update: %v", err)
+	}
+	if vmx := host.vmx(vm); vmx["memSize"] != "1024" {
+		t.Errorf("vmx not restored, memSize %s", vmx["memSize"])
+	}
+}
+
+func TestFakeHostGuestAdoptPowerOnRestoresVmx(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name": "web01",
+		"disk_store": "ds1",
+		"memsize":    "1024",
+		"power":      "off",
+	}
+	if err := r.Create(testResourceData(t, r, "", raw), c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	vm := host.vms[1]
+	before, _ := host.readFile(vm.vmxPath)
+
+	raw["memsize"] = "65536"
+	raw["power"] = "on"
+	raw["adopt_existing"] = true
+	err := r.Create(testResourceData(t, r, "", raw), c)
+	if err == nil || !strings.Contains(err.Error(), "previous vmx file was restored") {
+		t.Fatalf("adopt: %v", err)
+	}
+	if after, _ := host.readFile(vm.vmxPath); string(after) != string(before) {
+		t.Errorf("vmx not restored byte for byte:\n%q\nwant\n%q", after, before)
+	}
+}
+
+func TestFakeHostGuestSimilarName(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+
+	old := testResourceData(t, r, "", map[string]interface{}{"guest_name": "web-old", "disk_store": "ds1", "power": "off"})
+	if err := r.Create(old, c); err != nil {
+		t.Fatalf("create web-old: %s", err)
+	}
+	bracketed := testResourceData(t, r, "", map[string]interface{}{"guest_name": "web [old] x", "disk_store": "ds1", "power": "off"})
+	if err := r.Create(bracketed, c); err != nil {
+		t.Fatalf("create web [old] x: %s", err)
+	}
+	if bracketed.Id() != "2" || bracketed.Get("guest_name").(string) != "web [old] x" {
+		t.Errorf("web [old] x read back as %s %q", bracketed.Id(), bracketed.Get("guest_name"))
+	}
+
+	// A guest whose name contains the new name is not adopted.
+	d := testResourceData(t, r, "", map[string]interface{}{"guest_name": "web", "disk_store": "ds1", "power": "off", "memsize": "2048"})
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create web: %s", err)
+	}
+	if d.Id() != "3" || len(host.vms) != 3 {
+		t.Fatalf("web adopted guest %s", d.Id())
+	}
+	if vmx := host.vmx(host.vms[1]); vmx["displayName"] != "web-old" || vmx["memSize"] == "2048" {
+		t.Errorf("web-old reconfigured: %v", vmx)
+	}
+}
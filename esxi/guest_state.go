@@ -0,0 +1,311 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GuestState is what the provider reads about a guest.  It is gathered by
+// a single script on the host, see readGuestState.
+type GuestState struct {
+	guestName        string
+	diskStore        string
+	resourcePoolName string
+	bootDiskSize     string
+	bootDiskType     string
+	memsize          string
+	numvcpus         string
+	virthwver        string
+	guestos          string
+	notes            string
+	power            string
+	ipAddress        string
+	uptime           int
+	networks         []guestNetwork
+	disks            []guestDisk
+	guestinfo        map[string]interface{}
+	extraConfig      map[string]interface{}
+}
+
+// guestNetwork is a network interface of a guest, in the order of its
+// ethernet index
+type guestNetwork struct {
+	virtualNetwork string
+	macAddress     string
+	nicType        string
+}
+
+// guestDisk is a virtual disk attached to a guest, other than the boot disk
+type guestDisk struct {
+	virtualDiskID string
+	slot          string
+}
+
+// guestStateMarker starts the line before each section of the output of
+// the guest state script
+const guestStateMarker = "@@esxi-guest-state@@ "
+
+// ipv4Re matches an IPv4 address
+var ipv4Re = regexp.MustCompile(`^((1?[0-9][0-9]?|2[0-4][0-9]|25[0-5])\.){3}(1?[0-9][0-9]?|2[0-4][0-9]|25[0-5])$`)
+
+// guestStateScript returns the script that prints everything about guest
+// vmid in sections: the summary, the vmx file at vmxPath, the guest info
+// and the devices.  It fails only if the guest summary cannot be read.
+func guestStateScript(vmid string, vmxPath string) string {
+	//  A file without a final newline must not swallow the next marker
+	section := func(name string) string {
+		return "echo; " + shellCommand("echo", guestStateMarker+name)
+	}
+
+	return strings.Join([]string{
+		section("summary"),
+		shellCommand("vim-cmd", "vmsvc/get.summary", vmid) + " 2>&1 || exit 1",
+		section("vmx"),
+		shellCommand("cat", vmxPath) + " 2>/dev/null",
+		section("guest"),
+		shellCommand("vim-cmd", "vmsvc/get.guest", vmid) + " 2>/dev/null",
+		section("devices"),
+		shellCommand("vim-cmd", "vmsvc/device.getdevices", vmid) + " 2>/dev/null",
+		"true",
+	}, "; ")
+}
+
+// readGuestState reads the state of guest vmid in one round trip, plus the
+// host inventory if it is not cached yet.  The vmx file is found through
+// the inventory.  Only the vmx settings in
+// extraConfigKeys are read into extraConfig.  A guest that does not exist
+// returns nil.
+func readGuestState(ctx context.Context, c *Config, vmid string, guestStartupTimeout int, extraConfigKeys []string) (*GuestState, error) {
+	log.Println("[guestREAD]")
+
+	vmxPath, err := c.guestVmxPath(ctx, vmid)
+	if isRemoteNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.executor.runReadOnly(ctx, guestStateScript(vmid, vmxPath), "get guest state")
+	if isRemoteNotFound(err) || strings.Contains(result.stdout, "Unable to find a VM corresponding") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := parseGuestState(vmid, result.stdout, extraConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	state.resourcePoolName, err = c.guestResourcePoolName(ctx, vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	//  The guest is still booting, wait for its IP address
+	if state.power == "on" && state.ipAddress == "" && state.uptime < guestStartupTimeout {
+		state.ipAddress = getGuestIPAddress(ctx, c, vmid, guestStartupTimeout)
+	}
+	log.Printf("[guestREAD] %s power: %s ip_address: %s\n", state.guestName, state.power, state.ipAddress)
+
+	return state, nil
+}
+
+// parseGuestState parses the output of guestStateScript
+func parseGuestState(vmid string, output string, extraConfigKeys []string) (*GuestState, error) {
+	sections := make(map[string]string)
+	name := ""
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.HasPrefix(line, guestStateMarker) {
+			name = strings.TrimSpace(strings.TrimPrefix(line, guestStateMarker))
+			continue
+		}
+		sections[name] += line
+	}
+
+	summary, err := parseVimDump(sections["summary"])
+	if err != nil || summary.typeName != "vim.vm.Summary" {
+		return nil, fmt.Errorf("Failed to read guest %s: unexpected summary %q", vmid, sections["summary"])
+	}
+
+	state := &GuestState{
+		power:       "Unknown",
+		guestinfo:   make(map[string]interface{}),
+		extraConfig: make(map[string]interface{}),
+	}
+
+	//  Summary
+	state.guestName = summary.get("config", "name").str()
+	state.diskStore, _ = splitDatastorePath(summary.get("config", "vmPathName").str())
+	switch summary.get("runtime", "powerState").str() {
+	case "poweredOn":
+		state.power = "on"
+	case "poweredOff":
+		state.power = "off"
+	case "suspended":
+		state.power = "suspended"
+	}
+	state.uptime = int(summary.get("quickStats", "uptimeSeconds").int())
+
+	//  vmx settings.  Values come back unescaped.
+	vmx := parseVmx(sections["vmx"])
+	state.memsize, _ = vmx.get("memSize")
+	state.numvcpus, _ = vmx.get("numvcpus")
+	state.virthwver, _ = vmx.get("virtualHW.version")
+	state.guestos, _ = vmx.get("guestOS")
+	state.notes, _ = vmx.get("annotation")
+	for _, key := range vmx.keys() {
+		if strings.HasPrefix(key, "numa.autosize.vcpu.") {
+			state.numvcpus, _ = vmx.get(key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "guestinfo.") {
+			state.guestinfo[key[len("guestinfo."):]], _ = vmx.get(key)
+		}
+	}
+
+	// A setting missing from the vmx is drift
+	for _, key := range extraConfigKeys {
+		if value, ok := vmx.get(key); ok {
+			state.extraConfig[key] = value
+		}
+	}
+
+	hw := parseVmxHardware(vmx)
+	for _, disk := range hw.disks {
+		if disk.bus != "scsi" || (disk.controller == 0 && disk.unit == 0) {
+			// Skip boot disk, and disks terraform does not manage
+			continue
+		}
+		state.disks = append(state.disks, guestDisk{
+			virtualDiskID: disk.fileName,
+			slot:          fmt.Sprintf("%d:%d", disk.controller, disk.unit),
+		})
+	}
+
+	ethernets := append([]*vmxEthernet(nil), hw.ethernets...)
+	sort.SliceStable(ethernets, func(i, j int) bool {
+		return ethernets[i].index < ethernets[j].index
+	})
+	for _, ethernet := range ethernets {
+		network := guestNetwork{
+			virtualNetwork: ethernet.networkName,
+			macAddress:     ethernet.address,
+			nicType:        ethernet.virtualDev,
+		}
+		if strings.EqualFold(ethernet.addressType, "generated") {
+			network.macAddress = ethernet.generatedAddress
+		}
+		if network.virtualNetwork != "" && ethernet.index < 10 {
+			state.networks = append(state.networks, network)
+		}
+	}
+
+	//  IP address (needs vmware tools)
+	if state.power == "on" {
+		if guest, err := parseVimDump(sections["guest"]); err == nil {
+			state.ipAddress = guestIPAddress(guest, state.uptime)
+		}
+	}
+
+	//  Boot disk
+	state.bootDiskSize, state.bootDiskType = "0", "Unknown"
+	if devices, err := parseVimDump(sections["devices"]); err == nil {
+		if disk := guestBootDisk(devices); disk != nil {
+			state.bootDiskSize = strconv.FormatInt(disk.sizeGB, 10)
+			state.bootDiskType = disk.diskType
+		}
+	}
+
+	return state, nil
+}
+
+// guestIPAddress returns the IP address of the first network interface
+// from the output of vmsvc/get.guest.  Once the guest has been up for two
+// minutes any IP address it reports will do.
+func guestIPAddress(guest *vimValue, uptime int) string {
+	//  Primary method, the address of the first nic
+	for _, nic := range guest.get("net").list() {
+		if nic.get("deviceConfigId").int() != 4000 {
+			continue
+		}
+		for _, address := range nic.get("ipConfig", "ipAddress").list() {
+			if ip := address.get("ipAddress").str(); ipv4Re.MatchString(ip) {
+				return ip
+			}
+		}
+		for _, address := range nic.get("ipAddress").list() {
+			if ip := address.str(); ipv4Re.MatchString(ip) {
+				return ip
+			}
+		}
+	}
+
+	//  Alternate method
+	if ip := guest.get("ipAddress").str(); uptime > 120 && ipv4Re.MatchString(ip) {
+		return ip
+	}
+	return ""
+}
+
+// guestDiskInfo is a virtual disk as vmsvc/device.getdevices shows it
+type guestDiskInfo struct {
+	path     string
+	sizeGB   int64
+	diskType string
+}
+
+// guestBootDisk returns the boot disk, device key 2000, from the output of
+// vmsvc/device.getdevices, or nil if the guest has none
+func guestBootDisk(devices *vimValue) *guestDiskInfo {
+	for _, device := range devices.get("device").list() {
+		if device.get("key").int() != 2000 {
+			continue
+		}
+
+		backing := device.get("backing")
+		datastore, file := splitDatastorePath(backing.get("fileName").str())
+		disk := &guestDiskInfo{
+			path:     "/vmfs/volumes/" + datastore + "/" + file,
+			diskType: "Unknown",
+		}
+
+		size := device.get("capacityInBytes").int()
+		if size == 0 {
+			size = device.get("capacityInKB").int() * 1024
+		}
+		disk.sizeGB = size / 1024 / 1024 / 1024
+
+		if strings.HasSuffix(backing.typeName, "FlatVer2BackingInfo") {
+			switch {
+			case backing.get("thinProvisioned").bool():
+				disk.diskType = "thin"
+			case backing.get("eagerlyScrub").bool():
+				disk.diskType = "eagerzeroedthick"
+			default:
+				disk.diskType = "zeroedthick"
+			}
+		}
+		return disk
+	}
+	return nil
+}
+
+// splitDatastorePath splits a datastore path such as "[ds1] web01/web01.vmx"
+// into the datastore and the path in it
+func splitDatastorePath(datastorePath string) (string, string) {
+	if !strings.HasPrefix(datastorePath, "[") {
+		return "", datastorePath
+	}
+	end := strings.Index(datastorePath, "] ")
+	if end < 0 {
+		return "", datastorePath
+	}
+	return datastorePath[1:end], datastorePath[end+2:]
+}
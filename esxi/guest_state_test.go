@@ -0,0 +1,209 @@
+package esxi
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testGuestStateOutput = `
+@@esxi-guest-state@@ summary
+Listsummary:
+(vim.vm.Summary) {
+   vm = 'vim.VirtualMachine:7',
+   runtime = (vim.vm.RuntimeInfo) {
+      powerState = "poweredOn",
+   },
+   config = (vim.vm.Summary.ConfigSummary) {
+      name = "db01",
+      vmPathName = "[ssd 1] db01/db01.vmx",
+   },
+   quickStats = (vim.vm.Summary.QuickStats) {
+      uptimeSeconds = 3600,
+   },
+}
+
+@@esxi-guest-state@@ vmx
+virtualHW.version = "13"
+displayName = "db01"
+numvcpus = "2"
+numa.autosize.vcpu.maxPerVirtualNode = "4"
+memSize = "4096"
+guestOS = "ubuntu-64"
+annotation = "two|0Alines"
+vhv.enable = "TRUE"
+scsi0:0.present = "TRUE"
+scsi0:0.fileName = "db01.vmdk"
+scsi0:1.present = "TRUE"
+scsi0:1.fileName = "/vmfs/volumes/ssd 1/data/data.vmdk"
+sata0:0.present = "TRUE"
+sata0:0.fileName = "/vmfs/volumes/ssd 1/data/other.vmdk"
+ethernet1.present = "TRUE"
+ethernet1.networkName = "Backend"
+ethernet1.virtualDev = "e1000"
+ethernet1.addressType = "static"
+ethernet1.address = "00:50:56:01:02:03"
+ethernet0.present = "TRUE"
+ethernet0.networkName = "VM Network"
+ethernet0.virtualDev = "vmxnet3"
+ethernet0.addressType = "generated"
+ethernet0.generatedAddress = "00:0c:29:27:b4:13"
+guestinfo.hostname = "db01"
+
+@@esxi-guest-state@@ guest
+Guest information:
+
+(vim.vm.GuestInfo) {
+   ipAddress = "192.0.2.9",
+   net = (vim.vm.GuestInfo.NicInfo) [
+      (vim.vm.GuestInfo.NicInfo) {
+         network = "VM Network",
+         deviceConfigId = 4000,
+         dnsConfig = (vim.net.DnsConfigInfo) null,
+         ipConfig = (vim.net.IpConfigInfo) {
+            ipAddress = (vim.net.IpConfigInfo.IpAddress) [
+               (vim.net.IpConfigInfo.IpAddress) {
+                  ipAddress = "192.0.2.7",
+               }
+            ],
+         },
+      }
+   ],
+}
+
+@@esxi-guest-state@@ devices
+(vim.vm.VirtualHardware) {
+   numCPU = 2,
+   device = (vim.vm.device.VirtualDevice) [
+      (vim.vm.device.VirtualLsiLogicController) {
+         key = 1000,
+         busNumber = 0,
+         device = (int) [
+            2000,
+            2001
+         ],
+      },
+      (vim.vm.device.VirtualDisk) {
+         key = 2000,
+         backing = (vim.vm.device.VirtualDisk.FlatVer2BackingInfo) {
+            fileName = "[ssd 1] db01/db01.vmdk",
+            thinProvisioned = false,
+            eagerlyScrub = <unset>,
+         },
+         controllerKey = 1000,
+         unitNumber = 0,
+         capacityInKB = 41943040,
+         capacityInBytes = 42949672960,
+      },
+   ],
+}
+`
+
+func TestParseGuestState(t *testing.T) {
+	state, err := parseGuestState("7", testGuestStateOutput, []string{"vhv.enable", "svga.autodetect"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.guestName != "db01" || state.diskStore != "ssd 1" || state.power != "on" || state.uptime != 3600 {
+		t.Errorf("summary: %+v", state)
+	}
+	if state.memsize != "4096" || state.numvcpus != "4" || state.virthwver != "13" ||
+		state.guestos != "ubuntu-64" || state.notes != "two\nlines" {
+		t.Errorf("vmx: %+v", state)
+	}
+	if state.ipAddress != "192.0.2.7" {
+		t.Errorf("ip address: %s", state.ipAddress)
+	}
+	if state.bootDiskSize != "40" || state.bootDiskType != "zeroedthick" {
+		t.Errorf("boot disk: %s %s", state.bootDiskSize, state.bootDiskType)
+	}
+
+	if !reflect.DeepEqual(state.guestinfo, map[string]interface{}{"hostname": "db01"}) {
+		t.Errorf("guestinfo: %v", state.guestinfo)
+	}
+	if !reflect.DeepEqual(state.extraConfig, map[string]interface{}{"vhv.enable": "TRUE"}) {
+		t.Errorf("extra_config: %v", state.extraConfig)
+	}
+
+	wantNetworks := []guestNetwork{
+		{virtualNetwork: "VM Network", macAddress: "00:0c:29:27:b4:13", nicType: "vmxnet3"},
+		{virtualNetwork: "Backend", macAddress: "00:50:56:01:02:03", nicType: "e1000"},
+	}
+	if !reflect.DeepEqual(state.networks, wantNetworks) {
+		t.Errorf("networks: %+v", state.networks)
+	}
+	wantDisks := []guestDisk{{virtualDiskID: "/vmfs/volumes/ssd 1/data/data.vmdk", slot: "0:1"}}
+	if !reflect.DeepEqual(state.disks, wantDisks) {
+		t.Errorf("disks: %+v", state.disks)
+	}
+}
+
+func TestParseGuestStateBadSummary(t *testing.T) {
+	if _, err := parseGuestState("7", "@@esxi-guest-state@@ summary\nvim-cmd: not found\n", nil); err == nil {
+		t.Error("expected an error for output without a summary")
+	}
+}
+
+func TestGuestIPAddress(t *testing.T) {
+	guest, err := parseVimDump(`Guest information:
+
+(vim.vm.GuestInfo) {
+   ipAddress = "192.0.2.9",
+   net = (vim.vm.GuestInfo.NicInfo) [
+      (vim.vm.GuestInfo.NicInfo) {
+         network = "VM Network",
+         ipAddress = (string) [
+            "fe80::250:56ff:fe01:203",
+            "192.0.2.8"
+         ],
+         deviceConfigId = 4000,
+         ipConfig = (vim.net.IpConfigInfo) null,
+      }
+   ],
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := guestIPAddress(guest, 60); ip != "192.0.2.8" {
+		t.Errorf("nic address list: got %s", ip)
+	}
+
+	guest.get("net").items = nil
+	if ip := guestIPAddress(guest, 60); ip != "" {
+		t.Errorf("booting guest: got %s, want no address", ip)
+	}
+	if ip := guestIPAddress(guest, 600); ip != "192.0.2.9" {
+		t.Errorf("running guest: got %s", ip)
+	}
+}
+
+func TestHostdPools(t *testing.T) {
+	pools, err := parseHostdPools(`<ConfigRoot>
+  <resourcePool id="0000">
+    <name>parent</name>
+    <objID>pool1</objID>
+    <path>host/user/pool1</path>
+  </resourcePool>
+  <vm id="0001">
+    <objID>3</objID>
+    <resourcePool>pool1</resourcePool>
+  </vm>
+  <vm id="0002">
+    <objID>4</objID>
+    <resourcePool>ha-root-pool</resourcePool>
+  </vm>
+</ConfigRoot>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for vmid, want := range map[string]string{"3": "parent", "4": "/", "5": ""} {
+		if got := pools.poolName(pools.guestPool(vmid)); got != want {
+			t.Errorf("guest %s: got pool %q, want %q", vmid, got, want)
+		}
+	}
+
+	if _, err := parseHostdPools("<ConfigRoot>"); err == nil {
+		t.Error("expected an error for truncated pools.xml")
+	}
+}
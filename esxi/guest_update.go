@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -12,6 +13,8 @@ import (
 // updateGuestResource updates the guest resource
 func updateGuestResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutUpdate))
+	defer cancel()
 	log.Printf("[resourceGUESTUpdate]\n")
 
 	var virtualNetworks [10][3]string
@@ -30,10 +33,11 @@ func updateGuestResource(d *schema.ResourceData, m interface{}) error {
 	lanAdaptersCount := d.Get("network_interfaces.#").(int)
 	power := d.Get("power").(string)
 
-	guestinfo, ok := d.Get("guestinfo").(map[string]interface{})
-	if !ok {
-		return errors.New("guestinfo is wrong type")
+	guestinfo, err := guestinfoFromResource(d)
+	if err != nil {
+		return err
 	}
+	extraConfig, removedExtraConfig := extraConfigFromResource(d)
 
 	if lanAdaptersCount > 10 {
 		lanAdaptersCount = 10
@@ -79,9 +83,9 @@ func updateGuestResource(d *schema.ResourceData, m interface{}) error {
 	//
 	//   Power off guest if it's powered on.
 	//
-	currentpowerstate := getGuestPowerState(c, vmid)
+	currentpowerstate := getGuestPowerState(ctx, c, vmid)
 	if currentpowerstate == "on" || currentpowerstate == "suspended" {
-		_, err = powerOffGuest(c, vmid, guestShutdownTimeout)
+		_, err = powerOffGuest(ctx, c, vmid, guestShutdownTimeout)
 		if err != nil {
 			return err
 		}
@@ -93,28 +97,28 @@ func updateGuestResource(d *schema.ResourceData, m interface{}) error {
 	imemsize, _ := strconv.Atoi(memsize)
 	inumvcpus, _ := strconv.Atoi(numvcpus)
 	ivirthwver, _ := strconv.Atoi(virthwver)
-	err = updateVmx(c, vmid, false, imemsize, inumvcpus, ivirthwver, guestos, virtualNetworks, virtualDisks, notes, guestinfo)
+	snapshot, err := updateVmx(ctx, c, vmid, ethernetsSync, imemsize, inumvcpus, ivirthwver, guestos, virtualNetworks, virtualDisks, notes, guestinfo, extraConfig, removedExtraConfig)
 	if err != nil {
 		fmt.Println("Failed to update VMX file.")
-		return errors.New("Failed to update VMX file")
+		return fmt.Errorf("Failed to update VMX file: %s", err)
 	}
 
 	//
 	//  Grow boot disk to boot_disk_size
 	//
-	bootDiskPath, _ := getBootDiskPath(c, vmid)
+	bootDiskPath, _ := getBootDiskPath(ctx, c, vmid)
 
-	err = growVirtualDisk(c, bootDiskPath, bootDiskSize)
+	err = growVirtualDisk(ctx, c, bootDiskPath, bootDiskSize)
 	if err != nil {
 		return errors.New("Failed to grow boot disk")
 	}
 
 	//  power on
 	if power == "on" {
-		_, err = powerOnGuest(c, vmid)
+		_, err = powerOnGuest(ctx, c, vmid)
 		if err != nil {
 			fmt.Println("Failed to power on.")
-			return errors.New("Failed to power on")
+			return snapshot.restore(c, fmt.Errorf("Failed to power on: %s", err))
 		}
 	}
 
@@ -1,11 +1,13 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -40,10 +42,149 @@ func Provider() terraform.ResourceProvider {
 			},
 			"esxi_password": &schema.Schema{
 				Type:        schema.TypeString,
-				Required:    true,
-				DefaultFunc: schema.EnvDefaultFunc("esxi_password", "unset"),
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_password", ""),
 				Description: "esxi ssh password.",
 			},
+			"esxi_private_key": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_private_key", ""),
+				Description: "esxi ssh private key, inline PEM or path to a key file.",
+			},
+			"esxi_private_key_passphrase": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_private_key_passphrase", ""),
+				Description: "Passphrase for esxi_private_key.",
+			},
+			"esxi_use_agent": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_use_agent", false),
+				Description: "Authenticate with the ssh-agent on SSH_AUTH_SOCK.",
+			},
+			"esxi_known_hosts_file": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_known_hosts_file", ""),
+				Description: "known_hosts file used to verify the esxi host key.",
+			},
+			"esxi_host_key_fingerprint": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_host_key_fingerprint", ""),
+				Description: "Pinned SHA256 fingerprint of the esxi host key.",
+			},
+			"esxi_insecure_ignore_host_key": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_insecure_ignore_host_key", false),
+				Description: "Skip esxi host key verification.  Insecure.",
+			},
+			"esxi_retry_max_attempts": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("esxi_retry_max_attempts", 10),
+				Description:  "Attempts made to connect, or to run a read-only command, before giving up.",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"esxi_retry_initial_interval": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_retry_initial_interval", "1s"),
+				Description: "Delay before the first retry.  Doubles on every retry.",
+			},
+			"esxi_retry_max_interval": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("esxi_retry_max_interval", "30s"),
+				Description: "Longest delay between retries.",
+			},
+			"esxi_retry_on": &schema.Schema{
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Error classes to retry: transport, host_busy, not_found, permission_denied.  Default transport and host_busy.",
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringInSlice([]string{"transport", "host_busy", "not_found", "permission_denied"}, false),
+				},
+			},
+			"esxi_max_sessions": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("esxi_max_sessions", 8),
+				Description:  "Most SSH sessions open to the esxi host at once.",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"bastion": &schema.Schema{
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "SSH jump host used to reach the esxi host.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"host": &schema.Schema{
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Bastion hostname or IP address.",
+						},
+						"port": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "22",
+							Description: "Bastion ssh port.",
+						},
+						"user": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "root",
+							Description: "Bastion ssh username.",
+						},
+						"password": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Bastion ssh password.",
+						},
+						"private_key": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Bastion ssh private key, inline PEM or path to a key file.",
+						},
+						"private_key_passphrase": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Passphrase for private_key.",
+						},
+						"use_agent": &schema.Schema{
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Authenticate to the bastion with the ssh-agent on SSH_AUTH_SOCK.",
+						},
+						"known_hosts_file": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "known_hosts file used to verify the bastion host key.",
+						},
+						"host_key_fingerprint": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Pinned SHA256 fingerprint of the bastion host key.",
+						},
+						"insecure_ignore_host_key": &schema.Schema{
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Skip bastion host key verification.  Insecure.",
+						},
+					},
+				},
+			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
 			"esxi_guest":         buildGuestResourceSchema(),
@@ -61,9 +202,63 @@ func ConfigureProvider(d *schema.ResourceData) (interface{}, error) {
 		esxiHostPort: d.Get("esxi_hostport").(string),
 		esxiUserName: d.Get("esxi_username").(string),
 		esxiPassword: d.Get("esxi_password").(string),
+
+		esxiPrivateKey:           d.Get("esxi_private_key").(string),
+		esxiPrivateKeyPassphrase: d.Get("esxi_private_key_passphrase").(string),
+		esxiUseAgent:             d.Get("esxi_use_agent").(bool),
+
+		esxiKnownHostsFile:        d.Get("esxi_known_hosts_file").(string),
+		esxiHostKeyFingerprint:    d.Get("esxi_host_key_fingerprint").(string),
+		esxiInsecureIgnoreHostKey: d.Get("esxi_insecure_ignore_host_key").(bool),
+	}
+
+	var retryOn []string
+	for _, v := range d.Get("esxi_retry_on").([]interface{}) {
+		retryOn = append(retryOn, v.(string))
+	}
+
+	retryPolicy, err := newRetryPolicy(d.Get("esxi_retry_max_attempts").(int),
+		d.Get("esxi_retry_initial_interval").(string), d.Get("esxi_retry_max_interval").(string), retryOn)
+	if err != nil {
+		return nil, err
+	}
+	config.retryPolicy = retryPolicy
+	config.maxSessions = d.Get("esxi_max_sessions").(int)
+
+	if bastions := d.Get("bastion").([]interface{}); len(bastions) > 0 && bastions[0] != nil {
+		bastion := bastions[0].(map[string]interface{})
+		config.esxiBastion = &SSHConnectionSettings{
+			host:                  bastion["host"].(string),
+			port:                  bastion["port"].(string),
+			user:                  bastion["user"].(string),
+			pass:                  bastion["password"].(string),
+			privateKey:            bastion["private_key"].(string),
+			privateKeyPassphrase:  bastion["private_key_passphrase"].(string),
+			useAgent:              bastion["use_agent"].(bool),
+			knownHostsFile:        bastion["known_hosts_file"].(string),
+			hostKeyFingerprint:    bastion["host_key_fingerprint"].(string),
+			insecureIgnoreHostKey: bastion["insecure_ignore_host_key"].(bool),
+			retry:                 retryPolicy,
+			isBastion:             true,
+		}
+	}
+
+	installLogRedactor()
+	registerSecret(config.esxiPassword)
+	registerSecret(config.esxiPrivateKeyPassphrase)
+	if config.esxiBastion != nil {
+		registerSecret(config.esxiBastion.pass)
+		registerSecret(config.esxiBastion.privateKeyPassphrase)
+	}
+
+	sshPool, err := newSSHClientPool(config.sshConnectionSettings())
+	if err != nil {
+		return nil, err
 	}
+	config.sshPool = sshPool
+	config.executor = newSSHExecutor(config.sshConnectionSettings())
 
-	if err := config.validateEsxiCredentials(); err != nil {
+	if err := config.validateEsxiCredentials(context.Background()); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,63 @@
+package esxi
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"golang.org/x/crypto/ssh"
+)
+
+//
+//  Acceptance tests run with resource.Test against the fake ESXi host in
+//  esxi_fakehost_test.go, so no hypervisor is needed:
+//
+//    TF_ACC=1 go test -v ./esxi
+//
+
+func TestProvider(t *testing.T) {
+	if err := Provider().(*schema.Provider).InternalValidate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// testAccHost is a fake ESXi host serving one acceptance test
+type testAccHost struct {
+	host   *fakeESXiHost
+	server *fakeSSHServer
+}
+
+// testAccStartHost starts a fake host with datastore ds1
+func testAccStartHost(t *testing.T) *testAccHost {
+	host := newFakeESXiHost("ds1")
+	return &testAccHost{
+		host:   host,
+		server: startFakeSSHServer(t, host),
+	}
+}
+
+// providers returns a fresh provider for each test case
+func (h *testAccHost) providers() map[string]terraform.ResourceProvider {
+	return map[string]terraform.ResourceProvider{
+		"esxi": Provider(),
+	}
+}
+
+// config prefixes a configuration with the provider block for the host
+func (h *testAccHost) config(resources string) string {
+	host, port, _ := net.SplitHostPort(h.server.listener.Addr().String())
+
+	return fmt.Sprintf(`
+provider "esxi" {
+  esxi_hostname               = "%s"
+  esxi_hostport               = "%s"
+  esxi_username               = "%s"
+  esxi_password               = "%s"
+  esxi_host_key_fingerprint   = "%s"
+  esxi_retry_initial_interval = "10ms"
+  esxi_retry_max_interval     = "100ms"
+}
+%s`, host, port, fakeSSHUser, fakeSSHPassword, ssh.FingerprintSHA256(h.server.hostKey), resources)
+}
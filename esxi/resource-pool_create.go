@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -11,7 +12,8 @@ import (
 
 func createResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutCreate))
+	defer cancel()
 	log.Println("[resourceRESOURCEPOOLCreate]")
 
 	var remoteCmd string
@@ -42,8 +44,14 @@ func createResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 		resourcePoolName = resourcePoolName[i+1:]
 	}
 
+	unlock, err := c.lockResourcePools(ctx, resourcePoolName, parentPool)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	//  Check if already exists
-	stdout, _ := getResourcePoolID(c, resourcePoolName)
+	stdout, _ := getResourcePoolID(ctx, c, resourcePoolName)
 	if stdout != "" {
 		d.SetId(stdout)
 		return nil
@@ -99,28 +107,31 @@ func createResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	parentPoolID, err := getResourcePoolID(c, parentPool)
+	parentPoolID, err := getResourcePoolID(ctx, c, parentPool)
 	if err != nil {
 		d.SetId("")
 		return err
 	}
 
-	remoteCmd = fmt.Sprintf("vim-cmd hostsvc/rsrc/create %s %s %s %s %s %s %s %s %s %s",
-		cpuMinOpt, cpuMinExpandableOpt, cpuMaxOpt, cpuSharesOpt,
-		memMinOpt, memMinExpandableOpt, memMaxOpt, memSharesOpt, parentPoolID, resourcePoolName)
+	args := []string{"hostsvc/rsrc/create"}
+	args = append(args, resourcePoolOptions(cpuMinOpt, cpuMinExpandableOpt, cpuMaxOpt, cpuSharesOpt,
+		memMinOpt, memMinExpandableOpt, memMaxOpt, memSharesOpt)...)
+	args = append(args, parentPoolID, resourcePoolName)
+	remoteCmd = shellCommand("vim-cmd", args...)
 
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "create resource pool")
-	poolID, _ = getResourcePoolID(c, resourcePoolName)
+	_, err = c.executor.run(ctx, remoteCmd, "create resource pool")
+	c.invalidateInventory(inventoryPools)
+	poolID, _ = getResourcePoolID(ctx, c, resourcePoolName)
 	if err != nil {
 		d.SetId("")
-		return err
+		return permissionDeniedError(c, "create resource pool "+resourcePoolName, err)
 	}
 
 	//  Set pool_id
 	d.SetId(poolID)
 
 	// Refresh
-	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(c, poolID)
+	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(ctx, c, poolID)
 	if err != nil {
 		d.SetId("")
 		return nil
@@ -1,7 +1,7 @@
 package esxi
 
 import (
-	"fmt"
+	"context"
 	"log"
 
 	"github.com/hashicorp/terraform/helper/schema"
@@ -9,21 +9,30 @@ import (
 
 func deleteResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutDelete))
+	defer cancel()
 	log.Println("[resourceRESOURCEPOOLDelete]")
 
-	var remoteCmd, stdout string
+	var remoteCmd string
 	var err error
 
 	poolID := d.Id()
 
-	remoteCmd = fmt.Sprintf("vim-cmd hostsvc/rsrc/destroy %s", poolID)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "destroy resource pool")
+	unlock, err := c.lockResourcePools(ctx, d.Get("resource_pool_name").(string))
 	if err != nil {
-		// todo more descriptive err message
-		log.Printf("[resourcePoolDELETE] Failed destroy resource pool id: %s\n", stdout)
 		return err
 	}
+	defer unlock()
+
+	remoteCmd = shellCommand("vim-cmd", "hostsvc/rsrc/destroy", poolID)
+	_, err = c.runRetryingHostBusy(ctx, remoteCmd, "destroy resource pool")
+	c.invalidateInventory(inventoryPools)
+	if isRemoteNotFound(err) {
+		log.Printf("[resourcePoolDELETE] Already deleted resource pool id: %s\n", poolID)
+	} else if err != nil {
+		log.Printf("[resourcePoolDELETE] Failed destroy resource pool id: %s\n", err)
+		return permissionDeniedError(c, "destroy resource pool "+poolID, err)
+	}
 
 	d.SetId("")
 	return nil
@@ -1,170 +1,189 @@
 package esxi
 
 import (
-	"bufio"
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"log"
-	"regexp"
-	"strconv"
 	"strings"
 )
 
 // getResourcePoolID checks if resource pool exists (by name )and return it's Pool ID.
-func getResourcePoolID(c *Config, resourcePoolName string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getResourcePoolID(ctx context.Context, c *Config, resourcePoolName string) (string, error) {
 	log.Printf("[getPoolID]\n")
 
 	if resourcePoolName == "/" || resourcePoolName == "Resources" {
 		return "ha-root-pool", nil
 	}
 
-	result := strings.Split(resourcePoolName, "/")
-	resourcePoolName = result[len(result)-1]
+	nameParts := strings.Split(resourcePoolName, "/")
+	resourcePoolName = nameParts[len(nameParts)-1]
 
-	r := strings.NewReplacer("objID>", "", "</objID", "")
-	remoteCmd := fmt.Sprintf("grep -A1 '<name>%s</name>' /etc/vmware/hostd/pools.xml | grep -o objID.*objID | tail -1", resourcePoolName)
-	stdout, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "get existing resource pool id")
-	if err == nil {
-		stdout = r.Replace(stdout)
-		return stdout, err
+	pools, err := c.hostPools(ctx)
+	if err != nil {
+		log.Printf("[getPoolID] Failed get existing resource pool id: %s\n", err)
+		return "", err
 	}
 
-	log.Printf("[getPoolID] Failed get existing resource pool id: %s\n", stdout)
-	return "", err
-
+	poolID := ""
+	for _, pool := range pools.Pools {
+		if pool.Name == resourcePoolName {
+			poolID = pool.ObjID
+		}
+	}
+	return poolID, nil
 }
 
 // getResourcePoolName checks if Pool exists (by id)and return it's Pool name.
-func getResourcePoolName(c *Config, resourcePoolID string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func getResourcePoolName(ctx context.Context, c *Config, resourcePoolID string) (string, error) {
 	log.Printf("[getPoolNAME]\n")
 
-	var resourcePoolName, fullResourcePoolName string
-
-	fullResourcePoolName = ""
-
 	if resourcePoolID == "ha-root-pool" {
 		return "/", nil
 	}
 
-	// Get full Resource Pool Path
-	remoteCmd := fmt.Sprintf("grep -A1 '<objID>%s</objID>' /etc/vmware/hostd/pools.xml | grep '<path>'", resourcePoolID)
-	stdout, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "get resource pool path")
+	pools, err := c.hostPools(ctx)
 	if err != nil {
-		log.Printf("[getPoolNAME] Failed get resource pool PATH: %s\n", stdout)
+		log.Printf("[getPoolNAME] Failed get resource pool PATH: %s\n", err)
 		return "", err
 	}
 
-	re := regexp.MustCompile(`[/<>\n]`)
-	result := re.Split(stdout, -1)
+	for _, pool := range pools.Pools {
+		if pool.ObjID == resourcePoolID {
+			return pools.poolName(resourcePoolID), nil
+		}
+	}
+	return "", fmt.Errorf("Resource pool %s not found", resourcePoolID)
+}
+
+// hostdPools is /etc/vmware/hostd/pools.xml, where hostd keeps the resource
+// pools and the pool of each guest.  A pool's path is the ids of the pools
+// from host/user down to it.
+type hostdPools struct {
+	Pools []struct {
+		Name  string `xml:"name"`
+		ObjID string `xml:"objID"`
+		Path  string `xml:"path"`
+	} `xml:"resourcePool"`
+	VMs []struct {
+		ObjID        string `xml:"objID"`
+		ResourcePool string `xml:"resourcePool"`
+	} `xml:"vm"`
+}
 
-	for i := range result {
+// parseHostdPools parses the contents of pools.xml
+func parseHostdPools(contents string) (*hostdPools, error) {
+	pools := &hostdPools{}
+	if err := xml.Unmarshal([]byte(contents), pools); err != nil {
+		return nil, fmt.Errorf("Failed to parse pools.xml: %s", err)
+	}
+	return pools, nil
+}
 
-		resourcePoolName = ""
-		if result[i] != "path" && result[i] != "host" && result[i] != "user" && result[i] != "" {
+// guestPool returns the id of the pool guest vmid is in, or "" if it is
+// not listed
+func (p *hostdPools) guestPool(vmid string) string {
+	for _, vm := range p.VMs {
+		if vm.ObjID == vmid {
+			return vm.ResourcePool
+		}
+	}
+	return ""
+}
 
-			r := strings.NewReplacer("name>", "", "</name", "")
-			remoteCmd := fmt.Sprintf("grep -B1 '<objID>%s</objID>' /etc/vmware/hostd/pools.xml | grep -o name.*name", result[i])
-			stdout, _ := runCommandOnHost(esxiSSHinfo, remoteCmd, "get resource pool name")
-			resourcePoolName = r.Replace(stdout)
+// poolName returns the full name of pool id, such as "parent/child", or
+// "" if there is no such pool
+func (p *hostdPools) poolName(id string) string {
+	if id == "ha-root-pool" {
+		return "/"
+	}
 
-			if resourcePoolName != "" {
-				if result[i] == resourcePoolID {
-					fullResourcePoolName = fullResourcePoolName + resourcePoolName
-				} else {
-					fullResourcePoolName = fullResourcePoolName + resourcePoolName + "/"
-				}
-			}
+	names := make(map[string]string)
+	path := ""
+	for _, pool := range p.Pools {
+		names[pool.ObjID] = pool.Name
+		if pool.ObjID == id {
+			path = pool.Path
 		}
 	}
 
-	return fullResourcePoolName, nil
+	var parts []string
+	for _, element := range strings.Split(path, "/") {
+		if name := names[element]; name != "" {
+			parts = append(parts, name)
+		}
+	}
+	return strings.Join(parts, "/")
 }
 
-func readResourcePoolData(c *Config, poolID string) (string, int, string, int, string, int, string, int, string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+// resourcePoolOptions returns the options of a hostsvc/rsrc command that are set
+func resourcePoolOptions(opts ...string) []string {
+	var set []string
+	for _, opt := range opts {
+		if opt != "" {
+			set = append(set, opt)
+		}
+	}
+	return set
+}
+
+func readResourcePoolData(ctx context.Context, c *Config, poolID string) (string, int, string, int, string, int, string, int, string, error) {
 	log.Println("[resourcePoolRead]")
 
-	var remoteCmd, stdout, cpuShares, memShares string
-	var cpuMin, cpuMax, memMin, memMax, tmpvar int
+	var remoteCmd, cpuShares, memShares string
+	var cpuMin, cpuMax, memMin, memMax int
 	var cpuMinExpandable, memMinExpandable string
 	var err error
 
-	remoteCmd = fmt.Sprintf("vim-cmd hostsvc/rsrc/pool_config_get %s", poolID)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "resource pool_config_get")
+	remoteCmd = shellCommand("vim-cmd", "hostsvc/rsrc/pool_config_get", poolID)
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "resource pool_config_get")
+	stdout := result.stdout
 
-	if strings.Contains(stdout, "deleted") == true {
+	if isRemoteNotFound(err) || strings.Contains(stdout, "deleted") == true {
 		log.Printf("[resourcePoolRead] Already deleted: %s\n", err)
 		return "", 0, "", 0, "", 0, "", 0, "", nil
 	}
 	if err != nil {
 		log.Printf("[resourcePoolRead] Failed to get %s: %s\n", "resource pool_config_get", err)
-		return "", 0, "", 0, "", 0, "", 0, "", errors.New("Failed to get Resource Pool config")
+		return "", 0, "", 0, "", 0, "", 0, "", fmt.Errorf("Failed to get Resource Pool config: %w", err)
 	}
 
-	isCPUFlag := true
-
-	scanner := bufio.NewScanner(strings.NewReader(stdout))
-	for scanner.Scan() {
-		switch {
-		case strings.Contains(scanner.Text(), "memoryAllocation = "):
-			isCPUFlag = false
-
-		case strings.Contains(scanner.Text(), "reservation = "):
-			r, _ := regexp.Compile("[0-9]+")
-			if isCPUFlag == true {
-				cpuMin, _ = strconv.Atoi(r.FindString(scanner.Text()))
-			} else {
-				memMin, _ = strconv.Atoi(r.FindString(scanner.Text()))
-			}
-
-		case strings.Contains(scanner.Text(), "expandableReservation = "):
-			r, _ := regexp.Compile("(true|false)")
-			if isCPUFlag == true {
-				cpuMinExpandable = r.FindString(scanner.Text())
-			} else {
-				memMinExpandable = r.FindString(scanner.Text())
-			}
-
-		case strings.Contains(scanner.Text(), "limit = "):
-			r, _ := regexp.Compile("-?[0-9]+")
-			tmpvar, _ = strconv.Atoi(r.FindString(scanner.Text()))
-			if tmpvar < 0 {
-				tmpvar = 0
-			}
-			if isCPUFlag == true {
-				cpuMax = tmpvar
-			} else {
-				memMax = tmpvar
-			}
-
-		case strings.Contains(scanner.Text(), "shares = "):
-			r, _ := regexp.Compile("[0-9]+")
-			if isCPUFlag == true {
-				cpuShares = r.FindString(scanner.Text())
-			} else {
-				memShares = r.FindString(scanner.Text())
-			}
-
-		case strings.Contains(scanner.Text(), "level = "):
-			r, _ := regexp.Compile("(low|high|normal)")
-			if r.FindString(scanner.Text()) != "" {
-				if isCPUFlag == true {
-					cpuShares = r.FindString(scanner.Text())
-				} else {
-					memShares = r.FindString(scanner.Text())
-				}
-			}
-		}
+	config, err := parseVimDump(stdout)
+	if err != nil {
+		log.Printf("[resourcePoolRead] %s\n", err)
+		return "", 0, "", 0, "", 0, "", 0, "", errors.New("Failed to get Resource Pool config")
 	}
 
-	resourcePoolName, err := getResourcePoolName(c, poolID)
+	cpuMin, cpuMinExpandable, cpuMax, cpuShares = parseResourceAllocation(config.get("cpuAllocation"))
+	memMin, memMinExpandable, memMax, memShares = parseResourceAllocation(config.get("memoryAllocation"))
+
+	resourcePoolName, err := getResourcePoolName(ctx, c, poolID)
 	if err != nil {
 		log.Printf("[resourcePoolRead] Failed to get Resource Pool name: %s\n", err)
-		return "", 0, "", 0, "", 0, "", 0, "", errors.New("Failed to get Resource Pool name")
+		return "", 0, "", 0, "", 0, "", 0, "", fmt.Errorf("Failed to get Resource Pool name: %w", err)
 	}
 
 	return resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares,
 		memMin, memMinExpandable, memMax, memShares, nil
 }
+
+// parseResourceAllocation returns the reservation, whether it is
+// expandable, the limit (0 for none) and the shares of a
+// vim.ResourceAllocationInfo.  Shares are the level unless it is custom.
+func parseResourceAllocation(allocation *vimValue) (int, string, int, string) {
+	reservation := int(allocation.get("reservation").int())
+	expandable := allocation.get("expandableReservation").str()
+
+	limit := int(allocation.get("limit").int())
+	if limit < 0 {
+		limit = 0
+	}
+
+	shares := allocation.get("shares", "shares").str()
+	switch level := allocation.get("shares", "level").str(); level {
+	case "low", "normal", "high":
+		shares = level
+	}
+	return reservation, expandable, limit, shares
+}
@@ -0,0 +1,83 @@
+package esxi
+
+import (
+	"context"
+	"testing"
+)
+
+const testPoolConfig = `(vim.ResourceConfigSpec) {
+   entity = 'vim.ResourcePool:pool7',
+   changeVersion = <unset>,
+   lastModified = <unset>,
+   cpuAllocation = (vim.ResourceAllocationInfo) {
+      reservation = 100,
+      expandableReservation = true,
+      limit = -1,
+      shares = (vim.SharesInfo) {
+         shares = 4000,
+         level = "normal"
+      },
+      overheadLimit = <unset>
+   },
+   memoryAllocation = (vim.ResourceAllocationInfo) {
+      reservation = 200,
+      expandableReservation = false,
+      limit = 4096,
+      shares = (vim.SharesInfo) {
+         shares = 163840,
+         level = "custom"
+      },
+      overheadLimit = <unset>
+   }
+}`
+
+const testPoolsXML = `<ConfigRoot>
+  <resourcePool id="0000">
+    <name>parent</name>
+    <objID>pool3</objID>
+    <path>host/user/pool3</path>
+  </resourcePool>
+  <resourcePool id="0001">
+    <name>child</name>
+    <objID>pool7</objID>
+    <path>host/user/pool3/pool7</path>
+  </resourcePool>
+</ConfigRoot>
+`
+
+func TestReadResourcePoolData(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`pool_config_get pool7$`, testPoolConfig).
+		on(`^cat /etc/vmware/hostd/pools.xml$`, testPoolsXML)
+
+	name, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err :=
+		readResourcePoolData(context.Background(), testConfig(host), "pool7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "parent/child" {
+		t.Errorf("name: got %s", name)
+	}
+	if cpuMin != 100 || cpuMinExpandable != "true" || cpuMax != 0 || cpuShares != "normal" {
+		t.Errorf("cpu: got %d %s %d %s", cpuMin, cpuMinExpandable, cpuMax, cpuShares)
+	}
+	if memMin != 200 || memMinExpandable != "false" || memMax != 4096 || memShares != "163840" {
+		t.Errorf("mem: got %d %s %d %s", memMin, memMinExpandable, memMax, memShares)
+	}
+}
+
+func TestGetResourcePoolID(t *testing.T) {
+	host := newFakeExecutor(t).on(`^cat /etc/vmware/hostd/pools.xml$`, testPoolsXML)
+	c := testConfig(host)
+
+	id, err := getResourcePoolID(context.Background(), c, "parent/child")
+	if err != nil || id != "pool7" {
+		t.Errorf("got %q, %v", id, err)
+	}
+
+	id, err = getResourcePoolID(context.Background(), c, "/")
+	if err != nil || id != "ha-root-pool" {
+		t.Errorf("root pool: got %q, %v", id, err)
+	}
+}
@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -9,6 +10,8 @@ import (
 
 func importResourcePoolResource(d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
 
 	log.Println("[resourceRESOURCEPOOLImport]")
 
@@ -18,7 +21,7 @@ func importResourcePoolResource(d *schema.ResourceData, m interface{}) ([]*schem
 	results[0] = d
 
 	// get VMID (by name)
-	_, err = getResourcePoolName(c, d.Id())
+	_, err = getResourcePoolName(ctx, c, d.Id())
 	if err != nil {
 		return results, fmt.Errorf("Failed to validate resource_pool: %s", err)
 	}
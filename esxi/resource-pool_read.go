@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"log"
 
 	"github.com/hashicorp/terraform/helper/schema"
@@ -8,6 +9,8 @@ import (
 
 func readResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
 
 	log.Println("[resourceRESOURCEPOOLRead]")
 
@@ -19,7 +22,10 @@ func readResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 	poolID := d.Id()
 
 	// Refresh
-	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(c, poolID)
+	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(ctx, c, poolID)
+	if isRemoteTransient(err) || isRemotePermissionDenied(err) {
+		return permissionDeniedError(c, "read resource pool "+poolID, err)
+	}
 	if err != nil {
 		d.SetId("")
 		return nil
@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,7 +13,8 @@ import (
 // updateResourcePoolResource updates a resource pool resource
 func updateResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutUpdate))
+	defer cancel()
 	log.Println("[resourceRESOURCEPOOLUpdate]")
 
 	var remoteCmd, stdout string
@@ -36,14 +38,35 @@ func updateResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 		resourcePoolName = resourcePoolName[1:]
 	}
 
-	stdout, err = getResourcePoolName(c, poolID)
+	stdout, err = getResourcePoolName(ctx, c, poolID)
 	if err != nil {
 		return err
 	}
+
+	unlock, err := c.lockResourcePools(ctx, stdout, resourcePoolName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if stdout != resourcePoolName {
-		log.Printf("[resourceRESOURCEPOOLUpdate] rename %s %s", poolID, resourcePoolName)
-		remoteCmd = fmt.Sprintf("vim-cmd hostsvc/rsrc/rename %s %s", poolID, resourcePoolName)
-		stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "update resource pool")
+		//  rename only changes the last path element, the pool stays under its parent.
+		oldParent, newParent := "", ""
+		if i := strings.LastIndex(stdout, "/"); i >= 0 {
+			oldParent = stdout[:i]
+		}
+		if i := strings.LastIndex(resourcePoolName, "/"); i >= 0 {
+			newParent = resourcePoolName[:i]
+		}
+		if oldParent != newParent {
+			return fmt.Errorf("Unable to move resource pool %s to %s, only the last path element can be renamed", stdout, resourcePoolName)
+		}
+
+		newName := resourcePoolName[len(newParent):]
+		newName = strings.TrimPrefix(newName, "/")
+		log.Printf("[resourceRESOURCEPOOLUpdate] rename %s %s", poolID, newName)
+		remoteCmd = shellCommand("vim-cmd", "hostsvc/rsrc/rename", poolID, newName)
+		_, err = c.executor.run(ctx, remoteCmd, "update resource pool")
+		c.invalidateInventory(inventoryPools)
 		if err != nil {
 			return err
 		}
@@ -99,18 +122,20 @@ func updateResourcePoolResource(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	remoteCmd = fmt.Sprintf("vim-cmd hostsvc/rsrc/pool_config_set %s %s %s %s %s %s %s %s %s",
-		cpuMinOpt, cpuMinExpandableOpt, cpuMaxOpt, cpuSharesOpt,
-		memMinOpt, memMinExpandableOpt, memMaxOpt, memSharesOpt, poolID)
-
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "update resource pool")
-	log.Printf("[resourcePoolUPDATE] stdout |%s|\n", stdout)
+	args := []string{"hostsvc/rsrc/pool_config_set"}
+	args = append(args, resourcePoolOptions(cpuMinOpt, cpuMinExpandableOpt, cpuMaxOpt, cpuSharesOpt,
+		memMinOpt, memMinExpandableOpt, memMaxOpt, memSharesOpt)...)
+	args = append(args, poolID)
+	remoteCmd = shellCommand("vim-cmd", args...)
 
-	r := strings.NewReplacer("'vim.ResourcePool:", "", "'", "")
-	stdout = r.Replace(stdout)
+	result, err := c.executor.run(ctx, remoteCmd, "update resource pool")
+	log.Printf("[resourcePoolUPDATE] stdout |%s|\n", result.stdout)
+	if err != nil {
+		return err
+	}
 
 	// Refresh
-	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(c, poolID)
+	resourcePoolName, cpuMin, cpuMinExpandable, cpuMax, cpuShares, memMin, memMinExpandable, memMax, memShares, err = readResourcePoolData(ctx, c, poolID)
 	if err != nil {
 		d.SetId("")
 		return nil
@@ -1,6 +1,12 @@
 package esxi
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/helper/validation"
 )
@@ -15,6 +21,12 @@ func buildGuestResourceSchema() *schema.Resource {
 		Importer: &schema.ResourceImporter{
 			State: importGuestResource,
 		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Read:   schema.DefaultTimeout(10 * time.Minute),
+			Update: schema.DefaultTimeout(10 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
 		Schema: map[string]*schema.Schema{
 			"clone_from_vm": &schema.Schema{
 				Type:        schema.TypeString,
@@ -31,30 +43,44 @@ func buildGuestResourceSchema() *schema.Resource {
 				Description: "Local path to source ovf files.",
 			},
 			"disk_store": &schema.Schema{
-				Type:        schema.TypeString,
-				Required:    true,
-				ForceNew:    true,
-				DefaultFunc: schema.EnvDefaultFunc("disk_store", "Least Used"),
-				Description: "esxi diskstore for boot disk.",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("disk_store", "Least Used"),
+				ValidateFunc: validateName(checkDiskStoreName),
+				Description:  "esxi diskstore for boot disk.",
 			},
 			"resource_pool_name": &schema.Schema{
-				Type:        schema.TypeString,
-				Optional:    true,
-				ForceNew:    true,
-				Computed:    true,
-				Description: "Resource pool name to place guest.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Computed:     true,
+				ValidateFunc: validateName(checkResourcePoolName),
+				Description:  "Resource pool name to place guest.",
 			},
 			"guest_name": &schema.Schema{
-				Type:        schema.TypeString,
-				Required:    true,
-				ForceNew:    true,
-				DefaultFunc: schema.EnvDefaultFunc("guest_name", "vm-example"),
-				Description: "esxi guest name.",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("guest_name", "vm-example"),
+				ValidateFunc: validateName(checkGuestName),
+				Description:  "esxi guest name.",
+			},
+			"adopt_existing": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				//  Only used on create, so changing it later is not an update
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return d.Id() != ""
+				},
+				Description: "Take over an existing guest named guest_name instead of failing.  Its vmx is rewritten.",
 			},
 			"boot_disk_type": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
 				ForceNew:    true,
+				Computed:    true,
 				Description: "Guest boot disk type. thin, zeroedthick, eagerzeroedthick",
 			},
 			"boot_disk_size": &schema.Schema{
@@ -192,6 +218,74 @@ func buildGuestResourceSchema() *schema.Resource {
 					Type: schema.TypeString,
 				},
 			},
+			"sensitive_guestinfo": &schema.Schema{
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Sensitive:   true,
+				Description: "pass data to VM, masked in plans and logs",
+				ForceNew:    true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"extra_config": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Description:  "Additional vmx settings, such as vhv.enable.",
+				ValidateFunc: validateExtraConfig,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
 		},
 	}
 }
+
+// guestinfoFromResource merges guestinfo and sensitive_guestinfo into the
+// values written to the vmx, registering the sensitive ones for redaction
+func guestinfoFromResource(d *schema.ResourceData) (map[string]interface{}, error) {
+	guestinfo, ok := d.Get("guestinfo").(map[string]interface{})
+	if !ok {
+		return nil, errors.New("guestinfo is wrong type")
+	}
+	sensitiveGuestinfo, ok := d.Get("sensitive_guestinfo").(map[string]interface{})
+	if !ok {
+		return nil, errors.New("sensitive_guestinfo is wrong type")
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range guestinfo {
+		merged[k] = v
+	}
+	for k, v := range sensitiveGuestinfo {
+		if _, ok := merged[k]; ok {
+			return nil, fmt.Errorf("guestinfo key %s is set in both guestinfo and sensitive_guestinfo", k)
+		}
+		registerSecret(v.(string))
+		merged[k] = v
+	}
+
+	return merged, nil
+}
+
+// extraConfigFromResource returns the extra_config settings to write, and
+// the keys of settings dropped from extra_config that must be removed
+func extraConfigFromResource(d *schema.ResourceData) (map[string]interface{}, []string) {
+	o, n := d.GetChange("extra_config")
+	oldConfig, _ := o.(map[string]interface{})
+	extraConfig, _ := n.(map[string]interface{})
+
+	var removed []string
+	for k := range oldConfig {
+		kept := false
+		for key := range extraConfig {
+			kept = kept || strings.EqualFold(k, key)
+		}
+		if !kept {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+
+	return extraConfig, removed
+}
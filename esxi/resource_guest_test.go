@@ -0,0 +1,366 @@
+package esxi
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAccGuest(t *testing.T) {
+	h := testAccStartHost(t)
+
+	resource.Test(t, resource.TestCase{
+		Providers:    h.providers(),
+		CheckDestroy: h.checkGuestDestroy,
+		Steps: []resource.TestStep{
+			{
+				Config: h.config(testAccGuestConfig("1024", "2")),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_guest.web", "guest_name", "web01"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "resource_pool_name", "dev/web"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "memsize", "1024"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "numvcpus", "2"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "boot_disk_size", "20"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "power", "on"),
+					resource.TestCheckResourceAttrSet("esxi_guest.web", "ip_address"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "virtual_disks.#", "1"),
+					resource.TestCheckResourceAttrPair("esxi_guest.web", "virtual_disks.0.virtual_disk_id",
+						"esxi_virtual_disk.data", "id"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "virtual_disks.0.slot", "0:1"),
+					h.checkGuestVmx("esxi_guest.web", "scsi0:1.fileName", "/vmfs/volumes/ds1/disks/data.vmdk"),
+					h.checkGuestVmx("esxi_guest.web", "memSize", "1024"),
+				),
+			},
+			{
+				Config: h.config(testAccGuestConfig("2048", "4")),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_guest.web", "memsize", "2048"),
+					resource.TestCheckResourceAttr("esxi_guest.web", "numvcpus", "4"),
+					h.checkGuestVmx("esxi_guest.web", "memSize", "2048"),
+					h.checkGuestVmx("esxi_guest.web", "numvcpus", "4"),
+					h.checkGuestVmx("esxi_guest.web", "scsi0:1.fileName", "/vmfs/volumes/ds1/disks/data.vmdk"),
+				),
+			},
+			{
+				Config:            h.config(testAccGuestConfig("2048", "4")),
+				ResourceName:      "esxi_guest.web",
+				ImportState:       true,
+				ImportStateVerify: true,
+			},
+		},
+	})
+}
+
+func testAccGuestConfig(memsize string, numvcpus string) string {
+	return fmt.Sprintf(`
+resource "esxi_resource_pool" "dev" {
+  resource_pool_name = "dev"
+}
+
+resource "esxi_resource_pool" "web" {
+  resource_pool_name = "${esxi_resource_pool.dev.resource_pool_name}/web"
+}
+
+resource "esxi_virtual_disk" "data" {
+  virtual_disk_disk_store = "ds1"
+  virtual_disk_dir        = "disks"
+  virtual_disk_name       = "data.vmdk"
+  virtual_disk_size       = 1
+  virtual_disk_type       = "thin"
+}
+
+resource "esxi_guest" "web" {
+  guest_name         = "web01"
+  disk_store         = "ds1"
+  resource_pool_name = esxi_resource_pool.web.resource_pool_name
+  boot_disk_size     = "20"
+  memsize            = "%s"
+  numvcpus           = "%s"
+
+  network_interfaces {
+    virtual_network = "VM Network"
+  }
+
+  virtual_disks {
+    virtual_disk_id = esxi_virtual_disk.data.id
+    slot            = "0:1"
+  }
+}
+`, memsize, numvcpus)
+}
+
+// checkGuestVmx checks a value in the vmx file of a guest
+func (h *testAccHost) checkGuestVmx(name string, key string, value string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		h.host.mu.Lock()
+		defer h.host.mu.Unlock()
+
+		vmid := s.RootModule().Resources[name].Primary.ID
+		vm, ok := h.host.vm(vmid)
+		if !ok {
+			return fmt.Errorf("guest %s is not registered", vmid)
+		}
+		if got := h.host.vmx(vm)[key]; got != value {
+			return fmt.Errorf("guest %s: %s = %q, want %q", vmid, key, got, value)
+		}
+		return nil
+	}
+}
+
+func (h *testAccHost) checkGuestDestroy(s *terraform.State) error {
+	if err := h.checkVirtualDiskDestroy(s); err != nil {
+		return err
+	}
+
+	h.host.mu.Lock()
+	defer h.host.mu.Unlock()
+
+	for _, rs := range s.RootModule().Resources {
+		if rs.Type != "esxi_guest" {
+			continue
+		}
+		vmid, _ := strconv.Atoi(rs.Primary.ID)
+		if _, ok := h.host.vms[vmid]; ok {
+			return fmt.Errorf("guest %s still exists", rs.Primary.ID)
+		}
+	}
+	if _, ok := h.host.stat("/vmfs/volumes/ds1/web01"); ok {
+		return fmt.Errorf("guest directory still exists")
+	}
+	return nil
+}
+
+func TestFakeHostGuestExtraConfig(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name": "web01",
+		"disk_store": "ds1",
+		"power":      "off",
+		"extra_config": map[string]interface{}{
+			"vhv.enable":      "TRUE",
+			"svga.vramSize":   "16777216",
+			"disk.EnableUUID": "TRUE",
+		},
+	}
+
+	d := testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	vm := host.vms[1]
+	if vmx := host.vmx(vm); vmx["vhv.enable"] != "TRUE" || vmx["svga.vramSize"] != "16777216" || vmx["disk.EnableUUID"] != "TRUE" {
+		t.Errorf("extra_config not written: %v", vmx)
+	}
+
+	// Changes made on the host show up on refresh.
+	host.mu.Lock()
+	data, _ := host.readFile(vm.vmxPath)
+	doc := parseVmx(string(data))
+	doc.set("svga.vramSize", "8388608")
+	doc.delete("disk.EnableUUID")
+	host.writeFile(vm.vmxPath, []byte(doc.String()))
+	host.mu.Unlock()
+
+	d = testResourceData(t, r, d.Id(), raw)
+	if err := r.Read(d, c); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	extraConfig := d.Get("extra_config").(map[string]interface{})
+	if len(extraConfig) != 2 || extraConfig["vhv.enable"] != "TRUE" || extraConfig["svga.vramSize"] != "8388608" {
+		t.Errorf("drift not read back: %v", extraConfig)
+	}
+
+	// Dropping a key removes it from the vmx.
+	raw["extra_config"] = map[string]interface{}{"svga.vramSize": "16777216"}
+	d = testResourceUpdate(t, r, d.State(), raw)
+	if err := r.Update(d, c); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	vmx := host.vmx(vm)
+	if _, ok := vmx["vhv.enable"]; ok || vmx["svga.vramSize"] != "16777216" {
+		t.Errorf("extra_config not updated: %v", vmx)
+	}
+}
+
+func TestFakeHostGuestAdoptExisting(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name": "web01",
+		"disk_store": "ds1",
+		"power":      "on",
+		"memsize":    "1024",
+		"network_interfaces": []interface{}{
+			map[string]interface{}{"virtual_network": "VM Network"},
+		},
+	}
+	if err := r.Create(testResourceData(t, r, "", raw), c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	vm := host.vms[1]
+	before := host.vmx(vm)
+
+	// A second resource with the same name fails and leaves the guest alone.
+	raw["memsize"] = "2048"
+	raw["network_interfaces"] = nil
+	d := testResourceData(t, r, "", raw)
+	err := r.Create(d, c)
+	if err == nil || !strings.Contains(err.Error(), "already exists") || !strings.Contains(err.Error(), "adopt_existing") {
+		t.Fatalf("expected an already exists error, got %v", err)
+	}
+	if d.Id() != "" {
+		t.Errorf("failed create set id %s", d.Id())
+	}
+	if vm.power != "on" || !reflect.DeepEqual(host.vmx(vm), before) {
+		t.Errorf("existing guest changed: power %s, vmx %v", vm.power, host.vmx(vm))
+	}
+
+	raw["adopt_existing"] = true
+	d = testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("adopt: %s", err)
+	}
+	if d.Id() != "1" || len(host.vms) != 1 || host.vmx(vm)["memSize"] != "2048" {
+		t.Errorf("guest not adopted: id %s, vmx %v", d.Id(), host.vmx(vm))
+	}
+
+	// Changing adopt_existing afterwards is not an update.
+	raw["adopt_existing"] = false
+	cfg, err := config.NewRawConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := schema.InternalMap(r.Schema).Diff(d.State(), terraform.NewResourceConfig(cfg), nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != nil && diff.Attributes["adopt_existing"] != nil {
+		t.Errorf("adopt_existing changed after create: %+v", diff.Attributes["adopt_existing"])
+	}
+}
+
+func TestFakeHostGuestAdoptKeepsNetworkInterfaces(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name": "web01",
+		"disk_store": "ds1",
+		"power":      "off",
+	}
+	if err := r.Create(testResourceData(t, r, "", raw), c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	vm := host.vms[1]
+
+	// Adapters added by hand outside of terraform.
+	host.mu.Lock()
+	data, _ := host.readFile(vm.vmxPath)
+	doc := parseVmx(string(data))
+	for k, v := range map[string]string{
+		"ethernet0.present":     "TRUE",
+		"ethernet0.networkName": "VM Network",
+		"ethernet0.virtualDev":  "e1000",
+		"ethernet1.present":     "TRUE",
+		"ethernet1.networkName": "Backup",
+		"ethernet1.virtualDev":  "vmxnet3",
+		"ethernet1.addressType": "static",
+		"ethernet1.address":     "00:50:56:00:00:01",
+	} {
+		doc.set(k, v)
+	}
+	host.writeFile(vm.vmxPath, []byte(doc.String()))
+	host.mu.Unlock()
+
+	raw["adopt_existing"] = true
+	raw["network_interfaces"] = []interface{}{
+		map[string]interface{}{"virtual_network": "Prod"},
+	}
+	if err := r.Create(testResourceData(t, r, "", raw), c); err != nil {
+		t.Fatalf("adopt: %s", err)
+	}
+	vmx := host.vmx(vm)
+	if vmx["ethernet0.networkName"] != "Prod" {
+		t.Errorf("declared adapter not replaced: %v", vmx)
+	}
+	if vmx["ethernet1.present"] != "TRUE" || vmx["ethernet1.networkName"] != "Backup" ||
+		vmx["ethernet1.virtualDev"] != "vmxnet3" || vmx["ethernet1.address"] != "00:50:56:00:00:01" {
+		t.Errorf("hand-made adapter not kept: %v", vmx)
+	}
+}
+
+func TestFakeHostGuest(t *testing.T) {
+	host, server, c := testFakeHost(t)
+	r := buildGuestResourceSchema()
+	raw := map[string]interface{}{
+		"guest_name":     "web01",
+		"disk_store":     "ds1",
+		"boot_disk_size": "20",
+		"memsize":        "1024",
+		"numvcpus":       "2",
+		"power":          "on",
+		"notes":          "web server\n\"prod\" | #1 café",
+		"guestinfo": map[string]interface{}{
+			"userdata": "#cloud-config\nruncmd:\n  - echo \"hi\" | tee /tmp/x\n",
+		},
+		"network_interfaces": []interface{}{
+			map[string]interface{}{"virtual_network": "VM Network"},
+		},
+	}
+
+	d := testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if d.Get("notes").(string) != raw["notes"] || d.Get("guestinfo.userdata").(string) != raw["guestinfo"].(map[string]interface{})["userdata"] {
+		t.Errorf("escaped values read back as %q and %q", d.Get("notes"), d.Get("guestinfo.userdata"))
+	}
+	vm := host.vms[1]
+	if d.Id() != "1" || vm == nil || vm.power != "on" {
+		t.Fatalf("guest not created and powered on: id %s", d.Id())
+	}
+	if d.Get("memsize").(string) != "1024" || d.Get("numvcpus").(string) != "2" ||
+		d.Get("boot_disk_size").(string) != "20" || d.Get("ip_address").(string) != vm.ipAddress() {
+		t.Errorf("read back: %v", d.State().Attributes)
+	}
+
+	// A running guest with an address refreshes in one round trip.
+	before := len(server.ran())
+	if err := r.Read(d, c); err != nil || d.Id() != "1" {
+		t.Fatalf("read: %v", err)
+	}
+	if commands := server.ran()[before:]; len(commands) != 1 {
+		t.Errorf("refresh ran %d commands, want 1: %q", len(commands), commands)
+	}
+
+	raw["memsize"] = "2048"
+	d = testResourceData(t, r, d.Id(), raw)
+	if err := r.Update(d, c); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if vmx := host.vmx(vm); vmx["memSize"] != "2048" {
+		t.Errorf("memsize not updated: %s", vmx["memSize"])
+	}
+
+	imported, err := testImport(t, r, d.Id(), c)
+	if err != nil || imported.Get("guest_name").(string) != "web01" {
+		t.Errorf("import: %v", err)
+	}
+
+	if err := r.Delete(d, c); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if len(host.vms) != 0 {
+		t.Error("guest still registered after delete")
+	}
+	if _, ok := host.stat("/vmfs/volumes/ds1/web01"); ok {
+		t.Error("guest directory left after delete")
+	}
+}
@@ -1,6 +1,8 @@
 package esxi
 
 import (
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
 )
 
@@ -14,12 +16,19 @@ func buildResourcePoolResourceSchema() *schema.Resource {
 		Importer: &schema.ResourceImporter{
 			State: importResourcePoolResource,
 		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(5 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(5 * time.Minute),
+		},
 		Schema: map[string]*schema.Schema{
 			"resource_pool_name": &schema.Schema{
-				Type:        schema.TypeString,
-				Required:    true,
-				ForceNew:    false,
-				Description: "Resource Pool Name",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     false,
+				ValidateFunc: validateName(checkResourcePoolName),
+				Description:  "Resource Pool Name",
 			},
 			"cpu_min": &schema.Schema{
 				Type:        schema.TypeInt,
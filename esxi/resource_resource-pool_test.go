@@ -0,0 +1,168 @@
+package esxi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAccResourcePool(t *testing.T) {
+	h := testAccStartHost(t)
+
+	resource.Test(t, resource.TestCase{
+		Providers:    h.providers(),
+		CheckDestroy: h.checkResourcePoolDestroy,
+		Steps: []resource.TestStep{
+			{
+				Config: h.config(testAccResourcePoolConfig("web", "high", 2048)),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_resource_pool.parent", "resource_pool_name", "dev"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "resource_pool_name", "dev/web"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "cpu_min", "100"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "cpu_shares", "high"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "mem_max", "2048"),
+					h.checkPoolParent("esxi_resource_pool.child", "esxi_resource_pool.parent"),
+				),
+			},
+			{
+				Config: h.config(testAccResourcePoolConfig("app", "low", 4096)),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "resource_pool_name", "dev/app"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "cpu_shares", "low"),
+					resource.TestCheckResourceAttr("esxi_resource_pool.child", "mem_max", "4096"),
+					h.checkPoolParent("esxi_resource_pool.child", "esxi_resource_pool.parent"),
+				),
+			},
+			{
+				Config:            h.config(testAccResourcePoolConfig("app", "low", 4096)),
+				ResourceName:      "esxi_resource_pool.child",
+				ImportState:       true,
+				ImportStateVerify: true,
+			},
+		},
+	})
+}
+
+func testAccResourcePoolConfig(name string, cpuShares string, memMax int) string {
+	return fmt.Sprintf(`
+resource "esxi_resource_pool" "parent" {
+  resource_pool_name = "dev"
+}
+
+resource "esxi_resource_pool" "child" {
+  resource_pool_name = "${esxi_resource_pool.parent.resource_pool_name}/%s"
+  cpu_min            = 100
+  cpu_shares         = "%s"
+  mem_max            = %d
+}
+`, name, cpuShares, memMax)
+}
+
+// checkPoolParent checks that the pool of child is nested in the pool of parent
+func (h *testAccHost) checkPoolParent(child string, parent string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		h.host.mu.Lock()
+		defer h.host.mu.Unlock()
+
+		childID := s.RootModule().Resources[child].Primary.ID
+		parentID := s.RootModule().Resources[parent].Primary.ID
+		p, ok := h.host.pools[childID]
+		if !ok {
+			return fmt.Errorf("resource pool %s does not exist", childID)
+		}
+		if p.parent != parentID {
+			return fmt.Errorf("resource pool %s is in %s, want %s", childID, p.parent, parentID)
+		}
+		return nil
+	}
+}
+
+func (h *testAccHost) checkResourcePoolDestroy(s *terraform.State) error {
+	h.host.mu.Lock()
+	defer h.host.mu.Unlock()
+
+	for _, rs := range s.RootModule().Resources {
+		if rs.Type != "esxi_resource_pool" {
+			continue
+		}
+		if _, ok := h.host.pools[rs.Primary.ID]; ok {
+			return fmt.Errorf("resource pool %s still exists", rs.Primary.ID)
+		}
+	}
+	return nil
+}
+
+func TestFakeHostResourcePool(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildResourcePoolResourceSchema()
+
+	parent := testResourceData(t, r, "", map[string]interface{}{"resource_pool_name": "dev"})
+	if err := r.Create(parent, c); err != nil {
+		t.Fatalf("create parent: %s", err)
+	}
+
+	raw := map[string]interface{}{
+		"resource_pool_name": "dev/web",
+		"cpu_min":            100,
+		"cpu_shares":         "high",
+		"mem_max":            2048,
+	}
+	d := testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if p := host.pools[d.Id()]; p == nil || p.parent != parent.Id() {
+		t.Fatalf("pool %s not created below %s", d.Id(), parent.Id())
+	}
+	if d.Get("resource_pool_name").(string) != "dev/web" || d.Get("cpu_min").(int) != 100 ||
+		d.Get("cpu_shares").(string) != "high" || d.Get("mem_max").(int) != 2048 {
+		t.Errorf("read back: %v", d.State().Attributes)
+	}
+
+	raw["cpu_shares"] = "low"
+	d = testResourceData(t, r, d.Id(), raw)
+	if err := r.Update(d, c); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if p := host.pools[d.Id()]; p.cpuShares != "low" {
+		t.Errorf("update not applied: %+v", p)
+	}
+
+	imported, err := testImport(t, r, d.Id(), c)
+	if err != nil || imported.Get("resource_pool_name").(string) != "dev/web" {
+		t.Errorf("import: %v", err)
+	}
+
+	if err := r.Delete(d, c); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := r.Delete(parent, c); err != nil {
+		t.Fatalf("delete parent: %s", err)
+	}
+	if len(host.pools) != 0 {
+		t.Errorf("pools left after delete: %d", len(host.pools))
+	}
+}
+
+func TestFakeHostResourcePoolShellName(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildResourcePoolResourceSchema()
+
+	name := `it's $(reboot) ; x`
+	d := testResourceData(t, r, "", map[string]interface{}{"resource_pool_name": name})
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if p := host.pools[d.Id()]; p == nil || p.name != name {
+		t.Fatalf("pool %s not created as %q: %+v", d.Id(), name, p)
+	}
+	if got := d.Get("resource_pool_name").(string); got != name {
+		t.Errorf("read back %q, want %q", got, name)
+	}
+
+	if err := r.Delete(d, c); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+}
@@ -1,6 +1,8 @@
 package esxi
 
 import (
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
 )
 
@@ -14,28 +16,37 @@ func buildVirtualDiskResourceSchema() *schema.Resource {
 		Importer: &schema.ResourceImporter{
 			State: importVirtualDiskDataIntoResource,
 		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(10 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
 		Schema: map[string]*schema.Schema{
 			"virtual_disk_disk_store": &schema.Schema{
-				Type:        schema.TypeString,
-				Required:    true,
-				ForceNew:    true,
-				DefaultFunc: schema.EnvDefaultFunc("virtual_disk_disk_store", nil),
-				Description: "Disk Store.",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("virtual_disk_disk_store", nil),
+				ValidateFunc: validateName(checkDiskStoreName),
+				Description:  "Disk Store.",
 			},
 			"virtual_disk_dir": &schema.Schema{
-				Type:        schema.TypeString,
-				Required:    true,
-				ForceNew:    true,
-				DefaultFunc: schema.EnvDefaultFunc("virtual_disk_dir", nil),
-				Description: "Disk dir.",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("virtual_disk_dir", nil),
+				ValidateFunc: validateName(checkVirtualDiskDir),
+				Description:  "Disk dir.",
 			},
 			"virtual_disk_name": &schema.Schema{
-				Type:        schema.TypeString,
-				Optional:    true,
-				ForceNew:    true,
-				Computed:    true,
-				DefaultFunc: schema.EnvDefaultFunc("virtual_disk_name", nil),
-				Description: "Virtual Disk Name. A random virtual disk name will be generated if nil.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Computed:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("virtual_disk_name", nil),
+				ValidateFunc: validateName(checkVirtualDiskName),
+				Description:  "Virtual Disk Name. A random virtual disk name will be generated if nil.",
 			},
 			"virtual_disk_size": &schema.Schema{
 				Type:        schema.TypeInt,
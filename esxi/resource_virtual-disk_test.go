@@ -0,0 +1,130 @@
+package esxi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestAccVirtualDisk(t *testing.T) {
+	h := testAccStartHost(t)
+
+	resource.Test(t, resource.TestCase{
+		Providers:    h.providers(),
+		CheckDestroy: h.checkVirtualDiskDestroy,
+		Steps: []resource.TestStep{
+			{
+				Config: h.config(testAccVirtualDiskConfig(2)),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_virtual_disk.data", "id", "/vmfs/volumes/ds1/disks/data.vmdk"),
+					resource.TestCheckResourceAttr("esxi_virtual_disk.data", "virtual_disk_size", "2"),
+					resource.TestCheckResourceAttr("esxi_virtual_disk.data", "virtual_disk_type", "zeroedthick"),
+					h.checkFileSize("/vmfs/volumes/ds1/disks/data-flat.vmdk", 2<<30),
+				),
+			},
+			{
+				Config: h.config(testAccVirtualDiskConfig(5)),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("esxi_virtual_disk.data", "virtual_disk_size", "5"),
+					h.checkFileSize("/vmfs/volumes/ds1/disks/data-flat.vmdk", 5<<30),
+				),
+			},
+			{
+				Config:            h.config(testAccVirtualDiskConfig(5)),
+				ResourceName:      "esxi_virtual_disk.data",
+				ImportState:       true,
+				ImportStateVerify: true,
+			},
+		},
+	})
+}
+
+func testAccVirtualDiskConfig(size int) string {
+	return fmt.Sprintf(`
+resource "esxi_virtual_disk" "data" {
+  virtual_disk_disk_store = "ds1"
+  virtual_disk_dir        = "disks"
+  virtual_disk_name       = "data.vmdk"
+  virtual_disk_size       = %d
+  virtual_disk_type       = "zeroedthick"
+}
+`, size)
+}
+
+// checkFileSize checks the size of a file on the fake host
+func (h *testAccHost) checkFileSize(name string, size int64) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		h.host.mu.Lock()
+		defer h.host.mu.Unlock()
+
+		f, ok := h.host.stat(name)
+		if !ok {
+			return fmt.Errorf("%s does not exist", name)
+		}
+		if f.size() != size {
+			return fmt.Errorf("%s: size %d, want %d", name, f.size(), size)
+		}
+		return nil
+	}
+}
+
+func (h *testAccHost) checkVirtualDiskDestroy(s *terraform.State) error {
+	h.host.mu.Lock()
+	defer h.host.mu.Unlock()
+
+	for _, rs := range s.RootModule().Resources {
+		if rs.Type != "esxi_virtual_disk" {
+			continue
+		}
+		if _, ok := h.host.stat(rs.Primary.ID); ok {
+			return fmt.Errorf("virtual disk %s still exists", rs.Primary.ID)
+		}
+	}
+	return nil
+}
+
+func TestFakeHostVirtualDisk(t *testing.T) {
+	host, _, c := testFakeHost(t)
+	r := buildVirtualDiskResourceSchema()
+	raw := map[string]interface{}{
+		"virtual_disk_disk_store": "ds1",
+		"virtual_disk_dir":        "disks",
+		"virtual_disk_name":       "data.vmdk",
+		"virtual_disk_size":       2,
+		"virtual_disk_type":       "zeroedthick",
+	}
+
+	d := testResourceData(t, r, "", raw)
+	if err := r.Create(d, c); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if d.Id() != "/vmfs/volumes/ds1/disks/data.vmdk" {
+		t.Fatalf("id: got %s", d.Id())
+	}
+	if d.Get("virtual_disk_size").(int) != 2 || d.Get("virtual_disk_type").(string) != "zeroedthick" {
+		t.Errorf("read back size %v type %v", d.Get("virtual_disk_size"), d.Get("virtual_disk_type"))
+	}
+
+	raw["virtual_disk_size"] = 5
+	d = testResourceData(t, r, d.Id(), raw)
+	if err := r.Update(d, c); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if f, _ := host.stat("/vmfs/volumes/ds1/disks/data-flat.vmdk"); f == nil || f.size() != 5<<30 {
+		t.Errorf("disk not grown: %v", f)
+	}
+
+	imported, err := testImport(t, r, d.Id(), c)
+	if err != nil || imported.Get("virtual_disk_size").(int) != 5 {
+		t.Errorf("import: %v", err)
+	}
+
+	if err := r.Delete(d, c); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, ok := host.stat(d.Id()); ok {
+		t.Error("disk still exists after delete")
+	}
+}
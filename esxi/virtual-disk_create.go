@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -12,6 +13,8 @@ import (
 // createVirtualDiskResource creates a virtual disk resource
 func createVirtualDiskResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutCreate))
+	defer cancel()
 	log.Println("[resourceVIRTUALDISKCreate]")
 
 	virtualDiskDiskStore := d.Get("virtual_disk_disk_store").(string)
@@ -32,21 +35,15 @@ func createVirtualDiskResource(d *schema.ResourceData, m interface{}) error {
 		virtualDiskName = fmt.Sprintf("vdisk_%s.vmdk", name)
 	}
 
-	//
-	//  Validate virtual_disk_name
-	//
-
-	// todo,  check invalid chars (quotes, slash, period, comma)
-	// todo,  must end with .vmdk
-
-	virtDiskID, err := createVirtualDisk(c, virtualDiskDiskStore, virtualDiskDir,
+	virtDiskID, err := createVirtualDisk(ctx, c, virtualDiskDiskStore, virtualDiskDir,
 		virtualDiskName, virtualDiskSize, virtualDiskType)
 	if err == nil {
 		d.SetId(virtDiskID)
 	} else {
 		log.Println("[resourceVIRTUALDISKCreate] Error: " + err.Error())
 		d.SetId("")
-		return fmt.Errorf("Failed to create virtual Disk: %s\nError: %s", virtualDiskName, err.Error())
+		return permissionDeniedError(c, "create virtual disk "+virtualDiskName,
+			fmt.Errorf("Failed to create virtual Disk: %s\nError: %w", virtualDiskName, err))
 	}
 
 	return nil
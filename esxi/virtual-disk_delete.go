@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -11,10 +12,12 @@ import (
 // deleteVirtualDiskResource deletes the virtual disk resource
 func deleteVirtualDiskResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutDelete))
+	defer cancel()
 	log.Println("[resourceVIRTUALDISKDelete]")
 
-	var remoteCmd, stdout string
+	var remoteCmd string
+	var result remoteCmdResult
 	var err error
 
 	virtualDiskID := d.Id()
@@ -22,26 +25,25 @@ func deleteVirtualDiskResource(d *schema.ResourceData, m interface{}) error {
 	virtualDiskDir := d.Get("virtual_disk_dir").(string)
 
 	//  Destroy virtual disk.
-	remoteCmd = fmt.Sprintf("/bin/vmkfstools -U %s", virtualDiskID)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "destroy virtual disk")
+	remoteCmd = shellCommand("/bin/vmkfstools", "-U", virtualDiskID)
+	_, err = c.runRetryingHostBusy(ctx, remoteCmd, "destroy virtual disk")
 	if err != nil {
-		if strings.Contains(err.Error(), "Process exited with status 255") == true {
+		if isRemoteNotFound(err) {
 			log.Printf("[resourceVIRTUALDISKDelete] Already deleted:%s", virtualDiskID)
 		} else {
-			// todo more descriptive err message
-			log.Printf("[resourceVIRTUALDISKDelete] Failed destroy virtual disk id: %s\n", stdout)
-			return err
+			log.Printf("[resourceVIRTUALDISKDelete] Failed destroy virtual disk id: %s\n", err)
+			return permissionDeniedError(c, "destroy virtual disk "+virtualDiskID, err)
 		}
 	}
 
 	//  Delete dir if it's empty
-	remoteCmd = fmt.Sprintf("ls -al \"/vmfs/volumes/%s/%s/\" |wc -l", virtualDiskDiskStore, virtualDiskDir)
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Check if Storage dir is empty")
-	if stdout == "3" {
+	remoteCmd = shellCommand("ls", "-al", fmt.Sprintf("/vmfs/volumes/%s/%s/", virtualDiskDiskStore, virtualDiskDir)) + " |wc -l"
+	result, err = c.executor.runReadOnly(ctx, remoteCmd, "Check if Storage dir is empty")
+	if strings.TrimSpace(result.stdout) == "3" {
 		{
 			//  Delete empty dir.  Ignore stdout and errors.
-			remoteCmd = fmt.Sprintf("rmdir \"/vmfs/volumes/%s/%s\"", virtualDiskDiskStore, virtualDiskDir)
-			_, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "rmdir empty Storage dir")
+			remoteCmd = shellCommand("rmdir", fmt.Sprintf("/vmfs/volumes/%s/%s", virtualDiskDiskStore, virtualDiskDir))
+			_, _ = c.executor.run(ctx, remoteCmd, "rmdir empty Storage dir")
 		}
 	}
 
@@ -1,53 +1,58 @@
 package esxi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 // validateDiskStore checks that the requested disk store exists
-func validateDiskStore(c *Config, diskStore string) error {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func validateDiskStore(ctx context.Context, c *Config, diskStore string) error {
 	log.Printf("[diskStoreValidate]\n")
 
-	var remoteCmd, stdout string
-	var err error
-
 	//
 	//  Check if Disk Store already exists
 	//
-	remoteCmd = fmt.Sprintf("esxcli storage filesystem list | grep '/vmfs/volumes/.*[VMFS|NFS]' | awk '{print $2}'")
-	stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Get list of disk stores")
+	diskStores, err := c.hostDatastores(ctx)
 	if err != nil {
-		return fmt.Errorf("Unable to get list of disk stores: %s", err)
+		return err
 	}
-	log.Printf("1: Available Disk Stores: %s\n", strings.Replace(stdout, "\n", " ", -1))
+	log.Printf("1: Available Disk Stores: %s\n", strings.Join(diskStores, " "))
 
-	if strings.Contains(stdout, diskStore) == false {
-		remoteCmd = fmt.Sprintf("esxcli storage filesystem rescan")
-		_, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "Refresh filesystems")
+	if hasDiskStore(diskStores, diskStore) == false {
+		remoteCmd := fmt.Sprintf("esxcli storage filesystem rescan")
+		_, _ = c.executor.run(ctx, remoteCmd, "Refresh filesystems")
+		c.invalidateInventory(inventoryDatastores)
 
-		remoteCmd = fmt.Sprintf("esxcli storage filesystem list | grep '/vmfs/volumes/.*[VMFS|NFS]' | awk '{print $2}'")
-		stdout, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Get list of disk stores")
+		diskStores, err = c.hostDatastores(ctx)
 		if err != nil {
-			return fmt.Errorf("Unable to get list of disk stores: %s", err)
+			return err
 		}
-		log.Printf("2: Available Disk Stores: %s\n", strings.Replace(stdout, "\n", " ", -1))
+		log.Printf("2: Available Disk Stores: %s\n", strings.Join(diskStores, " "))
 
-		if strings.Contains(stdout, diskStore) == false {
-			return fmt.Errorf("Disk Store %s does not exist.\nAvailable Disk Stores: %s", diskStore, stdout)
+		if hasDiskStore(diskStores, diskStore) == false {
+			return fmt.Errorf("Disk Store %s does not exist.\nAvailable Disk Stores: %s", diskStore, strings.Join(diskStores, "\n"))
 		}
 	}
 	return nil
 }
 
+func hasDiskStore(diskStores []string, diskStore string) bool {
+	for _, name := range diskStores {
+		if name == diskStore {
+			return true
+		}
+	}
+	return false
+}
+
 // createVirtualDisk creates the virtual disk on the host
-func createVirtualDisk(c *Config, virtDiskDiskStore string, virtDiskDir string,
+func createVirtualDisk(ctx context.Context, c *Config, virtDiskDiskStore string, virtDiskDir string,
 	virtDiskName string, virtDiskSize int, virtDiskType string) (string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
 	log.Println("[virtualDiskCREATE]")
 
 	var virtDiskID, remoteCmd string
@@ -56,7 +61,7 @@ func createVirtualDisk(c *Config, virtDiskDiskStore string, virtDiskDir string,
 	//
 	//  Validate disk store exists
 	//
-	err = validateDiskStore(c, virtDiskDiskStore)
+	err = validateDiskStore(ctx, c, virtDiskDiskStore)
 	if err != nil {
 		return "", err
 	}
@@ -64,12 +69,15 @@ func createVirtualDisk(c *Config, virtDiskDiskStore string, virtDiskDir string,
 	//
 	//  Create dir if required
 	//
-	remoteCmd = fmt.Sprintf("mkdir -p \"/vmfs/volumes/%s/%s\"", virtDiskDiskStore, virtDiskDir)
-	_, _ = runCommandOnHost(esxiSSHinfo, remoteCmd, "create virtual disk dir")
+	remoteCmd = shellCommand("mkdir", "-p", fmt.Sprintf("/vmfs/volumes/%s/%s", virtDiskDiskStore, virtDiskDir))
+	_, mkdirErr := c.executor.run(ctx, remoteCmd, "create virtual disk dir")
 
-	remoteCmd = fmt.Sprintf("ls -d \"/vmfs/volumes/%s/%s\"", virtDiskDiskStore, virtDiskDir)
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "validate dir exists")
+	remoteCmd = shellCommand("ls", "-d", fmt.Sprintf("/vmfs/volumes/%s/%s", virtDiskDiskStore, virtDiskDir))
+	_, err = c.executor.runReadOnly(ctx, remoteCmd, "validate dir exists")
 	if err != nil {
+		if mkdirErr != nil {
+			return "", fmt.Errorf("Unable to create virtual_disk directory: %w", mkdirErr)
+		}
 		return "", errors.New("Unable to create virtual_disk directory")
 	}
 
@@ -81,39 +89,37 @@ func createVirtualDisk(c *Config, virtDiskDiskStore string, virtDiskDir string,
 	//
 	//  Validate if it exists already
 	//
-	remoteCmd = fmt.Sprintf("ls -l \"%s\"", virtDiskID)
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "validate disk store exists")
+	remoteCmd = shellCommand("ls", "-l", virtDiskID)
+	_, err = c.executor.runReadOnly(ctx, remoteCmd, "validate disk store exists")
 	if err == nil {
 		log.Println("[virtualDiskCREATE]  Already exists.")
 		return virtDiskID, err
 	}
 
-	remoteCmd = fmt.Sprintf("/bin/vmkfstools -c %dG -d %s \"%s\"", virtDiskSize,
-		virtDiskType, virtDiskID)
-	_, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Create virtual_disk")
+	remoteCmd = shellCommand("/bin/vmkfstools", "-c", fmt.Sprintf("%dG", virtDiskSize), "-d", virtDiskType, virtDiskID)
+	_, err = c.executor.run(ctx, remoteCmd, "Create virtual_disk")
 	if err != nil {
-		return "", errors.New("Unable to create virtual_disk")
+		return "", fmt.Errorf("Unable to create virtual_disk: %w", err)
 	}
 
 	return virtDiskID, err
 }
 
 // growVirtualDisk grows the virtual disk to the intended size
-func growVirtualDisk(c *Config, virtDiskID string, virtDiskSize string) error {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func growVirtualDisk(ctx context.Context, c *Config, virtDiskID string, virtDiskSize string) error {
 	log.Printf("[growVirtualDisk]\n")
 
 	var newDiskSize int
 
-	_, _, _, currentDiskSize, _, err := readVirtualDiskInfo(c, virtDiskID)
+	_, _, _, currentDiskSize, _, err := readVirtualDiskInfo(ctx, c, virtDiskID)
 
 	newDiskSize, _ = strconv.Atoi(virtDiskSize)
 
 	log.Printf("[growVirtualDisk] currentDiskSize:%d new_size:%d fullPATH: %s\n", currentDiskSize, newDiskSize, virtDiskID)
 
 	if currentDiskSize < newDiskSize {
-		remoteCmd := fmt.Sprintf("/bin/vmkfstools -X %dG \"%s\"", newDiskSize, virtDiskID)
-		_, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "grow disk")
+		remoteCmd := shellCommand("/bin/vmkfstools", "-X", fmt.Sprintf("%dG", newDiskSize), virtDiskID)
+		_, err := c.executor.run(ctx, remoteCmd, "grow disk")
 		if err != nil {
 			return err
 		}
@@ -123,12 +129,11 @@ func growVirtualDisk(c *Config, virtDiskID string, virtDiskSize string) error {
 }
 
 // readVirtualDiskInfo reads the virtual disk info from the host
-func readVirtualDiskInfo(c *Config, virtDiskID string) (string, string, string, int, string, error) {
-	esxiSSHinfo := SSHConnectionSettings{c.esxiHostName, c.esxiHostPort, c.esxiUserName, c.esxiPassword}
+func readVirtualDiskInfo(ctx context.Context, c *Config, virtDiskID string) (string, string, string, int, string, error) {
 	log.Println("[virtualDiskREAD] Begin")
 
 	var virtDiskDiskStore, virtDiskDir, virtDiskName string
-	var virtDiskType, flatSize string
+	var virtDiskType string
 	var virtDiskSize int
 	var flatSizei64 int64
 	var s []string
@@ -144,8 +149,8 @@ func readVirtualDiskInfo(c *Config, virtDiskID string) (string, string, string,
 	virtDiskName = s[5]
 
 	// Test if virtual disk exists
-	remoteCmd := fmt.Sprintf("test -s \"%s\"", virtDiskID)
-	_, err := runCommandOnHost(esxiSSHinfo, remoteCmd, "test if virtual disk exists")
+	remoteCmd := shellCommand("test", "-s", virtDiskID)
+	_, err := c.executor.runReadOnly(ctx, remoteCmd, "test if virtual disk exists")
 	if err != nil {
 		return "", "", "", 0, "", err
 	}
@@ -157,35 +162,60 @@ func readVirtualDiskInfo(c *Config, virtDiskID string) (string, string, string,
 	}
 	virtDiskNameFlat := fmt.Sprintf("%s-flat.%s", s[0], s[1])
 
-	remoteCmd = fmt.Sprintf("ls -l \"/vmfs/volumes/%s/%s/%s\" | awk '{print $5}'",
-		virtDiskDiskStore, virtDiskDir, virtDiskNameFlat)
-	flatSize, err = runCommandOnHost(esxiSSHinfo, remoteCmd, "Get size")
+	remoteCmd = shellCommand("ls", "-l", fmt.Sprintf("/vmfs/volumes/%s/%s/%s", virtDiskDiskStore, virtDiskDir, virtDiskNameFlat))
+	result, err := c.executor.runReadOnly(ctx, remoteCmd, "Get size")
 	if err != nil {
 		return "", "", "", 0, "", err
 	}
-	flatSizei64, _ = strconv.ParseInt(flatSize, 10, 64)
+	flatSizei64 = parseLsSize(result.stdout)
 	virtDiskSize = int(flatSizei64 / 1024 / 1024 / 1024)
 
 	// Determine virtual disk type  (only works if Guest is powered off)
-	remoteCmd = fmt.Sprintf("vmkfstools -t0 %s |grep -q 'VMFS Z- LVID:' && echo true", virtDiskID)
-	isZeroedThick, _ := runCommandOnHost(esxiSSHinfo, remoteCmd, "Get disk type.  Is zeroedthick.")
-
-	remoteCmd = fmt.Sprintf("vmkfstools -t0 %s |grep -q 'VMFS -- LVID:' && echo true", virtDiskID)
-	isEagerZeroedThick, _ := runCommandOnHost(esxiSSHinfo, remoteCmd, "Get disk type.  Is eagerzeroedthick.")
-
-	remoteCmd = fmt.Sprintf("vmkfstools -t0 %s |grep -q 'NOMP -- :' && echo true", virtDiskID)
-	isThin, _ := runCommandOnHost(esxiSSHinfo, remoteCmd, "Get disk type.  Is thin.")
-
-	if isThin == "true" {
-		virtDiskType = "thin"
-	} else if isZeroedThick == "true" {
-		virtDiskType = "zeroedthick"
-	} else if isEagerZeroedThick == "true" {
-		virtDiskType = "eagerzeroedthick"
-	} else {
-		virtDiskType = "Unknown"
-	}
+	remoteCmd = shellCommand("vmkfstools", "-t0", virtDiskID)
+	result, _ = c.executor.runReadOnly(ctx, remoteCmd, "Get disk type")
+	virtDiskType = parseVmkfstoolsDiskType(result.stdout)
 
 	// Return results
 	return virtDiskDiskStore, virtDiskDir, virtDiskName, virtDiskSize, virtDiskType, err
 }
+
+// parseLsSize returns the size of the file listed by ls -l
+func parseLsSize(output string) int64 {
+	fields := strings.Fields(output)
+	if len(fields) < 5 {
+		return 0
+	}
+	size, _ := strconv.ParseInt(fields[4], 10, 64)
+	return size
+}
+
+// vmkfstoolsExtentRe matches an extent of vmkfstools -t0, such as
+// "[ 0: 1048576] --> [VMFS Z- LVID:...", capturing the kind and flags
+var vmkfstoolsExtentRe = regexp.MustCompile(`-->\s*\[(\S+) (\S\S) `)
+
+// parseVmkfstoolsDiskType returns the provisioning of a disk from the
+// extent map printed by vmkfstools -t0.  An unallocated extent means the
+// disk is thin, a zeroed-on-first-write one that it is lazily zeroed.
+func parseVmkfstoolsDiskType(output string) string {
+	thin, lazy, eager := false, false, false
+	for _, m := range vmkfstoolsExtentRe.FindAllStringSubmatch(output, -1) {
+		switch {
+		case m[1] == "NOMP":
+			thin = true
+		case m[1] == "VMFS" && m[2] == "Z-":
+			lazy = true
+		case m[1] == "VMFS" && m[2] == "--":
+			eager = true
+		}
+	}
+
+	switch {
+	case thin:
+		return "thin"
+	case lazy:
+		return "zeroedthick"
+	case eager:
+		return "eagerzeroedthick"
+	}
+	return "Unknown"
+}
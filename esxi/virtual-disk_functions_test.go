@@ -0,0 +1,152 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testFilesystemList returns esxcli --formatter=csv storage filesystem list
+// output with a VMFS volume for each datastore
+func testFilesystemList(datastores ...string) string {
+	output := "Mount Point,Volume Name,UUID,Mounted,Type,Size,Free,\n"
+	for i, ds := range datastores {
+		uuid := fmt.Sprintf("5b1a0000-%08x-0000-000c29000000", i)
+		output += fmt.Sprintf("/vmfs/volumes/%s,%s,%s,true,VMFS-6,536602476544,268301238272,\n", uuid, ds, uuid)
+	}
+	return output
+}
+
+func TestValidateDiskStoreRescan(t *testing.T) {
+	host := newFakeExecutor(t).
+		onNext(`^esxcli --formatter=csv storage filesystem list$`, testFilesystemList("ds1")).
+		on(`^esxcli storage filesystem rescan$`, "").
+		on(`^esxcli --formatter=csv storage filesystem list$`, testFilesystemList("ds1", "ds2"))
+
+	if err := validateDiskStore(context.Background(), testConfig(host), "ds2"); err != nil {
+		t.Errorf("ds2 should be found after rescan: %s", err)
+	}
+	if !host.ran(`rescan`) {
+		t.Errorf("expected a rescan")
+	}
+
+	if err := validateDiskStore(context.Background(), testConfig(host), "ds3"); err == nil {
+		t.Errorf("expected missing disk store error")
+	}
+}
+
+func TestCreateVirtualDisk(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`^esxcli --formatter=csv storage filesystem list$`, testFilesystemList("ds1")).
+		on(`^mkdir -p /vmfs/volumes/ds1/disks$`, "").
+		on(`^ls -d `, "/vmfs/volumes/ds1/disks").
+		onFailure(`^ls -l `, "ls: /vmfs/volumes/ds1/disks/data.vmdk: No such file or directory", 1).
+		on(`^/bin/vmkfstools -c 10G -d thin /vmfs/volumes/ds1/disks/data.vmdk$`, "")
+
+	id, err := createVirtualDisk(context.Background(), testConfig(host), "ds1", "disks", "data.vmdk", 10, "thin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "/vmfs/volumes/ds1/disks/data.vmdk" {
+		t.Errorf("got %s", id)
+	}
+	if !host.ran(`vmkfstools -c`) {
+		t.Errorf("disk not created")
+	}
+}
+
+func TestReadVirtualDiskInfo(t *testing.T) {
+	host := newFakeExecutor(t).
+		on(`^test -s `, "").
+		on(`^ls -l /vmfs/volumes/ds1/disks/data-flat\.vmdk$`,
+			"-rw-------    1 root     root     10737418240 Jan  1 00:00 /vmfs/volumes/ds1/disks/data-flat.vmdk").
+		on(`^vmkfstools -t0 /vmfs/volumes/ds1/disks/data\.vmdk$`, "Mapping for file /vmfs/volumes/ds1/disks/data.vmdk (10737418240 bytes in size):\n"+
+			"[           0:     1048576] --> [VMFS Z- LVID:5b1a0000-00000000-0000-000c29000000/5b1a0000-00000000-0000-000c29000000/1:(   1 -->  2)]\n"+
+			"[     1048576: 10736369664] --> [NOMP -- :        0 -->  10736369664)]")
+
+	diskStore, dir, name, size, diskType, err := readVirtualDiskInfo(context.Background(), testConfig(host), "/vmfs/volumes/ds1/disks/data.vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diskStore != "ds1" || dir != "disks" || name != "data.vmdk" || size != 10 || diskType != "thin" {
+		t.Errorf("got %s %s %s %d %s", diskStore, dir, name, size, diskType)
+	}
+
+	host = newFakeExecutor(t).onFailure(`^test -s `, "", 1)
+	if _, _, _, _, _, err := readVirtualDiskInfo(context.Background(), testConfig(host), "/vmfs/volumes/ds1/disks/gone.vmdk"); err == nil {
+		t.Errorf("expected error for missing disk")
+	}
+}
+
+func TestDeleteVirtualDisk(t *testing.T) {
+	r := buildVirtualDiskResourceSchema()
+	raw := map[string]interface{}{
+		"virtual_disk_disk_store": "ds1",
+		"virtual_disk_dir":        "disks",
+		"virtual_disk_name":       "data.vmdk",
+	}
+	id := "/vmfs/volumes/ds1/disks/data.vmdk"
+
+	// A disk that is already gone is deleted
+	host := newFakeExecutor(t).
+		onFailure(`^/bin/vmkfstools -U `, "Failed to delete virtual disk: The system cannot find the file specified (25).", 255).
+		on(`^ls -al /vmfs/volumes/ds1/disks/ \|wc -l$`, "3\n").
+		on(`^rmdir /vmfs/volumes/ds1/disks$`, "")
+	d := testResourceData(t, r, id, raw)
+	if err := deleteVirtualDiskResource(d, testConfig(host)); err != nil || d.Id() != "" {
+		t.Errorf("missing disk: id %q, %v", d.Id(), err)
+	}
+	if !host.ran(`^rmdir `) {
+		t.Error("empty dir not removed")
+	}
+
+	// Any other failure is returned, whatever the exit status
+	host = newFakeExecutor(t).
+		onFailure(`^/bin/vmkfstools -U `, "Failed to delete virtual disk: Failed to lock the file (16392).", 255)
+	d = testResourceData(t, r, id, raw)
+	if err := deleteVirtualDiskResource(d, testConfig(host)); err == nil || d.Id() != id {
+		t.Errorf("locked disk: id %q, %v", d.Id(), err)
+	}
+
+	// A busy host is tried again
+	host = newFakeExecutor(t).
+		onNextFailure(`^/bin/vmkfstools -U `, "(vim.fault.TaskInProgress) {", 1).
+		on(`^/bin/vmkfstools -U `, "").
+		on(`^ls -al /vmfs/volumes/ds1/disks/ \|wc -l$`, "4\n")
+	c := testConfig(host)
+	c.retryPolicy, _ = newRetryPolicy(3, "1ms", "1ms", nil)
+	d = testResourceData(t, r, id, raw)
+	if err := deleteVirtualDiskResource(d, c); err != nil || d.Id() != "" || host.count(`^/bin/vmkfstools -U `) != 2 {
+		t.Errorf("busy host: id %q, %d attempts, %v", d.Id(), host.count(`^/bin/vmkfstools -U `), err)
+	}
+
+	// A permission failure is not tried again and says so
+	host = newFakeExecutor(t).
+		onFailure(`^/bin/vmkfstools -U `, "Failed to delete virtual disk: Permission denied", 1)
+	c = testConfig(host)
+	c.retryPolicy, _ = newRetryPolicy(3, "1ms", "1ms", nil)
+	d = testResourceData(t, r, id, raw)
+	err := deleteVirtualDiskResource(d, c)
+	if err == nil || !strings.Contains(err.Error(), "Permission denied to destroy virtual disk") || d.Id() != id {
+		t.Errorf("permission denied: id %q, %v", d.Id(), err)
+	}
+	if n := host.count(`^/bin/vmkfstools -U `); n != 1 {
+		t.Errorf("permission denied: %d attempts", n)
+	}
+}
+
+func TestReadVirtualDiskPermissionDenied(t *testing.T) {
+	r := buildVirtualDiskResourceSchema()
+	id := "/vmfs/volumes/ds1/disks/data.vmdk"
+	host := newFakeExecutor(t).
+		on(`^test -s `, "").
+		onFailure(`^ls -l `, "ls: /vmfs/volumes/ds1/disks/data-flat.vmdk: Permission denied", 1)
+
+	// The disk is not dropped from state when the user may not look at it
+	d := testResourceData(t, r, id, map[string]interface{}{})
+	err := readVirtualDiskDataIntoResource(d, testConfig(host))
+	if err == nil || !strings.Contains(err.Error(), "Permission denied to read virtual disk") || d.Id() != id {
+		t.Errorf("id %q, %v", d.Id(), err)
+	}
+}
@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -10,12 +11,14 @@ import (
 // importVirtualDiskDataIntoResource imports virtual disk data from ESXi host into resource
 func importVirtualDiskDataIntoResource(d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
 	log.Println("[resourceVIRTUALDISKImport]")
 
 	results := make([]*schema.ResourceData, 1, 1)
 	results[0] = d
 
-	_, _, _, _, _, err := readVirtualDiskInfo(c, d.Id())
+	_, _, _, _, _, err := readVirtualDiskInfo(ctx, c, d.Id())
 	if err != nil {
 		d.SetId("")
 		return results, fmt.Errorf("Failed to validate virtual_disk: %s", err)
@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"log"
 
 	"github.com/hashicorp/terraform/helper/schema"
@@ -9,9 +10,14 @@ import (
 // readVirtualDiskDataIntoResource reads virtual disk data from ESXi host into resource
 func readVirtualDiskDataIntoResource(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
 	log.Println("[resourceVIRTUALDISKRead]")
 
-	virtualDiskDiskStore, virtualDiskDir, virtualDiskName, virtualDiskSize, virtualDiskType, err := readVirtualDiskInfo(c, d.Id())
+	virtualDiskDiskStore, virtualDiskDir, virtualDiskName, virtualDiskSize, virtualDiskType, err := readVirtualDiskInfo(ctx, c, d.Id())
+	if isRemoteTransient(err) || isRemotePermissionDenied(err) {
+		return permissionDeniedError(c, "read virtual disk "+d.Id(), err)
+	}
 	if err != nil {
 		d.SetId("")
 		return nil
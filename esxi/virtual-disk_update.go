@@ -1,6 +1,7 @@
 package esxi
 
 import (
+	"context"
 	"errors"
 	"log"
 	"strconv"
@@ -11,11 +12,13 @@ import (
 // updateVirtualDisk updates the virtual disk on the host using the size specified in the resource
 func updateVirtualDisk(d *schema.ResourceData, m interface{}) error {
 	c := m.(*Config)
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutUpdate))
+	defer cancel()
 
 	log.Println("[resourceVIRTUALDISKUpdate]")
 
 	if d.HasChange("virtual_disk_size") {
-		_, _, _, currentVirtDiskSize, _, err := readVirtualDiskInfo(c, d.Id())
+		_, _, _, currentVirtDiskSize, _, err := readVirtualDiskInfo(ctx, c, d.Id())
 		if err != nil {
 			d.SetId("")
 			return err
@@ -27,7 +30,7 @@ func updateVirtualDisk(d *schema.ResourceData, m interface{}) error {
 			return errors.New("Not able to shrink virtual disk:" + d.Id())
 		}
 
-		err = growVirtualDisk(c, d.Id(), strconv.Itoa(virtDiskSize))
+		err = growVirtualDisk(ctx, c, d.Id(), strconv.Itoa(virtDiskSize))
 		if err != nil {
 			return errors.New("Failed to grow disk:" + d.Id())
 		}
@@ -1,100 +1,240 @@
 package esxi
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"os"
 	"regexp"
-	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
-// parseVmxFile parses VMX file to map
-func parseVmxFile(contents string) map[string]string {
-	results := make(map[string]string)
+// vmxLineRe matches a key = value line.  Values are normally quoted, but
+// hand-edited files sometimes leave them bare.
+var vmxLineRe = regexp.MustCompile(`^\s*([^#\s=][^=]*?)\s*=\s*(?:"(.*)"|([^"]*?))\s*$`)
+
+// vmxDocument is a parsed vmx file.  It keeps every line in order,
+// including blank lines, comments and lines it does not understand, so
+// an unchanged document encodes to exactly the text it was parsed from.
+// Keys are matched case-insensitively, as ESXi does.  Values are kept
+// unescaped, see vmxEscape.
+type vmxDocument struct {
+	lines []vmxLine
+}
 
-	lineRe := regexp.MustCompile(`^(.+?)\s*=\s*"(.*?)"\s*$`)
+// vmxLine is one line of a vmx file.  key is empty for lines that are not
+// settings.  text is the line as it is written out, value is unescaped.
+type vmxLine struct {
+	text  string
+	key   string
+	value string
+}
 
-	for _, line := range strings.Split(contents, "\n") {
-		matches := lineRe.FindStringSubmatch(line)
-		if matches == nil {
-			continue
+// parseVmx parses the contents of a vmx file
+func parseVmx(contents string) *vmxDocument {
+	doc := &vmxDocument{}
+	for _, text := range strings.Split(contents, "\n") {
+		line := vmxLine{text: text}
+		if matches := vmxLineRe.FindStringSubmatch(strings.TrimSuffix(text, "\r")); matches != nil {
+			line.key = matches[1]
+			line.value = vmxUnescape(matches[2] + matches[3])
 		}
-
-		results[matches[1]] = matches[2]
+		doc.lines = append(doc.lines, line)
 	}
+	return doc
+}
 
-	return results
+// String encodes the document as vmx file contents
+func (doc *vmxDocument) String() string {
+	texts := make([]string, len(doc.lines))
+	for i, line := range doc.lines {
+		texts[i] = line.text
+	}
+	return strings.Join(texts, "\n")
 }
 
-// buildVmxString builds a valid VMX file from a data map
-func buildVmxString(contents map[string]string) string {
-	var buf bytes.Buffer
+// get returns the value of key.  If key is set more than once the last
+// setting wins, as it does for ESXi.
+func (doc *vmxDocument) get(key string) (string, bool) {
+	for i := len(doc.lines) - 1; i >= 0; i-- {
+		if doc.lines[i].key != "" && strings.EqualFold(doc.lines[i].key, key) {
+			return doc.lines[i].value, true
+		}
+	}
+	return "", false
+}
 
-	i := 0
-	keys := make([]string, len(contents))
-	for k := range contents {
-		keys[i] = k
-		i++
+// set sets key to value.  An existing setting is changed in place and any
+// duplicates of it are dropped, a new one is added at the end.
+func (doc *vmxDocument) set(key string, value string) {
+	found := false
+	lines := doc.lines[:0]
+	for _, line := range doc.lines {
+		if line.key != "" && strings.EqualFold(line.key, key) {
+			if found {
+				continue
+			}
+			found = true
+			if line.value != value {
+				line = newVmxLine(line.key, value, strings.HasSuffix(line.text, "\r"))
+			}
+		}
+		lines = append(lines, line)
 	}
+	doc.lines = lines
 
-	sort.Strings(keys)
-	for _, k := range keys {
-		buf.WriteString(fmt.Sprintf("%s = \"%s\"\n", k, contents[k]))
+	if !found {
+		doc.insert(key, value)
 	}
+}
 
-	return buf.String()
+// delete removes every setting of key and reports whether there was one
+func (doc *vmxDocument) delete(key string) bool {
+	return doc.deleteMatching(func(k string) bool {
+		return strings.EqualFold(k, key)
+	}) > 0
 }
 
-// saveVmxDataToDisk saves a map of VMX contents to disk
-func saveVmxDataToDisk(path string, data map[string]string) (err error) {
-	f, err := os.Create(path)
-	if err != nil {
-		return
+// keys returns the keys of the document in file order
+func (doc *vmxDocument) keys() []string {
+	var keys []string
+	for _, line := range doc.lines {
+		if line.key != "" {
+			keys = append(keys, line.key)
+		}
 	}
-	defer f.Close()
+	return keys
+}
 
-	var buf bytes.Buffer
-	buf.WriteString(buildVmxString(data))
-	if _, err = io.Copy(f, &buf); err != nil {
-		return
+// deviceKeys returns the keys of device, such as "ethernet0" or "scsi0:1",
+// in file order.  A device's keys are the device name followed by a period.
+func (doc *vmxDocument) deviceKeys(device string) []string {
+	var keys []string
+	for _, key := range doc.keys() {
+		if isVmxDeviceKey(key, device) {
+			keys = append(keys, key)
+		}
 	}
+	return keys
+}
+
+// deleteDevice removes every setting of device and returns how many there were
+func (doc *vmxDocument) deleteDevice(device string) int {
+	return doc.deleteMatching(func(k string) bool {
+		return isVmxDeviceKey(k, device)
+	})
+}
 
-	return
+// values returns the settings of the document as a map
+func (doc *vmxDocument) values() map[string]string {
+	results := make(map[string]string)
+	for _, line := range doc.lines {
+		if line.key != "" {
+			results[line.key] = line.value
+		}
+	}
+	return results
 }
 
-// saveVmxStringToDisk saves VMX contents string to disk
-func saveVmxStringToDisk(fileName string, data string) (err error) {
+// insert adds a setting at the end of the document, keeping a final
+// newline last.  The new line ends like the first line of the document.
+func (doc *vmxDocument) insert(key string, value string) {
+	crlf := len(doc.lines) > 0 && strings.HasSuffix(doc.lines[0].text, "\r")
 
-	file, err := os.Create(fileName)
-	if err != nil {
+	n := len(doc.lines)
+	if n > 0 && doc.lines[n-1].text == "" {
+		doc.lines = append(doc.lines[:n-1], newVmxLine(key, value, crlf), doc.lines[n-1])
 		return
 	}
-	defer file.Close()
 
-	_, err = io.WriteString(file, data)
+	//  No final newline, so the new line goes last without one.
+	if n > 0 && crlf {
+		doc.lines[n-1].text += "\r"
+	}
+	doc.lines = append(doc.lines, newVmxLine(key, value, false))
+}
 
-	if err != nil {
-		return
+func (doc *vmxDocument) deleteMatching(match func(key string) bool) int {
+	deleted := 0
+	lines := doc.lines[:0]
+	for _, line := range doc.lines {
+		if line.key != "" && match(line.key) {
+			deleted++
+			continue
+		}
+		lines = append(lines, line)
 	}
-	return file.Sync()
+	doc.lines = lines
+	return deleted
 }
 
-// deleteVmx deletes VMX file from local disk
-func deleteVmx(fileName string) (err error) {
-	err = os.Remove(fileName)
+func newVmxLine(key string, value string, crlf bool) vmxLine {
+	text := fmt.Sprintf("%s = \"%s\"", key, vmxEscape(value))
+	if crlf {
+		text += "\r"
+	}
+	return vmxLine{
+		text:  text,
+		key:   key,
+		value: value,
+	}
+}
 
-	return
+func isVmxDeviceKey(key string, device string) bool {
+	return len(key) > len(device) && key[len(device)] == '.' && strings.EqualFold(key[:len(device)], device)
 }
 
-// getVmxFileFromPath gets the VMX file name from a path string
-func getVmxFileFromPath(path string) string {
-	if !strings.Contains(path, "/") {
-		return path
+// parseVmxFile parses VMX file to map
+func parseVmxFile(contents string) map[string]string {
+	return parseVmx(contents).values()
+}
+
+// vmxEscape escapes value for a vmx file the way ESXi does.  Quotes, '|',
+// '#', control characters and bytes that are not UTF-8 are written as '|'
+// and two hex digits, so any value fits on one line and reads back unchanged.
+func vmxEscape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		switch {
+		case r == utf8.RuneError && size == 1, r < 0x20, r == 0x7f, r == '"', r == '|', r == '#':
+			fmt.Fprintf(&b, "|%02X", value[i])
+		default:
+			b.WriteString(value[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// vmxUnescape reverses vmxEscape.  A '|' that is not followed by two hex
+// digits is kept as it is.
+func vmxUnescape(value string) string {
+	if !strings.Contains(value, "|") {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '|' && i+2 < len(value) && isHexDigit(value[i+1]) && isHexDigit(value[i+2]) {
+			b.WriteByte(unhex(value[i+1])<<4 | unhex(value[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(value[i])
 	}
+	return b.String()
+}
 
-	pathFragments := strings.Split(path, "/")
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
 
-	return pathFragments[len(pathFragments)-1]
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c >= 'a':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
 }
@@ -0,0 +1,379 @@
+package esxi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	vmxControllerRe = regexp.MustCompile(`(?i)^(scsi|sata|nvme)([0-9]+)\.`)
+	vmxUnitRe       = regexp.MustCompile(`(?i)^(scsi|sata|nvme|ide)([0-9]+):([0-9]+)\.`)
+	vmxEthernetRe   = regexp.MustCompile(`(?i)^ethernet([0-9]+)\.`)
+	vmxPCIBridgeRe  = regexp.MustCompile(`(?i)^pciBridge([0-9]+)\.`)
+)
+
+// vmxManagedKeys are the guest settings the provider writes itself, on top
+// of guestinfo and the settings of the devices in the model
+var vmxManagedKeys = []string{
+	".encoding",
+	"config.version",
+	"displayName",
+	"memSize",
+	"numvcpus",
+	"virtualHW.version",
+	"guestOS",
+	"annotation",
+}
+
+// vmxHardware is the virtual hardware of a guest.  It is parsed from a vmx
+// document, changed, and written back with apply.  Only the settings the
+// model knows about are written, everything else in the document is left
+// as it was, except the settings of devices that were removed.
+type vmxHardware struct {
+	controllers []*vmxController
+	disks       []*vmxDisk
+	cdroms      []*vmxCdrom
+	ethernets   []*vmxEthernet
+	pciBridges  []*vmxPCIBridge
+
+	// parsed holds the names of the devices read from the document
+	parsed []string
+}
+
+// vmxDevice is a device that renders itself into a vmx document
+type vmxDevice interface {
+	name() string
+	render(doc *vmxDocument)
+}
+
+// vmxController is a SCSI, SATA or NVMe controller
+type vmxController struct {
+	bus        string // scsi, sata or nvme
+	index      int
+	virtualDev string // lsilogic, pvscsi or lsisas1068 for scsi
+	sharedBus  string
+}
+
+// vmxDisk is a hard disk on a controller
+type vmxDisk struct {
+	bus        string
+	controller int
+	unit       int
+	fileName   string
+	deviceType string // scsi-hardDisk for scsi, empty for sata and nvme
+}
+
+// vmxCdrom is a CD-ROM drive on an IDE or SATA controller
+type vmxCdrom struct {
+	bus            string
+	controller     int
+	unit           int
+	fileName       string
+	deviceType     string // cdrom-image, atapi-cdrom or cdrom-raw
+	startConnected string
+	clientDevice   string
+}
+
+// vmxEthernet is a network adapter
+type vmxEthernet struct {
+	index       int
+	networkName string
+	virtualDev  string
+	addressType string // generated, static or vpx
+	address     string // set with addressType static
+
+	// generatedAddress is assigned by ESXi and never written
+	generatedAddress string
+}
+
+// vmxPCIBridge is a PCI bridge or PCIe root port
+type vmxPCIBridge struct {
+	index      int
+	virtualDev string
+	functions  string
+}
+
+// parseVmxHardware reads the devices of doc.  Devices that are not present
+// and units that are neither a disk nor a CD-ROM are not part of the model.
+func parseVmxHardware(doc *vmxDocument) *vmxHardware {
+	hw := &vmxHardware{}
+	seen := make(map[string]bool)
+
+	for _, key := range doc.keys() {
+		var device vmxDevice
+
+		if m := vmxUnitRe.FindStringSubmatch(key); m != nil {
+			device = parseVmxUnit(doc, strings.ToLower(m[1]), atoi(m[2]), atoi(m[3]))
+		} else if m := vmxControllerRe.FindStringSubmatch(key); m != nil {
+			device = &vmxController{bus: strings.ToLower(m[1]), index: atoi(m[2])}
+		} else if m := vmxEthernetRe.FindStringSubmatch(key); m != nil {
+			device = &vmxEthernet{index: atoi(m[1])}
+		} else if m := vmxPCIBridgeRe.FindStringSubmatch(key); m != nil {
+			device = &vmxPCIBridge{index: atoi(m[1])}
+		}
+		if device == nil || seen[strings.ToLower(device.name())] {
+			continue
+		}
+		seen[strings.ToLower(device.name())] = true
+
+		if present, _ := doc.get(device.name() + ".present"); !strings.EqualFold(present, "true") {
+			continue
+		}
+		hw.parsed = append(hw.parsed, device.name())
+
+		switch device := device.(type) {
+		case *vmxController:
+			device.virtualDev, _ = doc.get(device.name() + ".virtualDev")
+			device.sharedBus, _ = doc.get(device.name() + ".sharedBus")
+			hw.controllers = append(hw.controllers, device)
+		case *vmxDisk:
+			hw.disks = append(hw.disks, device)
+		case *vmxCdrom:
+			hw.cdroms = append(hw.cdroms, device)
+		case *vmxEthernet:
+			device.networkName, _ = doc.get(device.name() + ".networkName")
+			device.virtualDev, _ = doc.get(device.name() + ".virtualDev")
+			device.addressType, _ = doc.get(device.name() + ".addressType")
+			device.address, _ = doc.get(device.name() + ".address")
+			device.generatedAddress, _ = doc.get(device.name() + ".generatedAddress")
+			hw.ethernets = append(hw.ethernets, device)
+		case *vmxPCIBridge:
+			device.virtualDev, _ = doc.get(device.name() + ".virtualDev")
+			device.functions, _ = doc.get(device.name() + ".functions")
+			hw.pciBridges = append(hw.pciBridges, device)
+		}
+	}
+
+	return hw
+}
+
+// parseVmxUnit reads the unit at bus controller:unit as a disk or a CD-ROM
+func parseVmxUnit(doc *vmxDocument, bus string, controller int, unit int) vmxDevice {
+	prefix := fmt.Sprintf("%s%d:%d.", bus, controller, unit)
+	fileName, hasFile := doc.get(prefix + "fileName")
+	deviceType, _ := doc.get(prefix + "deviceType")
+
+	if strings.Contains(strings.ToLower(deviceType), "cdrom") {
+		cdrom := &vmxCdrom{bus: bus, controller: controller, unit: unit, fileName: fileName, deviceType: deviceType}
+		cdrom.startConnected, _ = doc.get(prefix + "startConnected")
+		cdrom.clientDevice, _ = doc.get(prefix + "clientDevice")
+		return cdrom
+	}
+	if hasFile && bus != "ide" {
+		return &vmxDisk{bus: bus, controller: controller, unit: unit, fileName: fileName, deviceType: deviceType}
+	}
+	return nil
+}
+
+// apply writes the hardware into doc.  Every setting of a device that was
+// parsed from doc but is no longer in the model is removed.
+func (hw *vmxHardware) apply(doc *vmxDocument) {
+	devices := hw.devices()
+
+	current := make(map[string]bool)
+	for _, device := range devices {
+		current[strings.ToLower(device.name())] = true
+	}
+	for _, name := range hw.parsed {
+		if !current[strings.ToLower(name)] {
+			doc.deleteDevice(name)
+			doc.deleteDevice("sched." + name)
+		}
+	}
+
+	for _, device := range devices {
+		device.render(doc)
+	}
+
+	hw.parsed = hw.parsed[:0]
+	for _, device := range devices {
+		hw.parsed = append(hw.parsed, device.name())
+	}
+}
+
+// devices returns every device of the model in the order they are rendered
+func (hw *vmxHardware) devices() []vmxDevice {
+	var devices []vmxDevice
+	for _, device := range hw.pciBridges {
+		devices = append(devices, device)
+	}
+	for _, device := range hw.controllers {
+		devices = append(devices, device)
+	}
+	for _, device := range hw.disks {
+		devices = append(devices, device)
+	}
+	for _, device := range hw.cdroms {
+		devices = append(devices, device)
+	}
+	for _, device := range hw.ethernets {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// controller returns the controller bus index, or nil if there is none
+func (hw *vmxHardware) controller(bus string, index int) *vmxController {
+	for _, c := range hw.controllers {
+		if c.bus == bus && c.index == index {
+			return c
+		}
+	}
+	return nil
+}
+
+// removeDisks removes every disk for which match returns true
+func (hw *vmxHardware) removeDisks(match func(disk *vmxDisk) bool) {
+	disks := hw.disks[:0]
+	for _, disk := range hw.disks {
+		if !match(disk) {
+			disks = append(disks, disk)
+		}
+	}
+	hw.disks = disks
+}
+
+// attachDisk puts fileName in SCSI slot controller:unit, adding the
+// controller if the guest does not have it yet.  New controllers are the
+// same type as scsi0.
+func (hw *vmxHardware) attachDisk(controller int, unit int, fileName string) {
+	if hw.controller("scsi", controller) == nil {
+		virtualDev := "lsilogic"
+		if scsi0 := hw.controller("scsi", 0); scsi0 != nil && scsi0.virtualDev != "" {
+			virtualDev = scsi0.virtualDev
+		}
+		hw.controllers = append(hw.controllers, &vmxController{bus: "scsi", index: controller, virtualDev: virtualDev})
+		sort.SliceStable(hw.controllers, func(i, j int) bool {
+			return hw.controllers[i].name() < hw.controllers[j].name()
+		})
+	}
+
+	hw.removeDisks(func(disk *vmxDisk) bool {
+		return disk.bus == "scsi" && disk.controller == controller && disk.unit == unit
+	})
+	hw.disks = append(hw.disks, &vmxDisk{
+		bus:        "scsi",
+		controller: controller,
+		unit:       unit,
+		fileName:   fileName,
+		deviceType: "scsi-hardDisk",
+	})
+}
+
+// ethernet returns network adapter index, or nil if there is none
+func (hw *vmxHardware) ethernet(index int) *vmxEthernet {
+	for _, e := range hw.ethernets {
+		if e.index == index {
+			return e
+		}
+	}
+	return nil
+}
+
+// removeEthernet removes network adapter index
+func (hw *vmxHardware) removeEthernet(index int) {
+	ethernets := hw.ethernets[:0]
+	for _, e := range hw.ethernets {
+		if e.index != index {
+			ethernets = append(ethernets, e)
+		}
+	}
+	hw.ethernets = ethernets
+}
+
+func (c *vmxController) name() string {
+	return fmt.Sprintf("%s%d", c.bus, c.index)
+}
+
+func (c *vmxController) render(doc *vmxDocument) {
+	setVmxPresent(doc, c.name())
+	setVmxOptional(doc, c.name()+".sharedBus", c.sharedBus)
+	setVmxOptional(doc, c.name()+".virtualDev", c.virtualDev)
+}
+
+func (d *vmxDisk) name() string {
+	return fmt.Sprintf("%s%d:%d", d.bus, d.controller, d.unit)
+}
+
+func (d *vmxDisk) render(doc *vmxDocument) {
+	setVmxPresent(doc, d.name())
+	doc.set(d.name()+".fileName", d.fileName)
+	setVmxOptional(doc, d.name()+".deviceType", d.deviceType)
+}
+
+func (d *vmxCdrom) name() string {
+	return fmt.Sprintf("%s%d:%d", d.bus, d.controller, d.unit)
+}
+
+func (d *vmxCdrom) render(doc *vmxDocument) {
+	setVmxPresent(doc, d.name())
+	doc.set(d.name()+".fileName", d.fileName)
+	doc.set(d.name()+".deviceType", d.deviceType)
+	setVmxOptional(doc, d.name()+".startConnected", d.startConnected)
+	setVmxOptional(doc, d.name()+".clientDevice", d.clientDevice)
+}
+
+func (e *vmxEthernet) name() string {
+	return fmt.Sprintf("ethernet%d", e.index)
+}
+
+func (e *vmxEthernet) render(doc *vmxDocument) {
+	doc.set(e.name()+".networkName", e.networkName)
+	setVmxOptional(doc, e.name()+".addressType", e.addressType)
+	setVmxOptional(doc, e.name()+".address", e.address)
+	setVmxOptional(doc, e.name()+".virtualDev", e.virtualDev)
+	setVmxPresent(doc, e.name())
+}
+
+func (b *vmxPCIBridge) name() string {
+	return fmt.Sprintf("pciBridge%d", b.index)
+}
+
+func (b *vmxPCIBridge) render(doc *vmxDocument) {
+	setVmxPresent(doc, b.name())
+	setVmxOptional(doc, b.name()+".virtualDev", b.virtualDev)
+	setVmxOptional(doc, b.name()+".functions", b.functions)
+}
+
+// isManagedVmxKey reports whether the provider writes key itself.  Device
+// scheduling settings count too, since they go when the device does.
+func isManagedVmxKey(key string) bool {
+	for _, managed := range vmxManagedKeys {
+		if strings.EqualFold(key, managed) {
+			return true
+		}
+	}
+	if len(key) > len("sched.") && strings.EqualFold(key[:len("sched.")], "sched.") {
+		key = key[len("sched."):]
+	}
+	return strings.HasPrefix(strings.ToLower(key), "guestinfo.") ||
+		vmxUnitRe.MatchString(key) ||
+		vmxControllerRe.MatchString(key) ||
+		vmxEthernetRe.MatchString(key) ||
+		vmxPCIBridgeRe.MatchString(key)
+}
+
+// setVmxPresent marks device present, leaving a present setting that
+// already says so as it is
+func setVmxPresent(doc *vmxDocument, device string) {
+	if present, _ := doc.get(device + ".present"); !strings.EqualFold(present, "true") {
+		doc.set(device+".present", "TRUE")
+	}
+}
+
+// setVmxOptional sets key to value, or removes key when value is empty
+func setVmxOptional(doc *vmxDocument, key string, value string) {
+	if value == "" {
+		doc.delete(key)
+		return
+	}
+	doc.set(key, value)
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
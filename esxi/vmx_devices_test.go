@@ -0,0 +1,141 @@
+package esxi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseVmxHardware(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "vmx", "esxi67.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := parseVmx(string(data))
+	hw := parseVmxHardware(doc)
+
+	if len(hw.controllers) != 2 || hw.controllers[0].name() != "scsi0" || hw.controllers[0].virtualDev != "lsilogic" ||
+		hw.controllers[1].name() != "sata0" {
+		t.Errorf("controllers: %+v", hw.controllers)
+	}
+	if len(hw.disks) != 1 || hw.disks[0].name() != "scsi0:0" || hw.disks[0].fileName != "web01.vmdk" {
+		t.Errorf("disks: %+v", hw.disks)
+	}
+	if len(hw.ethernets) != 2 {
+		t.Fatalf("ethernets: %+v", hw.ethernets)
+	}
+	if e := hw.ethernet(0); e.networkName != "VM Network" || e.virtualDev != "vmxnet3" ||
+		e.addressType != "generated" || e.generatedAddress != "00:0c:29:27:b4:13" {
+		t.Errorf("ethernet0: %+v", e)
+	}
+	if e := hw.ethernet(1); e.addressType != "static" || e.address != "00:50:56:01:02:03" {
+		t.Errorf("ethernet1: %+v", e)
+	}
+
+	// Writing back an unchanged model changes nothing.
+	hw.apply(doc)
+	if doc.String() != string(data) {
+		t.Errorf("unchanged hardware rewrote the document:\n%s", doc)
+	}
+}
+
+func TestVmxHardwareRemoveEthernet(t *testing.T) {
+	doc := parseVmx(`ethernet1.present = "TRUE"
+ethernet1.networkName = "one"
+ethernet10.present = "TRUE"
+ethernet10.networkName = "ten"
+ethernet1x.networkName = "not a device"
+ethernet11.present = "FALSE"
+ethernet11.networkName = "eleven"
+`)
+
+	hw := parseVmxHardware(doc)
+	if len(hw.ethernets) != 2 {
+		t.Fatalf("ethernets: %+v", hw.ethernets)
+	}
+	hw.removeEthernet(1)
+	hw.apply(doc)
+
+	expected := `ethernet10.present = "TRUE"
+ethernet10.networkName = "ten"
+ethernet1x.networkName = "not a device"
+ethernet11.present = "FALSE"
+ethernet11.networkName = "eleven"
+`
+	if doc.String() != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", doc, expected)
+	}
+}
+
+func TestVmxHardwareAttachDisk(t *testing.T) {
+	doc := parseVmx(`scsi0.present = "TRUE"
+scsi0.virtualDev = "pvscsi"
+scsi0:0.present = "TRUE"
+scsi0:0.fileName = "web01.vmdk"
+scsi0:1.present = "TRUE"
+scsi0:1.fileName = "/vmfs/volumes/ds1/old/old.vmdk"
+scsi0:1.deviceType = "scsi-hardDisk"
+scsi0:1.present = "TRUE"
+sched.scsi0:1.shares = "normal"
+scsi0:12.present = "TRUE"
+scsi0:12.fileName = "/vmfs/volumes/ds1/keep/keep.vmdk"
+`)
+
+	hw := parseVmxHardware(doc)
+	hw.removeDisks(func(disk *vmxDisk) bool {
+		return disk.name() == "scsi0:1"
+	})
+	hw.attachDisk(0, 2, "/vmfs/volumes/ds1/new/new.vmdk")
+	hw.attachDisk(1, 0, "/vmfs/volumes/ds1/other/other.vmdk")
+	hw.apply(doc)
+
+	expected := `scsi0.present = "TRUE"
+scsi0.virtualDev = "pvscsi"
+scsi0:0.present = "TRUE"
+scsi0:0.fileName = "web01.vmdk"
+scsi0:12.present = "TRUE"
+scsi0:12.fileName = "/vmfs/volumes/ds1/keep/keep.vmdk"
+scsi1.present = "TRUE"
+scsi1.virtualDev = "pvscsi"
+scsi0:2.present = "TRUE"
+scsi0:2.fileName = "/vmfs/volumes/ds1/new/new.vmdk"
+scsi0:2.deviceType = "scsi-hardDisk"
+scsi1:0.present = "TRUE"
+scsi1:0.fileName = "/vmfs/volumes/ds1/other/other.vmdk"
+scsi1:0.deviceType = "scsi-hardDisk"
+`
+	if doc.String() != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", doc, expected)
+	}
+
+	// Attaching to a used slot replaces the disk without repeating settings.
+	hw.attachDisk(0, 2, "/vmfs/volumes/ds1/newer/newer.vmdk")
+	hw.apply(doc)
+	if n := strings.Count(doc.String(), "scsi0:2.present"); n != 1 {
+		t.Errorf("scsi0:2.present written %d times:\n%s", n, doc)
+	}
+	if v, _ := doc.get("scsi0:2.fileName"); v != "/vmfs/volumes/ds1/newer/newer.vmdk" {
+		t.Errorf("scsi0:2.fileName = %s", v)
+	}
+}
+
+func TestVmxHardwareCdrom(t *testing.T) {
+	doc := parseVmx(`ide1:0.present = "TRUE"
+ide1:0.fileName = "/vmfs/volumes/ds1/iso/centos.iso"
+ide1:0.deviceType = "cdrom-image"
+sata0:1.present = "TRUE"
+sata0:1.deviceType = "atapi-cdrom"
+sata0:1.fileName = "emptyBackingString"
+sata0:1.clientDevice = "TRUE"
+`)
+
+	hw := parseVmxHardware(doc)
+	if len(hw.cdroms) != 2 || len(hw.disks) != 0 {
+		t.Fatalf("cdroms: %+v disks: %+v", hw.cdroms, hw.disks)
+	}
+	if hw.cdroms[0].name() != "ide1:0" || hw.cdroms[0].fileName != "/vmfs/volumes/ds1/iso/centos.iso" ||
+		hw.cdroms[1].name() != "sata0:1" || hw.cdroms[1].clientDevice != "TRUE" {
+		t.Errorf("cdroms: %+v %+v", hw.cdroms[0], hw.cdroms[1])
+	}
+}
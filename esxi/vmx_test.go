@@ -1,6 +1,15 @@
 package esxi
 
-import "testing"
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
 
 func TestParseVMX(t *testing.T) {
 	contents := `
@@ -23,17 +32,183 @@ config.version = "8"
 }
 
 func TestEncodeVMX(t *testing.T) {
-	contents := map[string]string{
-		".encoding":      "UTF-8",
-		"config.version": "8",
-	}
+	doc := parseVmx("")
+	doc.set(".encoding", "UTF-8")
+	doc.set("config.version", "8")
 
 	expected := `.encoding = "UTF-8"
 config.version = "8"
 `
 
-	result := buildVmxString(contents)
+	result := doc.String()
 	if result != expected {
 		t.Errorf("invalid results: %s", result)
 	}
 }
+
+func TestVmxDocument(t *testing.T) {
+	doc := parseVmx(`# comment
+memSize = "1024"
+numvcpus = "1"
+scsi0:1.fileName = "data.vmdk"
+scsi0:1.present = "TRUE"
+scsi0:10.present = "TRUE"
+numvcpus = "2"
+`)
+
+	if v, ok := doc.get("MEMSIZE"); !ok || v != "1024" {
+		t.Errorf("get memsize = %q, %t", v, ok)
+	}
+	if v, _ := doc.get("numvcpus"); v != "2" {
+		t.Errorf("get duplicate numvcpus = %q, want the last setting", v)
+	}
+	if _, ok := doc.get("comment"); ok {
+		t.Errorf("comment read as a setting")
+	}
+
+	want := []string{"scsi0:1.fileName", "scsi0:1.present"}
+	if keys := doc.deviceKeys("scsi0:1"); !reflect.DeepEqual(keys, want) {
+		t.Errorf("deviceKeys = %q, want %q", keys, want)
+	}
+
+	doc.set("memsize", "2048")
+	doc.set("numvcpus", "4")
+	if n := doc.deleteDevice("scsi0:1"); n != 2 {
+		t.Errorf("deleteDevice removed %d settings, want 2", n)
+	}
+	if !doc.delete("scsi0:10.present") || doc.delete("scsi0:10.present") {
+		t.Errorf("delete did not report the removed setting")
+	}
+	doc.set("guestinfo.userdata", "abc")
+
+	expected := `# comment
+memSize = "2048"
+numvcpus = "4"
+guestinfo.userdata = "abc"
+`
+	if doc.String() != expected {
+		t.Errorf("edited document:\n%s\nwant:\n%s", doc, expected)
+	}
+}
+
+// TestVmxGolden checks that every vmx file in testdata/vmx encodes back
+// unchanged, and that a fixed set of edits gives the matching .golden file.
+// Run with -update to rewrite the golden files.
+func TestVmxGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "vmx", "*.vmx"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no vmx files in testdata: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc := parseVmx(string(data))
+		if doc.String() != string(data) {
+			t.Errorf("%s: unchanged document does not encode to the original", file)
+		}
+
+		doc.set("memSize", "4096")
+		doc.set("numvcpus", "2")
+		doc.set("displayName", "renamed")
+		doc.set("guestinfo.userdata", "dXNlcmRhdGE=")
+		doc.set("annotation", "line one\n\"quoted\" | #2 café")
+		doc.deleteDevice("ethernet0")
+
+		golden := strings.TrimSuffix(file, ".vmx") + ".golden"
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, []byte(doc.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.String() != string(want) {
+			t.Errorf("%s: edited document does not match %s:\n%s", file, golden, doc)
+		}
+	}
+}
+
+func TestVmxEscape(t *testing.T) {
+	cases := map[string]string{
+		"web01":            "web01",
+		`say "hi"`:         `say |22hi|22`,
+		"a|b#c":            "a|7Cb|23c",
+		"line1\nline2\r\n": "line1|0Aline2|0D|0A",
+		"tab\there":        "tab|09here",
+		"café ☕":           "café ☕",
+		"bad \xff byte":    "bad |FF byte",
+		"":                 "",
+	}
+
+	for in, want := range cases {
+		if got := vmxEscape(in); got != want {
+			t.Errorf("vmxEscape(%q) = %q, want %q", in, got, want)
+		}
+		if got := vmxUnescape(want); got != in {
+			t.Errorf("vmxUnescape(%q) = %q, want %q", want, got, in)
+		}
+	}
+
+	// ESXi writes upper case hex, but either case reads back, and a '|'
+	// that starts no escape is kept.
+	for in, want := range map[string]string{"|7c|0a": "|\n", "a|b": "a|b", "|2": "|2", "|zz": "|zz"} {
+		if got := vmxUnescape(in); got != want {
+			t.Errorf("vmxUnescape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func FuzzVmxEscape(f *testing.F) {
+	f.Add("#cloud-config\nruncmd:\n  - echo \"hi\" | tee /tmp/x\n")
+	f.Add("|22 already escaped")
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		escaped := vmxEscape(value)
+		if strings.ContainsAny(escaped, "\"#\r\n") {
+			t.Fatalf("vmxEscape(%q) = %q is not a safe vmx value", value, escaped)
+		}
+		if got := vmxUnescape(escaped); got != value {
+			t.Fatalf("vmxUnescape(vmxEscape(%q)) = %q", value, got)
+		}
+	})
+}
+
+func FuzzVmxRoundTrip(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "vmx", "*.vmx"))
+	for _, file := range files {
+		if data, err := ioutil.ReadFile(file); err == nil {
+			f.Add(string(data), "memSize", "4096")
+		}
+	}
+	f.Add("", "a", "")
+	f.Add("a = b\n\n# c = \"d\"\r\n", "A", "x y")
+
+	f.Fuzz(func(t *testing.T, contents string, key string, value string) {
+		doc := parseVmx(contents)
+		if doc.String() != contents {
+			t.Fatalf("round trip changed %q to %q", contents, doc.String())
+		}
+
+		if !vmxLineRe.MatchString(key+` = ""`) || strings.ContainsAny(key, "\"\r\n") ||
+			strings.TrimSpace(key) != key || key == "" {
+			return
+		}
+
+		before := doc.keys()
+		doc.set(key, value)
+		reparsed := parseVmx(doc.String())
+		if got, ok := reparsed.get(key); !ok || got != value {
+			t.Fatalf("set %q = %q, read back %q, %t from %q", key, value, got, ok, doc.String())
+		}
+		if len(reparsed.keys()) > len(before)+1 {
+			t.Fatalf("set %q added more than one setting to %q", key, contents)
+		}
+	})
+}
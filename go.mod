@@ -3,6 +3,9 @@ module terraform-provider-esxi
 require (
 	github.com/hashicorp/terraform v0.12.2
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
-	github.com/tmc/scp v0.0.0-20170824174625-f7b48647feef
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mitchellh/go-homedir v1.0.0
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/sftp v1.10.0
 	golang.org/x/crypto v0.0.0-20190611184440-5c40567a22f8
 )